@@ -146,3 +146,18 @@ func KillProc(pid int) error {
 	}
 	return process.Kill()
 }
+
+// HumanSize 将字节数格式化为可读的字符串，例如 1.5MiB
+func HumanSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	f := float64(size)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", size, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", f, units[i])
+}
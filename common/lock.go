@@ -0,0 +1,146 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 跨进程的文件锁，基于 flock(2)：
+//  - 持有锁的进程退出（包括被 kill）时内核自动释放锁，不会因为进程崩溃留下死锁
+//  - 锁文件本身不会删除，残留的锁文件不影响加锁；加锁后检查锁文件是否已被删除或替换，
+//    如果是则重新打开并加锁，避免两个进程分别锁住新旧两个文件
+//  - 锁文件中记录持有锁的进程 pid，超时时用于提示
+
+// DefaultLockTimeout 等待文件锁的默认超时时间
+const DefaultLockTimeout = 10 * time.Second
+
+// lockRetryInterval 加锁失败后的重试间隔
+const lockRetryInterval = 10 * time.Millisecond
+
+var ErrLockTimeout = errors.New("lock timeout")
+
+type FileLock struct {
+	path string
+	file *os.File
+}
+
+// LockFile 以排他方式锁住文件，文件不存在时创建
+// timeout: 等待的最长时间，超时返回 ErrLockTimeout
+func LockFile(path string, timeout time.Duration) (*FileLock, error) {
+	return lockFile(path, syscall.LOCK_EX, timeout)
+}
+
+// RLockFile 以共享方式锁住文件，可以和其他共享锁同时持有
+func RLockFile(path string, timeout time.Duration) (*FileLock, error) {
+	return lockFile(path, syscall.LOCK_SH, timeout)
+}
+
+func lockFile(path string, how int, timeout time.Duration) (*FileLock, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+			if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+				break
+			}
+			if time.Now().After(deadline) {
+				file.Close()
+				return nil, fmt.Errorf("%w: %s is held by %s", ErrLockTimeout, path, lockHolder(path))
+			}
+			time.Sleep(lockRetryInterval)
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("flock %s: %w", path, err)
+		}
+
+		if !sameFile(file, path) {
+			// 等待期间锁文件被删除或替换，锁住的是旧文件，重新加锁
+			file.Close()
+			continue
+		}
+		l := &FileLock{path: path, file: file}
+		if how == syscall.LOCK_EX {
+			l.writeHolder()
+		}
+		return l, nil
+	}
+}
+
+// Unlock 释放锁，可以重复调用
+func (l *FileLock) Unlock() error {
+	if l.file == nil {
+		return nil
+	}
+	// 关闭文件时内核释放锁
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// writeHolder 在锁文件中记录持有锁的进程，失败不影响加锁
+func (l *FileLock) writeHolder() {
+	if err := l.file.Truncate(0); err != nil {
+		return
+	}
+	_, _ = l.file.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+}
+
+// lockHolder 锁文件中记录的持有者，用于超时时的错误信息
+func lockHolder(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "unknown process"
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return "unknown process"
+	}
+	if !IsExistProc(pid) {
+		// 持有者已经退出，说明锁被共享锁或者继承了文件描述符的子进程持有
+		return fmt.Sprintf("pid %d (exited)", pid)
+	}
+	return fmt.Sprintf("pid %d", pid)
+}
+
+// sameFile 判断打开的文件和路径当前指向的是否为同一个文件
+func sameFile(file *os.File, path string) bool {
+	opened, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(opened, current)
+}
+
+// WithFileLock 持有排他锁期间执行 fn
+func WithFileLock(path string, timeout time.Duration, fn func() error) error {
+	l, err := LockFile(path, timeout)
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+	return fn()
+}
+
+// WithFileRLock 持有共享锁期间执行 fn
+func WithFileRLock(path string, timeout time.Duration, fn func() error) error {
+	l, err := RLockFile(path, timeout)
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+	return fn()
+}
@@ -0,0 +1,71 @@
+package common
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lock")
+
+	l, err := LockFile(path, time.Second)
+	assert.NoError(t, err)
+
+	// flock 属于打开的文件，同一进程中再次打开也会互斥
+	_, err = LockFile(path, 50*time.Millisecond)
+	assert.True(t, errors.Is(err, ErrLockTimeout), err)
+	_, err = RLockFile(path, 50*time.Millisecond)
+	assert.True(t, errors.Is(err, ErrLockTimeout), err)
+
+	assert.NoError(t, l.Unlock())
+	assert.NoError(t, l.Unlock())
+
+	r1, err := RLockFile(path, time.Second)
+	assert.NoError(t, err)
+	r2, err := RLockFile(path, time.Second)
+	assert.NoError(t, err)
+	_, err = LockFile(path, 50*time.Millisecond)
+	assert.Error(t, err)
+	r1.Unlock()
+	r2.Unlock()
+}
+
+func TestFileLockReplaced(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lock")
+	l, err := LockFile(path, time.Second)
+	assert.NoError(t, err)
+
+	done := make(chan *FileLock)
+	go func() {
+		l2, err := LockFile(path, 5*time.Second)
+		assert.NoError(t, err)
+		done <- l2
+	}()
+
+	// 等待期间锁文件被删除，持有者随后释放旧文件上的锁
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, os.Remove(path))
+	l.Unlock()
+
+	l2 := <-done
+	assert.True(t, sameFile(l2.file, path))
+	l2.Unlock()
+}
+
+func TestWithFileLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lock")
+	called := false
+	assert.NoError(t, WithFileLock(path, time.Second, func() error {
+		called = true
+		return nil
+	}))
+	assert.True(t, called)
+	assert.EqualError(t, WithFileRLock(path, time.Second, func() error {
+		return errors.New("fn error")
+	}), "fn error")
+}
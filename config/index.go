@@ -20,12 +20,34 @@ const (
 	ContainerConfigDir = ConfigDir + "/config"
 
 	IPPoolPath = ConfigDir + "/ip-pool.json"
+	// PortsLockPath 检查端口冲突到容器运行之间持有的锁，见 Container.LockPorts
+	PortsLockPath = ConfigDir + "/ports.lock"
+	// BootIDPath 上次检查宿主机网络配置时的 boot_id，变化时说明宿主机重启过
+	BootIDPath = ConfigDir + "/boot-id"
+
+	// ImageStoreDir 本地镜像仓库，通过 import 导入
+	ImageStoreDir = ConfigDir + "/images"
+	// VolumeDir 命名卷，通过 volume create 或 run -v name:/path 创建
+	VolumeDir = ConfigDir + "/volumes"
+	// NetworkDir 用户自定义网络，通过 network create 创建
+	NetworkDir = ConfigDir + "/networks"
+	// NetworkAllowRulesPath 网络之间的放行规则，通过 network allow 添加
+	NetworkAllowRulesPath = ConfigDir + "/network-allow.json"
 
 	CgroupsDir = "/sys/fs/cgroup/"
+	// NetNSDir 容器 network namespace 的句柄（bind mount），与 ip netns 使用相同的目录
+	NetNSDir = "/var/run/netns"
 )
 
 // Network
 const (
+	// DefaultNetworkName 默认网络，不指定 --network 时使用，不能删除
+	DefaultNetworkName = "bridge"
 	DefaultBridgeName  = "mini-ctr0"
 	DefaultBridgeIPNet = "192.172.0.1/24"
+
+	// CNIConfDir CNI 网络配置的默认目录，可以通过环境变量 MINI_CONTAINER_CNI_CONF_DIR 修改
+	CNIConfDir = "/etc/cni/net.d"
+	// CNIBinDir CNI 插件的默认目录，可以通过环境变量 MINI_CONTAINER_CNI_PATH 修改，多个目录用 : 分隔
+	CNIBinDir = "/opt/cni/bin"
 )
@@ -1,19 +1,33 @@
 package container
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"mini-container/common"
 	"mini-container/config"
 	"mini-container/internal/cgroup"
 	"mini-container/internal/fs"
 	"mini-container/internal/network"
 	"net"
+	"os"
 	"path/filepath"
+	"strconv"
+	"syscall"
 )
 
 const (
-	StateName  = "state.json"
-	ConfigName = "config.json"
+	StateName     = "state.json"
+	StateLockName = "state.lock" // 修改 state.json 时加锁，见 ContainerState.Update
+	ConfigName    = "config.json"
+
+	// 为容器生成的文件，绑定挂载到容器的 /etc 下
+	HostsName      = "hosts"
+	ResolvConfName = "resolv.conf"
+	HostnameName   = "hostname"
+
+	// BootIDPath 内核每次启动时生成的随机ID
+	BootIDPath = "/proc/sys/kernel/random/boot_id"
 )
 
 type LifeCycle string
@@ -28,10 +42,50 @@ const (
 // ContainerConfig 容器配置
 // ~/.mini-container/config/<container name>/config.json
 type ContainerConfig struct {
-	Name            string           `json:"name"`
-	ImageDir        string           `json:"imageDir"`
-	ChildEntryPoint []string         `json:"childEntryPoint"`
-	Cgroups         []cgroup.ICgroup `json:"cgroups"`
+	Name            string                 `json:"name"`
+	ImageDir        string                 `json:"imageDir"`
+	ChildEntryPoint []string               `json:"childEntryPoint"`
+	Cgroups         []cgroup.ICgroup       `json:"cgroups"`
+	Mounts          []*fs.Mount            `json:"mounts"`         // -v 挂载的宿主机目录或命名卷
+	Tmpfs           []*fs.Tmpfs            `json:"tmpfs"`          // --tmpfs 挂载的 tmpfs
+	ReadOnly        bool                   `json:"readOnly"`       // --read-only 只读的 rootfs
+	Hostname        string                 `json:"hostname"`       // --hostname 容器的主机名，默认为容器名
+	Domainname      string                 `json:"domainname"`     // --domainname 容器的NIS域名
+	DNS             []string               `json:"dns"`            // --dns 指定的 nameserver，为空时使用网络的内置 DNS 或宿主机的配置
+	ExtraHosts      []string               `json:"extraHosts"`     // --add-host 指定的 /etc/hosts 记录，格式 hostname:ip
+	Ports           []*network.PortMapping `json:"ports"`          // -p 发布到宿主机的端口
+	Network         string                 `json:"network"`        // --network 容器连接的网络或网络模式（host、none、container:<name>、cni:<name>），为空时使用默认网络
+	IP              string                 `json:"ip"`             // --ip 静态IP，为空时从网络的IP池中分配
+	StickyIP        bool                   `json:"stickyIP"`       // --sticky-ip 重启后使用上次分配的IP
+	NetworkAliases  []string               `json:"networkAliases"` // --network-alias 内置 DNS 中容器的其他名字
+	// --network-ingress-rate/--network-egress-rate 容器每个网卡进入和发出的速率，单位 bit/s，为0时不限速
+	NetworkIngressRate uint64 `json:"networkIngressRate"`
+	NetworkEgressRate  uint64 `json:"networkEgressRate"`
+}
+
+// EndpointOptions 容器连接到网络时的配置
+func (cc *ContainerConfig) EndpointOptions() *network.EndpointOptions {
+	opts := &network.EndpointOptions{Ports: cc.Ports, IngressRate: cc.NetworkIngressRate, EgressRate: cc.NetworkEgressRate}
+	if cc.IP != "" {
+		opts.IP = net.ParseIP(cc.IP)
+	}
+	if cc.StickyIP {
+		opts.StickyOwner = cc.Name
+	}
+	return opts
+}
+
+// NewNetworkNameSpace 是否为容器创建新的 network namespace，host 和 container 模式使用已有的
+func (cc *ContainerConfig) NewNetworkNameSpace() bool {
+	return network.IsBridgeMode(cc.Network) || network.IsNoneMode(cc.Network) || network.CNINetwork(cc.Network) != ""
+}
+
+// GetHostname 容器的主机名，旧版本创建的容器没有该配置，使用容器名
+func (cc *ContainerConfig) GetHostname() string {
+	if cc.Hostname == "" {
+		return cc.Name
+	}
+	return cc.Hostname
 }
 
 func (cc *ContainerConfig) Load() error {
@@ -45,22 +99,78 @@ func (cc *ContainerConfig) Save() error {
 // ContainerState 容器状态
 // ~/.mini-container/config/<container name>/state.json
 type ContainerState struct {
-	Name         string     `json:"name"`
-	UnionMounted bool       `json:"unionMounted"`
-	LifeCycle    LifeCycle  `json:"lifeCycle"`
-	ParentPID    int        `json:"parentPID"`
-	ChildPID     int        `json:"childPID"`
-	IPNet        *net.IPNet `json:"ipNet"` // x.x.x.x/x, 如果不为nil，表示已经分配了ip，如果在stopped状态需要释放ip
+	Name         string              `json:"name"`
+	UnionMounted bool                `json:"unionMounted"`
+	LifeCycle    LifeCycle           `json:"lifeCycle"`
+	ParentPID    int                 `json:"parentPID"`
+	ChildPID     int                 `json:"childPID"`
+	Endpoints    []*network.Endpoint `json:"endpoints"`           // 容器连接的网络，第一个为启动时的网络，停止时释放，释放失败的保留到下次停止
+	CNIResult    json.RawMessage     `json:"cniResult,omitempty"` // cni:<name> 模式中插件 ADD 的结果，停止时用于 DEL
+	NetNSPath    string              `json:"netnsPath,omitempty"` // 容器 network namespace 的句柄，启动 child 之前创建，停止时删除
+
+	// 旧版本只记录一个网络的配置，读取时转换为 Endpoints
+	LegacyIPNet    *net.IPNet `json:"ipNet,omitempty"`
+	LegacyIPNet6   *net.IPNet `json:"ipNet6,omitempty"`
+	LegacyVethName string     `json:"vethName,omitempty"`
+}
+
+// migrate 将旧版本的网络配置转换为 Endpoints，网络为容器的 --network
+func (cs *ContainerState) migrate() {
+	if cs.LegacyIPNet == nil && cs.LegacyIPNet6 == nil && cs.LegacyVethName == "" {
+		return
+	}
+	ep := &network.Endpoint{IPNet: cs.LegacyIPNet, IPNet6: cs.LegacyIPNet6, VethName: cs.LegacyVethName}
+	cs.Endpoints = append([]*network.Endpoint{ep}, cs.Endpoints...)
+	cs.LegacyIPNet, cs.LegacyIPNet6, cs.LegacyVethName = nil, nil, ""
+}
+
+// IPs 容器在所有网络中的地址，包括 CNI 插件分配的地址
+func (cs *ContainerState) IPs() []net.IP {
+	ips := make([]net.IP, 0, len(cs.Endpoints)*2)
+	for _, ep := range cs.Endpoints {
+		ips = append(ips, ep.IPs()...)
+	}
+	if cs.CNIResult != nil {
+		ips = append(ips, network.CNIResultIPs(cs.CNIResult)...)
+	}
+	return ips
+}
+
+// NetNS 容器的 network namespace，旧版本启动的容器没有句柄，使用 child 进程的 namespace
+func (cs *ContainerState) NetNS() string {
+	if cs.NetNSPath != "" {
+		return cs.NetNSPath
+	}
+	return network.ProcNetNSPath(cs.ChildPID)
 }
 
 func (cs *ContainerState) Load() error {
-	return common.ReadJSON(filepath.Join(config.ContainerConfigDir, cs.Name, StateName), cs)
+	if err := common.ReadJSON(filepath.Join(config.ContainerConfigDir, cs.Name, StateName), cs); err != nil {
+		return err
+	}
+	cs.migrate()
+	return nil
 }
 
 func (cs *ContainerState) Save() error {
 	return common.WriteJSONSync(filepath.Join(config.ContainerConfigDir, cs.Name, StateName), cs)
 }
 
+// Update 锁住容器状态，从磁盘重新读取后调用 fn，fn 成功时保存
+// 多个进程可能同时修改同一个容器的状态，例如 stop 和容器的 parent 进程都会调用 SetStopped
+func (cs *ContainerState) Update(fn func() error) error {
+	lockPath := filepath.Join(config.ContainerConfigDir, cs.Name, StateLockName)
+	return common.WithFileLock(lockPath, common.DefaultLockTimeout, func() error {
+		if err := cs.Load(); err != nil {
+			return err
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+		return cs.Save()
+	})
+}
+
 type Container struct {
 	Config *ContainerConfig
 	State  *ContainerState
@@ -69,10 +179,12 @@ type Container struct {
 // SetRunning 设置容器为运行状态
 // 调用该方法前你需要保证child进程已经启动
 func (c *Container) SetRunning(parentPID, childPID int) error {
-	c.State.LifeCycle = Running
-	c.State.ParentPID = parentPID
-	c.State.ChildPID = childPID
-	return c.State.Save()
+	return c.State.Update(func() error {
+		c.State.LifeCycle = Running
+		c.State.ParentPID = parentPID
+		c.State.ChildPID = childPID
+		return nil
+	})
 }
 
 // Kill 强制停止容器
@@ -92,30 +204,456 @@ func (c *Container) Kill() error {
 	return c.SetStopped()
 }
 
+// 重新读取状态后再释放，另一个进程已经释放过的网络不会被重复释放
 func (c *Container) SetStopped() error {
-	c.State.LifeCycle = Stopped
-	c.State.ParentPID = 0
-	c.State.ChildPID = 0
+	return c.State.Update(func() error {
+		c.State.LifeCycle = Stopped
+		c.State.ParentPID = 0
+		c.State.ChildPID = 0
+
+		// 释放网络，释放失败不影响运行停止，失败的部分记录下来，下次停止时继续释放
+		kept := make([]*network.Endpoint, 0)
+		for _, ep := range c.State.Endpoints {
+			common.ErrLog("release container network", c.releaseEndpoint(ep))
+			if !ep.Released() {
+				kept = append(kept, ep)
+			}
+		}
+		c.State.Endpoints = kept
+		common.ErrLog("release cni network", c.releaseCNI())
+		// 最后删除 network namespace，其中的网卡随之删除
+		if c.State.NetNSPath != "" && !common.ErrLog("delete network namespace", network.DeleteNetworkNameSpace(c.State.NetNSPath)) {
+			c.State.NetNSPath = ""
+		}
+		return nil
+	})
+}
+
+// releaseCNI cni:<name> 模式中执行插件的 DEL，成功后清空 CNIResult，失败时保留到下次停止
+// ADD 没有输出结果时 CNIResult 为空，只要 network namespace 还在就执行 DEL，插件需要支持重复的 DEL
+func (c *Container) releaseCNI() error {
+	name := network.CNINetwork(c.Config.Network)
+	if name == "" {
+		return nil
+	}
+	if c.State.CNIResult == nil && c.State.NetNSPath == "" {
+		return nil
+	}
+	if err := network.DetachCNI(name, c.Config.Name, c.State.NetNSPath, c.State.CNIResult); err != nil {
+		return err
+	}
+	c.State.CNIResult = nil
+	return nil
+}
+
+// CreateNetworkNameSpace 为容器创建 network namespace 并记录句柄，host 和 container 模式不创建
+// 调用该方法前你需要保证容器已经停止，child 启动后通过 JoinNetworkForChild 加入
+func (c *Container) CreateNetworkNameSpace() error {
+	if !c.Config.NewNetworkNameSpace() {
+		return nil
+	}
+	path, err := network.CreateNetworkNameSpace(c.Config.Name)
+	if err != nil {
+		return err
+	}
+	err = c.State.Update(func() error {
+		c.State.NetNSPath = path
+		return nil
+	})
+	if err != nil {
+		common.ErrLog("delete network namespace", network.DeleteNetworkNameSpace(path))
+	}
+	return err
+}
 
-	// 释放ip，释放失败不影响运行停止
-	if c.State.IPNet != nil {
-		if !common.ErrLog("release container ip",
-			network.ReleaseNetworkForContainer(c.State.IPNet.String())) {
-			c.State.IPNet = nil
+// endpointNetwork Endpoint 所在的网络名，旧版本的 Endpoint 没有记录网络，为容器的 --network
+func (c *Container) endpointNetwork(ep *network.Endpoint) string {
+	if ep.Network == "" {
+		return networkName(c.Config.Network)
+	}
+	return ep.Network
+}
+
+// networkName 网络名，为空时为默认网络
+func networkName(name string) string {
+	if name == "" {
+		return config.DefaultNetworkName
+	}
+	return name
+}
+
+// endpointIn 容器在网络中的 Endpoint，没有连接到该网络时返回 nil
+func (c *Container) endpointIn(name string) *network.Endpoint {
+	for _, ep := range c.State.Endpoints {
+		if c.endpointNetwork(ep) == name {
+			return ep
 		}
 	}
-	return c.State.Save()
+	return nil
+}
+
+// releaseEndpoint 释放容器在一个网络中的配置，端口映射只发布在启动时的网络上
+// 释放成功的部分会从 Endpoint 中清空
+func (c *Container) releaseEndpoint(ep *network.Endpoint) error {
+	name := c.endpointNetwork(ep)
+	nw, err := network.GetNetwork(name)
+	if err != nil {
+		return err
+	}
+	var ports []*network.PortMapping
+	if name == networkName(c.Config.Network) {
+		ports = c.Config.Ports
+	}
+	return network.ReleaseNetworkForContainer(nw, ep, c.State.NetNS(), ports)
 }
 
-// ConfigChildNetworkInParent 配置容器的网络
+// ConfigChildNetworkInParent 配置容器的网络，配置在容器的 network namespace 中进行，不依赖 child 进程
 // 调用该方法前你需要保证child进程已经启动，并且已经调用 SetRunning
 func (c *Container) ConfigChildNetworkInParent() error {
-	ipNet, err := network.ConfigNetworkForContainer(c.State.ChildPID)
+	switch {
+	case network.IsNoneMode(c.Config.Network):
+		return common.ErrTag("config loopback", network.ConfigNoneNetworkForContainer(c.State.NetNS()))
+	case network.CNINetwork(c.Config.Network) != "":
+		return c.configCNI()
+	case !network.IsBridgeMode(c.Config.Network):
+		// host 模式不需要配置，container 模式由 child 加入目标容器的网络，见 JoinNetworkForChild
+		return nil
+	}
+
+	nw, err := network.GetNetwork(c.Config.Network)
+	if err != nil {
+		return err
+	}
+	var configErr error
+	err = c.State.Update(func() error {
+		var ep *network.Endpoint
+		ep, configErr = network.ConfigNetworkForContainer(c.State.ChildPID, c.State.NetNS(), nw, c.Config.EndpointOptions())
+		// 配置失败时ip和veth可能已经分配，仍然需要记录，停止时释放
+		c.State.Endpoints = append(c.State.Endpoints, ep)
+		return nil
+	})
+	return common.ErrTag("config network", configErr, err)
+}
+
+// configCNI 执行 CNI 插件的 ADD 并记录结果，失败时插件已经撤销，不需要记录
+func (c *Container) configCNI() error {
+	result, err := network.AttachCNI(network.CNINetwork(c.Config.Network), c.Config.Name, c.State.NetNS())
+	if err != nil {
+		return common.ErrTag("config cni network", err)
+	}
+	return common.ErrTag("config cni network", c.State.Update(func() error {
+		c.State.CNIResult = result
+		return nil
+	}))
+}
+
+// CheckCNINetwork 执行 CNI 插件的 CHECK，检查运行中的容器的网络与 ADD 的结果一致
+func (c *Container) CheckCNINetwork() error {
+	name := network.CNINetwork(c.Config.Network)
+	if name == "" {
+		return fmt.Errorf("container %s is not in cni network mode", c.Config.Name)
+	}
+	if !c.IsRunning() {
+		return fmt.Errorf("container %s is not running", c.Config.Name)
+	}
+	return network.CheckCNI(name, c.Config.Name, c.State.NetNS(), c.State.CNIResult)
+}
+
+// Connect 将运行中的容器连接到另一个网络：在容器中增加一个网卡，不添加默认路由，也不发布端口，限速与其他网卡相同
+// 容器停止时断开，再次启动时只连接 --network 指定的网络
+func (c *Container) Connect(name string) error {
+	if !c.IsRunning() {
+		return fmt.Errorf("container %s is not running", c.Config.Name)
+	}
+	if !network.IsBridgeMode(c.Config.Network) {
+		return fmt.Errorf("container %s uses network mode %s", c.Config.Name, c.Config.Network)
+	}
+	nw, err := network.GetNetwork(name)
+	if err != nil {
+		return err
+	}
+
+	var configErr error
+	err = c.State.Update(func() error {
+		if c.endpointIn(nw.Name) != nil {
+			return fmt.Errorf("container %s is already connected to network %s", c.Config.Name, nw.Name)
+		}
+		var ep *network.Endpoint
+		opts := &network.EndpointOptions{
+			NoDefaultRoute: true,
+			IngressRate:    c.Config.NetworkIngressRate,
+			EgressRate:     c.Config.NetworkEgressRate,
+		}
+		ep, configErr = network.ConfigNetworkForContainer(c.State.ChildPID, c.State.NetNS(), nw, opts)
+		if configErr != nil {
+			// 立即释放已经分配的部分，释放失败时记录下来，停止时继续释放
+			common.ErrLog("release container network", network.ReleaseNetworkForContainer(nw, ep, c.State.NetNS(), nil))
+			if ep.Released() {
+				return nil
+			}
+		}
+		c.State.Endpoints = append(c.State.Endpoints, ep)
+		return nil
+	})
+	if err := common.ErrTag("connect network "+nw.Name, configErr, err); err != nil {
+		return err
+	}
+	// 其他网络中的容器可以通过该网络的内置 DNS 解析到容器
+	common.ErrLog("start dns server", nw.EnsureDNSServer())
+	return common.ErrTag("update etc files", c.ConfigEtcFilesInParent())
+}
+
+// Disconnect 断开运行中的容器与 Connect 连接的网络，删除容器中的网卡并释放地址
+func (c *Container) Disconnect(name string) error {
+	nw, err := network.GetNetwork(name)
+	if err != nil {
+		return err
+	}
+	if nw.Name == networkName(c.Config.Network) {
+		return fmt.Errorf("can not disconnect container %s from network %s it was started with", c.Config.Name, nw.Name)
+	}
+	var releaseErr error
+	err = c.State.Update(func() error {
+		ep := c.endpointIn(nw.Name)
+		if ep == nil {
+			return fmt.Errorf("container %s is not connected to network %s", c.Config.Name, nw.Name)
+		}
+		// 部分释放的结果也需要保存
+		releaseErr = c.releaseEndpoint(ep)
+		if ep.Released() {
+			kept := make([]*network.Endpoint, 0, len(c.State.Endpoints))
+			for _, other := range c.State.Endpoints {
+				if other != ep {
+					kept = append(kept, other)
+				}
+			}
+			c.State.Endpoints = kept
+		}
+		return nil
+	})
+	if err := common.ErrTag("disconnect network "+nw.Name, releaseErr, err); err != nil {
+		return err
+	}
+	if c.IsRunning() {
+		return common.ErrTag("update etc files", c.ConfigEtcFilesInParent())
+	}
+	return nil
+}
+
+// UpdateBandwidth 修改容器的限速，容器运行中时立即更新所有网卡的限速，速率为0时不限速
+func (c *Container) UpdateBandwidth(ingressRate, egressRate uint64) error {
+	if !network.IsBridgeMode(c.Config.Network) {
+		return fmt.Errorf("container %s uses network mode %s", c.Config.Name, c.Config.Network)
+	}
+	// 与 run 相同，macvlan/ipvlan 子接口没有宿主机端，不支持限速
+	nw, err := network.GetNetwork(networkName(c.Config.Network))
+	if err != nil {
+		return err
+	}
+	if !nw.IsBridge() {
+		return fmt.Errorf("--network-*-rate can not be used with %s network %s", nw.Driver, nw.Name)
+	}
+	c.Config.NetworkIngressRate = ingressRate
+	c.Config.NetworkEgressRate = egressRate
+	if err := c.Config.Save(); err != nil {
+		return err
+	}
+	if !c.IsRunning() {
+		return nil
+	}
+	// 加锁读取 Endpoints，避免与 Connect/Disconnect 同时修改网卡
+	return c.State.Update(func() error {
+		for _, ep := range c.State.Endpoints {
+			if err := network.SetBandwidth(ep, ingressRate, egressRate); err != nil {
+				return common.ErrTag("set bandwidth in network "+c.endpointNetwork(ep), err)
+			}
+		}
+		return nil
+	})
+}
+
+// SharedNetworkContainer container:<name> 模式中共享网络的容器，必须在运行中
+func (cc *ContainerConfig) SharedNetworkContainer() (*Container, error) {
+	name := network.SharedContainer(cc.Network)
+	if name == "" {
+		return nil, fmt.Errorf("container %s does not share the network of another container", cc.Name)
+	}
+	if name == cc.Name {
+		return nil, fmt.Errorf("container %s can not share its own network", name)
+	}
+	target, err := NewContainerFromDisk(name)
+	if err != nil {
+		return nil, fmt.Errorf("container %s not found", name)
+	}
+	if !target.IsRunning() {
+		return nil, fmt.Errorf("container %s is not running", name)
+	}
+	return target, nil
+}
+
+// JoinNetworkForChild 加入容器的 network namespace：parent 为容器创建的，或 container:<name> 模式中目标容器的，host 模式不做处理
+// 注意：需要在child中、切换 rootfs 之前执行，之后的操作（包括 exec）都在加入 namespace 的线程上进行
+func (c *Container) JoinNetworkForChild() error {
+	if name := network.SharedContainer(c.Config.Network); name != "" {
+		// child 在新的 pid namespace 中，看不到目标容器的进程，不能通过 IsRunning 检查，由 parent 在启动 child 之前检查
+		target, err := NewContainerFromDisk(name)
+		if err != nil {
+			return fmt.Errorf("container %s not found", name)
+		}
+		return network.JoinNetworkNameSpace(target.State.NetNS())
+	}
+	if c.State.NetNSPath == "" {
+		return nil
+	}
+	return network.JoinNetworkNameSpace(c.State.NetNSPath)
+}
+
+// networkNameSpace 容器的进程所在的 network namespace，host 模式返回空字符串
+func (c *Container) networkNameSpace() (string, error) {
+	switch {
+	case network.SharedContainer(c.Config.Network) != "":
+		target, err := c.Config.SharedNetworkContainer()
+		if err != nil {
+			return "", err
+		}
+		return target.State.NetNS(), nil
+	case c.Config.NewNetworkNameSpace():
+		return c.State.NetNS(), nil
+	default:
+		return "", nil
+	}
+}
+
+// ExecArgs 在运行中的容器内执行命令的 nsenter 参数：加入 child 进程的 mount、uts、ipc、pid namespace
+// 以及容器的 network namespace，根目录和工作目录与 child 进程相同
+func (c *Container) ExecArgs(command []string) ([]string, error) {
+	if !c.IsRunning() {
+		return nil, fmt.Errorf("container %s is not running", c.Config.Name)
+	}
+	netns, err := c.networkNameSpace()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"--target", strconv.Itoa(c.State.ChildPID), "--mount", "--uts", "--ipc", "--pid"}
+	if netns != "" {
+		args = append(args, "--net="+netns)
+	}
+	args = append(args, "--root", "--wd", "--")
+	return append(args, command...), nil
+}
+
+// JoinCgroups 将进程 pid 加入容器的 cgroups
+// exec 在启动 nsenter 之前加入，nsenter 没有 cgroup namespace 可以加入，容器中执行的命令通过继承受到容器的资源限制
+func (c *Container) JoinCgroups(pid int) error {
+	for _, cg := range c.Config.Cgroups {
+		if err := cgroup.Join(cg, pid); err != nil {
+			return common.ErrTag("join "+string(cg.Type())+" cgroup", err)
+		}
+	}
+	return nil
+}
+
+// LockPorts 锁住宿主机端口的分配，期间其他容器的 LockPorts 需要等待
+// 从 CheckPortConflicts 之前持有到容器标记为运行中并配置完端口映射之后，避免并发启动的容器都通过检查
+// 没有发布端口时不加锁，返回的锁同样可以 Unlock
+func (c *Container) LockPorts() (*common.FileLock, error) {
+	if len(c.Config.Ports) == 0 {
+		return &common.FileLock{}, nil
+	}
+	return common.LockFile(config.PortsLockPath, common.DefaultLockTimeout)
+}
+
+// CheckPortConflicts 检查容器发布的端口是否已被其他运行中的容器占用
+func (c *Container) CheckPortConflicts() error {
+	if len(c.Config.Ports) == 0 {
+		return nil
+	}
+	containers, err := ListContainers()
 	if err != nil {
 		return err
 	}
-	c.State.IPNet = ipNet
-	return c.State.Save()
+	for _, other := range containers {
+		if other.Config.Name == c.Config.Name || !other.IsRunning() {
+			continue
+		}
+		for _, pm := range c.Config.Ports {
+			for _, op := range other.Config.Ports {
+				if pm.Conflicts(op) {
+					return fmt.Errorf("port %s is already allocated by container %s", pm, other.Config.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ConfigEtcFilesInParent 生成容器的 hosts、resolv.conf、hostname 文件
+// 调用该方法前你需要保证已经调用 ConfigChildNetworkInParent
+func (c *Container) ConfigEtcFilesInParent() error {
+	// container 模式使用目标容器的地址和网络
+	state, networkName := c.State, c.Config.Network
+	if network.SharedContainer(c.Config.Network) != "" {
+		target, err := c.Config.SharedNetworkContainer()
+		if err != nil {
+			return err
+		}
+		state, networkName = target.State, target.Config.Network
+	}
+	ips := state.IPs()
+	hostname := c.Config.GetHostname()
+	hosts, err := network.BuildHosts(ips, network.HostAliases(hostname, c.Config.Domainname), c.Config.ExtraHosts)
+	if err != nil {
+		return common.ErrTag("build hosts", err)
+	}
+	resolvConf, err := network.BuildResolvConf(nameservers(networkName, c.Config.DNS, state.CNIResult), network.IsHostMode(c.Config.Network))
+	if err != nil {
+		return common.ErrTag("build resolv.conf", err)
+	}
+
+	dir := filepath.Join(config.ContainerConfigDir, c.Config.Name)
+	return common.ErrTag("write etc files",
+		os.WriteFile(filepath.Join(dir, HostsName), []byte(hosts), 0644),
+		os.WriteFile(filepath.Join(dir, ResolvConfName), []byte(resolvConf), 0644),
+		os.WriteFile(filepath.Join(dir, HostnameName), []byte(hostname+"\n"), 0644),
+	)
+}
+
+// nameservers 容器使用的 DNS：指定了 --dns 时使用指定的，连接到网络时使用网络的内置 DNS，cni 模式使用插件返回的 DNS，
+// 网络没有内置 DNS 或内置 DNS 启动失败时返回 nil，使用宿主机的配置
+func nameservers(networkName string, dns []string, cniResult json.RawMessage) []string {
+	if len(dns) == 0 && network.CNINetwork(networkName) != "" {
+		return network.CNIResultNameservers(cniResult)
+	}
+	if len(dns) > 0 || !network.IsBridgeMode(networkName) {
+		return dns
+	}
+	nw, err := network.GetNetwork(networkName)
+	if err == nil {
+		err = nw.EnsureDNSServer()
+	}
+	if common.ErrLog("start dns server", err) || nw.DNSAddr() == nil {
+		// macvlan/ipvlan 网络没有内置 DNS
+		return nil
+	}
+	return []string{nw.DNSAddr().String()}
+}
+
+// etcMounts 将生成的 hosts、resolv.conf、hostname 绑定挂载到容器的 /etc 下
+func (c *Container) etcMounts() []*fs.Mount {
+	dir := filepath.Join(config.ContainerConfigDir, c.Config.Name)
+	mounts := make([]*fs.Mount, 0, 3)
+	for _, name := range []string{HostsName, ResolvConfName, HostnameName} {
+		source := filepath.Join(dir, name)
+		if !common.IsExistPath(source) {
+			continue
+		}
+		mounts = append(mounts, &fs.Mount{
+			Source:      source,
+			Target:      filepath.Join("/etc", name),
+			Propagation: fs.DefaultPropagation,
+		})
+	}
+	return mounts
 }
 
 // ConfigChildCgroupsInParent 配置容器的cgroups
@@ -129,8 +667,35 @@ func (c *Container) ConfigChildCgroupsInParent() error {
 	return nil
 }
 
+// Diff 列出容器相对镜像的文件变更
+func (c *Container) Diff() ([]fs.Change, error) {
+	return fs.DiffForContainer(c.Config.Name, c.Config.ImageDir)
+}
+
+// Export 以tar流的方式导出容器的 rootfs
+func (c *Container) Export(w io.Writer) error {
+	return fs.ExportForContainer(c.Config.Name, c.Config.ImageDir, w)
+}
+
+// ConfigHostnameForChild 在容器的 UTS namespace 中设置主机名和域名
+// 注意：需要在child中执行
+func (c *Container) ConfigHostnameForChild() error {
+	if err := syscall.Sethostname([]byte(c.Config.GetHostname())); err != nil {
+		return common.ErrTag("set hostname", err)
+	}
+	if c.Config.Domainname == "" {
+		return nil
+	}
+	return common.ErrTag("set domainname", syscall.Setdomainname([]byte(c.Config.Domainname)))
+}
+
 func (c *Container) ConfigRootfsForChild() error {
-	return fs.ChangeRootForContainer(c.Config.Name)
+	// 用户指定的 volume 在后面挂载，可以覆盖生成的文件
+	return fs.ChangeRootForContainer(c.Config.Name, &fs.RootfsOptions{
+		Mounts:   append(c.etcMounts(), c.Config.Mounts...),
+		Tmpfs:    c.Config.Tmpfs,
+		ReadOnly: c.Config.ReadOnly,
+	})
 }
 
 // IsRunning 判断容器是否在运行状态
@@ -181,6 +746,18 @@ func (c *Container) Remove() error {
 			return common.ErrTag("release cgroup", err)
 		}
 	}
+	if err := detachVolumes(c.Config); err != nil {
+		return common.ErrTag("detach volumes", err)
+	}
+	if c.Config.StickyIP {
+		if err := network.ReleaseStickyIPs(c.Config.Name); err != nil {
+			return common.ErrTag("release sticky ip", err)
+		}
+	}
+	// 启动失败时 network namespace 可能没有被删除
+	if err := network.DeleteNetworkNameSpace(network.NetNSPath(c.Config.Name)); err != nil {
+		return common.ErrTag("delete network namespace", err)
+	}
 	return RemoveContainerForce(c.Config.Name)
 }
 
@@ -193,8 +770,10 @@ func (c *Container) FixCreatedToStopped() error {
 	// 检查容器初始化配置
 	// 暂时没有需要检查的
 
-	c.State.LifeCycle = Stopped
-	return c.State.Save()
+	return c.State.Update(func() error {
+		c.State.LifeCycle = Stopped
+		return nil
+	})
 }
 
 // AddCgroup 添加cgroup
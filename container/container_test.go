@@ -0,0 +1,119 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"mini-container/internal/cgroup"
+	"mini-container/internal/network"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestStateMigrate(t *testing.T) {
+	legacy := `{"name":"test","lifeCycle":"running","childPID":10,
+		"ipNet":{"IP":"192.172.0.2","Mask":"////AA=="},"vethName":"veth-10-123"}`
+	cs := &ContainerState{}
+	assert.NoError(t, json.Unmarshal([]byte(legacy), cs))
+	cs.migrate()
+	assert.Len(t, cs.Endpoints, 1)
+	assert.Equal(t, "", cs.Endpoints[0].Network)
+	assert.Equal(t, "192.172.0.2/24", cs.Endpoints[0].IPNet.String())
+	assert.Equal(t, "veth-10-123", cs.Endpoints[0].VethName)
+	assert.Equal(t, "192.172.0.2", cs.IPs()[0].String())
+
+	// 保存时不再写入旧的字段，再次读取时不会重复转换
+	data, err := json.Marshal(cs)
+	assert.NoError(t, err)
+	fields := map[string]any{}
+	assert.NoError(t, json.Unmarshal(data, &fields))
+	assert.NotContains(t, fields, "ipNet")
+	assert.NotContains(t, fields, "vethName")
+	cs = &ContainerState{}
+	assert.NoError(t, json.Unmarshal(data, cs))
+	cs.migrate()
+	assert.Len(t, cs.Endpoints, 1)
+}
+
+func TestEndpointIn(t *testing.T) {
+	c := &Container{
+		Config: &ContainerConfig{Name: "test"},
+		State: &ContainerState{Endpoints: []*network.Endpoint{
+			{VethName: "veth-10-123"},
+			{Network: "web", VethName: "veth-10-456"},
+		}},
+	}
+	// 旧版本的 Endpoint 属于容器的 --network，为空时为默认网络
+	assert.Equal(t, "veth-10-123", c.endpointIn("bridge").VethName)
+	assert.Equal(t, "veth-10-456", c.endpointIn("web").VethName)
+	assert.Nil(t, c.endpointIn("db"))
+}
+
+func TestCNIState(t *testing.T) {
+	cs := &ContainerState{CNIResult: json.RawMessage(`{"cniVersion":"1.0.0","ips":[{"address":"10.22.0.5/16"},{"address":"fd00::5/64"}],"dns":{"nameservers":["10.22.0.1"]}}`)}
+	assert.Len(t, cs.IPs(), 2)
+	assert.Equal(t, "10.22.0.5", cs.IPs()[0].String())
+	assert.Equal(t, "fd00::5", cs.IPs()[1].String())
+
+	cc := &ContainerConfig{Network: "cni:mynet"}
+	assert.True(t, cc.NewNetworkNameSpace())
+	assert.Equal(t, []string{"10.22.0.1"}, nameservers(cc.Network, nil, cs.CNIResult))
+	assert.Equal(t, []string{"1.1.1.1"}, nameservers(cc.Network, []string{"1.1.1.1"}, cs.CNIResult))
+	assert.Nil(t, nameservers(cc.Network, nil, nil))
+}
+
+func TestExecArgs(t *testing.T) {
+	pid := os.Getpid()
+	c := &Container{
+		Config: &ContainerConfig{Name: "test", Network: "bridge"},
+		State:  &ContainerState{Name: "test", LifeCycle: Running, ChildPID: pid},
+	}
+	// 旧版本启动的容器没有句柄，使用 child 进程的 namespace
+	assert.Equal(t, fmt.Sprintf("/proc/%d/ns/net", pid), c.State.NetNS())
+	c.State.NetNSPath = "/var/run/netns/mc-test"
+	args, err := c.ExecArgs([]string{"ip", "addr"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"--target", strconv.Itoa(pid), "--mount", "--uts", "--ipc", "--pid",
+		"--net=/var/run/netns/mc-test", "--root", "--wd", "--", "ip", "addr"}, args)
+
+	// host 模式不加入 network namespace
+	c.Config.Network = "host"
+	args, err = c.ExecArgs([]string{"sh"})
+	assert.NoError(t, err)
+	assert.NotContains(t, strings.Join(args, " "), "--net")
+
+	// 容器没有 cgroup namespace，exec 进程在启动 nsenter 之前通过 JoinCgroups 加入容器的 cgroups，见 TestJoinCgroups
+	c.Config.Cgroups = []cgroup.ICgroup{cgroup.NewCPUCgroup("test", 50), cgroup.NewMemoryCgroup("test", 64)}
+	args, err = c.ExecArgs([]string{"sh"})
+	assert.NoError(t, err)
+	assert.NotContains(t, args, "--cgroup")
+
+	c.State.LifeCycle = Stopped
+	_, err = c.ExecArgs([]string{"sh"})
+	assert.Error(t, err)
+}
+
+func TestJoinCgroups(t *testing.T) {
+	old := cgroup.Root
+	cgroup.Root = t.TempDir()
+	defer func() { cgroup.Root = old }()
+
+	c := &Container{Config: &ContainerConfig{Name: "test", Cgroups: []cgroup.ICgroup{
+		cgroup.NewCPUCgroup("test", 50), cgroup.NewMemoryCgroup("test", 64),
+	}}}
+	// cgroup 目录不存在时（容器的 cgroups 还没有创建）报错，不会创建新的 cgroup
+	assert.ErrorContains(t, c.JoinCgroups(1234), "join cpu cgroup")
+
+	for _, cg := range c.Config.Cgroups {
+		assert.NoError(t, os.MkdirAll(cgroup.CgroupPath(cg), 0755))
+	}
+	assert.NoError(t, c.JoinCgroups(1234))
+	for _, sub := range []string{"cpu", "memory"} {
+		data, err := os.ReadFile(filepath.Join(cgroup.Root, sub, "mini-container", "test", "cgroup.procs"))
+		assert.NoError(t, err, sub)
+		assert.Equal(t, "1234", string(data), sub)
+	}
+}
@@ -1,11 +1,16 @@
 package container
 
 import (
+	"bytes"
+	"fmt"
 	"mini-container/common"
 	"mini-container/config"
 	"mini-container/internal/cgroup"
 	"mini-container/internal/fs"
 	"mini-container/internal/network"
+	"mini-container/internal/network/dns"
+	"mini-container/internal/volume"
+	"net"
 	"os"
 	"path/filepath"
 )
@@ -16,24 +21,37 @@ func ExistsContainer(name string) bool {
 }
 
 // NewCreatedContainer 创建一个创建状态的容器
+// cc: 由调用方填写 Name、ImageDir、ChildEntryPoint 以及可选配置
 // 注意：调用前需要确保容器不存在
-func NewCreatedContainer(name, imageDir string, entryPoint []string) (*Container, error) {
-	cc := &ContainerConfig{
-		Name:            name,
-		ImageDir:        imageDir,
-		ChildEntryPoint: entryPoint,
-		Cgroups:         make([]cgroup.ICgroup, 0),
+func NewCreatedContainer(cc *ContainerConfig) (*Container, error) {
+	name := cc.Name
+	// 保存绝对路径，后续 diff 等操作不依赖当前工作目录
+	imageDir, err := filepath.Abs(cc.ImageDir)
+	if err != nil {
+		return nil, err
+	}
+	cc.ImageDir = imageDir
+	if cc.Hostname == "" {
+		cc.Hostname = name
+	}
+	if cc.Cgroups == nil {
+		cc.Cgroups = make([]cgroup.ICgroup, 0)
+	}
+	for _, m := range cc.Mounts {
+		if m.Volume == "" && !common.IsExistPath(m.Source) {
+			return nil, fmt.Errorf("volume source %s not found", m.Source)
+		}
 	}
+
 	cs := &ContainerState{
 		Name:         name,
 		UnionMounted: false,
 		LifeCycle:    Created,
 		ParentPID:    0,
 		ChildPID:     0,
-		IPNet:        nil,
 	}
 
-	err := common.ErrTag("new created container",
+	err = common.ErrTag("new created container",
 		fs.CreateContainerDir(name),
 		fs.UnionMountForContainer(name, imageDir),
 	)
@@ -43,12 +61,54 @@ func NewCreatedContainer(name, imageDir string, entryPoint []string) (*Container
 	}
 	cs.UnionMounted = true
 
-	err = common.ErrTag("new created container",
-		cc.Save(), cs.Save())
+	// RemoveContainerForce 不会删除卷的引用，失败时需要先撤销已经记录的引用，否则卷无法删除
+	err = common.ErrTag("new created container", attachVolumes(cc))
+	if err == nil {
+		err = common.ErrTag("new created container", cc.Save(), cs.Save())
+	}
+	if err != nil {
+		common.ErrLog("new created container", detachVolumes(cc))
+		RemoveContainerForce(name)
+		return nil, err
+	}
 	return &Container{
 		Config: cc,
 		State:  cs,
-	}, err
+	}, nil
+}
+
+// attachVolumes 为命名卷填写数据目录并记录引用，第一次使用的卷会拷贝镜像中挂载点的已有内容
+// 注意：需要在联合挂载之后调用
+func attachVolumes(cc *ContainerConfig) error {
+	rootfs := filepath.Join(config.ContainerMountDir, cc.Name)
+	for _, m := range cc.Mounts {
+		if m.Volume == "" {
+			continue
+		}
+		initDir, err := fs.ResolveInRoot(rootfs, m.Target)
+		if err != nil {
+			return err
+		}
+		v, err := volume.Attach(m.Volume, cc.Name, initDir)
+		if err != nil {
+			return err
+		}
+		m.Source = v.DataDir()
+	}
+	return nil
+}
+
+// detachVolumes 删除容器对命名卷的引用
+func detachVolumes(cc *ContainerConfig) error {
+	for _, m := range cc.Mounts {
+		if m.Volume == "" {
+			continue
+		}
+		if err := volume.Detach(m.Volume, cc.Name); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // NewContainerFromDisk 从磁盘上加载容器配置和状态
@@ -77,9 +137,62 @@ func InitHostConfig() error {
 		os.MkdirAll(config.ContainerConfigDir, 0755),
 
 		network.InitBridgeAndIPPool(),
+		reconcileAfterBoot(),
 	))
 }
 
+// reconcileAfterBoot 宿主机重启后（boot_id 变化）修复网络配置，并释放重启前运行的容器占用的IP
+func reconcileAfterBoot() error {
+	bootID, err := os.ReadFile(BootIDPath)
+	if err != nil {
+		return err
+	}
+	saved, err := os.ReadFile(config.BootIDPath)
+	if err == nil && bytes.Equal(saved, bootID) {
+		return nil
+	}
+
+	// 没有记录过 boot_id 时无法判断是否重启过，只按 IsRunning 修复
+	if err == nil {
+		containers, err := ListContainers()
+		if err != nil {
+			return err
+		}
+		for _, c := range containers {
+			// 重启前的进程都已经退出，pid 可能已经被其他进程复用，不能通过 IsRunning 判断
+			if c.State.LifeCycle == Running {
+				common.ErrLog("reconcile container "+c.Config.Name, c.SetStopped())
+			}
+		}
+	}
+	if err := ReconcileHostNetwork(); err != nil {
+		return err
+	}
+	return os.WriteFile(config.BootIDPath, bootID, 0644)
+}
+
+// ReconcileHostNetwork 检查并修复所有网络在宿主机上的配置，IP池中只保留运行中的容器的地址
+func ReconcileHostNetwork() error {
+	containers, err := ListContainers()
+	if err != nil {
+		return err
+	}
+	leases := make([]*net.IPNet, 0)
+	for _, c := range containers {
+		if !c.IsRunning() {
+			continue
+		}
+		for _, ep := range c.State.Endpoints {
+			for _, ipNet := range []*net.IPNet{ep.IPNet, ep.IPNet6} {
+				if ipNet != nil {
+					leases = append(leases, ipNet)
+				}
+			}
+		}
+	}
+	return network.ReconcileHostNetwork(leases)
+}
+
 // ListContainers 列出所有容器
 func ListContainers() ([]*Container, error) {
 	containers := make([]*Container, 0)
@@ -103,6 +216,93 @@ func ListContainers() ([]*Container, error) {
 	return containers, nil
 }
 
+// ListContainersInNetwork 列出连接到网络的容器名，包括通过 network connect 连接的容器
+func ListContainersInNetwork(name string) ([]string, error) {
+	names := make([]string, 0)
+	containers, err := ListContainers()
+	if err != nil {
+		return names, err
+	}
+	for _, c := range containers {
+		if networkName(c.Config.Network) == name || c.endpointIn(name) != nil {
+			names = append(names, c.Config.Name)
+		}
+	}
+	return names, nil
+}
+
+// DNSRecords 网络中运行的容器的名字和地址，用于网络的内置 DNS
+// 包括通过 network connect 连接的容器，以及通过 container:<name> 共享这些容器网络的容器，它们使用被共享容器的地址
+func DNSRecords(name string) ([]*dns.Record, error) {
+	containers, err := ListContainers()
+	if err != nil {
+		return nil, err
+	}
+	// 不使用 IsRunning，DNS 进程不应修改容器的状态
+	alive := func(c *Container) bool {
+		return c.State.LifeCycle == Running && common.IsExistProc(c.State.ChildPID)
+	}
+	ips := make(map[string][]net.IP)
+	for _, c := range containers {
+		if ep := c.endpointIn(name); ep != nil && alive(c) {
+			ips[c.Config.Name] = ep.IPs()
+		}
+	}
+
+	records := make([]*dns.Record, 0, len(ips))
+	for _, c := range containers {
+		owner := c.Config.Name
+		if shared := network.SharedContainer(c.Config.Network); shared != "" {
+			owner = shared
+		}
+		if len(ips[owner]) == 0 || !alive(c) {
+			continue
+		}
+		names := append([]string{c.Config.Name}, c.Config.NetworkAliases...)
+		if c.Config.Hostname != "" {
+			names = append(names, c.Config.Hostname)
+		}
+		records = append(records, &dns.Record{Names: names, IPs: ips[owner]})
+	}
+	return records, nil
+}
+
+// CheckStaticIP 检查容器的静态IP可以在其网络中使用，并且没有被其他容器指定
+func CheckStaticIP(cc *ContainerConfig) error {
+	if cc.IP == "" {
+		return nil
+	}
+	ip := net.ParseIP(cc.IP)
+	if ip == nil {
+		return fmt.Errorf("invalid ip %q", cc.IP)
+	}
+	nw, err := network.GetNetwork(cc.Network)
+	if err != nil {
+		return err
+	}
+	if err := network.ValidateStaticIP(nw, ip); err != nil {
+		return err
+	}
+	containers, err := ListContainersInNetwork(nw.Name)
+	if err != nil {
+		return err
+	}
+	for _, name := range containers {
+		other, err := NewContainerFromDisk(name)
+		if err != nil {
+			return err
+		}
+		// 静态IP属于容器启动时的网络
+		if networkName(other.Config.Network) != nw.Name {
+			continue
+		}
+		if other.Config.IP != "" && net.ParseIP(other.Config.IP).Equal(ip) {
+			return fmt.Errorf("ip %s is already used by container %s", cc.IP, name)
+		}
+	}
+	return nil
+}
+
 // RemoveContainerForce 强制删除容器
 // 注意：该删除方法不涉及删除cgroups
 func RemoveContainerForce(name string) error {
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+// stringSlice 可重复指定的字符串参数，例如 -v a:/a -v b:/b
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSlice) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// parseInterleaved 解析位置参数和flag交替出现的参数列表，例如 `diff test1 --json`
+// return: 位置参数
+func parseInterleaved(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional := make([]string, 0)
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
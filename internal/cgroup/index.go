@@ -11,6 +11,9 @@ import (
 	"strconv"
 )
 
+// Root cgroup v1 各个子系统的挂载点所在的目录，测试时替换为临时目录
+var Root = config.CgroupsDir
+
 type CgroupType string
 
 const (
@@ -54,17 +57,28 @@ func Applied(cg ICgroup, childPID int) (bool, error) {
 	return string(data) == strconv.Itoa(childPID), nil
 }
 
+// Join 将进程 pid 及其所有线程加入 cg，之后 fork 的子进程同样属于 cg
+// 与 Apply 不同，不会重建 cgroup 或修改限制，用于 exec 进入运行中的容器
+func Join(cg ICgroup, pid int) error {
+	return os.WriteFile(ProcsPath(cg), []byte(strconv.Itoa(pid)), 0644)
+}
+
+// ProcsPath cg 的 cgroup.procs 文件，写入 pid 时移动整个进程，tasks 只移动一个线程
+func ProcsPath(cg ICgroup) string {
+	return filepath.Join(CgroupPath(cg), "cgroup.procs")
+}
+
 func Release(cg ICgroup) error {
 	return clearCgroup(cg.ContainerName(), cg.Type())
 }
 
 // CgroupPath format: /sys/fs/cgroup/[type]/[projName]/[containerName]
 func CgroupPath(cg ICgroup) string {
-	return filepath.Join(config.CgroupsDir, string(cg.Type()), config.ProjName, cg.ContainerName())
+	return filepath.Join(Root, string(cg.Type()), config.ProjName, cg.ContainerName())
 }
 
 func createCgroup(name string) error {
-	cgroupPath := filepath.Join(config.CgroupsDir, name)
+	cgroupPath := filepath.Join(Root, name)
 	err := os.MkdirAll(cgroupPath, 0755)
 	return err
 }
@@ -75,5 +89,5 @@ func clearCgroup(name string, cgroupType CgroupType) error {
 	if err != nil {
 		return fmt.Errorf("clear %s cgroup fail 1 err=%s output=%s", cgroupType, err, string(output))
 	}
-	return os.RemoveAll(filepath.Join(config.CgroupsDir, string(cgroupType), config.ProjName, name))
+	return os.RemoveAll(filepath.Join(Root, string(cgroupType), config.ProjName, name))
 }
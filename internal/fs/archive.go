@@ -0,0 +1,323 @@
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"mini-container/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// tar 中以 PAX 扩展头保存 xattr，格式与 GNU tar / docker 一致
+const paxXattrPrefix = "SCHILY.xattr."
+
+// ExportForContainer 将容器的合并视图（镜像层+容器层）以tar流的方式写入w
+func ExportForContainer(name, imageDir string, w io.Writer) error {
+	if err := EnsureUnionMounted(name, imageDir); err != nil {
+		return err
+	}
+	return Export(filepath.Join(config.ContainerMountDir, name), w)
+}
+
+// Export 将 rootfs 目录以tar流的方式写入w，保留属主、权限、xattr、硬链接和设备文件
+func Export(rootfs string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	// dev+inode -> 第一次出现的路径，用于还原硬链接
+	inodes := make(map[[2]uint64]string)
+
+	err := filepath.Walk(rootfs, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if rel == config.OldRootfsName {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// tar 无法表示 socket
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Format = tar.FormatPAX
+		// 用户名/组名是按宿主机的 /etc/passwd 查出来的，对容器没有意义，只保留数字id
+		hdr.Uname, hdr.Gname = "", ""
+
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && st.Nlink > 1 {
+			key := [2]uint64{st.Dev, st.Ino}
+			if first, ok := inodes[key]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				inodes[key] = hdr.Name
+			}
+		}
+
+		xattrs, err := readXattrs(path)
+		if err != nil {
+			return err
+		}
+		for k, v := range xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+			hdr.PAXRecords[paxXattrPrefix+k] = v
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Import 将 Export 生成的tar流解压到 dest 目录
+// 注意：tar 中的路径和链接都被限制在 dest 内，试图通过 ".." 或符号链接逃逸的条目会导致返回错误
+func Import(r io.Reader, dest string) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	// 目录的修改时间需要在其内容写完后再设置
+	dirs := make([]*tar.Header, 0)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := importPath(dest, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if target == dest {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := extractEntry(tr, hdr, dest, target); err != nil {
+			return fmt.Errorf("extract %s: %s", hdr.Name, err)
+		}
+
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr)
+		} else if hdr.Typeflag != tar.TypeLink {
+			if err := lchtimes(target, hdr.AccessTime, hdr.ModTime); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target, _ := importPath(dest, dirs[i].Name)
+		if err := lchtimes(target, dirs[i].AccessTime, dirs[i].ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importPath 计算tar条目在宿主机上的路径：父目录在 dest 内解析符号链接，最后一级不跟随
+func importPath(dest, name string) (string, error) {
+	name = filepath.Clean("/" + filepath.FromSlash(name))
+	if name == "/" {
+		return dest, nil
+	}
+	parent, err := ResolveInRoot(dest, filepath.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(name)), nil
+}
+
+func extractEntry(tr *tar.Reader, hdr *tar.Header, dest, target string) error {
+	mode := hdr.FileInfo().Mode()
+
+	// 非目录条目覆盖已有文件
+	if hdr.Typeflag != tar.TypeDir {
+		if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if info, err := os.Lstat(target); err != nil || !info.IsDir() {
+			if err == nil {
+				if err := os.Remove(target); err != nil {
+					return err
+				}
+			}
+			if err := os.Mkdir(target, 0755); err != nil {
+				return err
+			}
+		}
+	case tar.TypeReg:
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, tr)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+		// 符号链接本身的权限没有意义
+		return applyMetadata(hdr, target, false)
+	case tar.TypeLink:
+		source, err := importPath(dest, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		// 硬链接共享inode，属性已经随源文件设置过了
+		return os.Link(source, target)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devType := uint32(unix.S_IFIFO)
+		switch hdr.Typeflag {
+		case tar.TypeChar:
+			devType = unix.S_IFCHR
+		case tar.TypeBlock:
+			devType = unix.S_IFBLK
+		}
+		dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		if err := unix.Mknod(target, devType|uint32(mode.Perm()), int(dev)); err != nil {
+			return err
+		}
+	default:
+		// 其他类型（例如 GNU sparse、全局扩展头）不处理
+		return nil
+	}
+
+	return applyMetadata(hdr, target, true)
+}
+
+// applyMetadata 设置属主、权限和xattr，chown 会清除 setuid/setgid 位，因此 chmod 必须放在之后
+func applyMetadata(hdr *tar.Header, target string, chmod bool) error {
+	if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	if chmod {
+		if err := os.Chmod(target, hdr.FileInfo().Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+	}
+	for k, v := range hdr.PAXRecords {
+		if !strings.HasPrefix(k, paxXattrPrefix) {
+			continue
+		}
+		if err := unix.Lsetxattr(target, strings.TrimPrefix(k, paxXattrPrefix), []byte(v), 0); err != nil {
+			return fmt.Errorf("set xattr %s: %s", k, err)
+		}
+	}
+	return nil
+}
+
+func lchtimes(path string, atime, mtime time.Time) error {
+	if atime.IsZero() {
+		atime = mtime
+	}
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// readXattrs 读取文件的全部xattr（不跟随符号链接）
+func readXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string]string)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := lgetxattr(path, string(name))
+		if err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = string(value)
+	}
+	return xattrs, nil
+}
+
+func lgetxattr(path, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Lgetxattr(path, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
@@ -0,0 +1,98 @@
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, "bin"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, "dev"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(src, "bin/sh"), []byte("#!sh"), 0755))
+	assert.NoError(t, os.Link(filepath.Join(src, "bin/sh"), filepath.Join(src, "bin/ash")))
+	assert.NoError(t, os.Symlink("/bin/sh", filepath.Join(src, "bin/bash")))
+	assert.NoError(t, os.Lchown(filepath.Join(src, "bin/sh"), 1000, 1001))
+	assert.NoError(t, os.Chmod(filepath.Join(src, "bin/sh"), 0755|os.ModeSetuid))
+	assert.NoError(t, syscall.Mkfifo(filepath.Join(src, "fifo"), 0600))
+	if err := unix.Mknod(filepath.Join(src, "dev/null"), unix.S_IFCHR|0666, int(unix.Mkdev(1, 3))); err != nil {
+		t.Skipf("mknod: %v", err)
+	}
+	xattr := unix.Setxattr(filepath.Join(src, "bin/sh"), "user.test", []byte("value"), 0) == nil
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, Export(src, buf))
+	assert.NoError(t, Import(buf, dst))
+
+	info, err := os.Lstat(filepath.Join(dst, "bin/sh"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755)|os.ModeSetuid, info.Mode())
+	st := info.Sys().(*syscall.Stat_t)
+	assert.Equal(t, uint32(1000), st.Uid)
+	assert.Equal(t, uint32(1001), st.Gid)
+	assert.Equal(t, uint64(2), uint64(st.Nlink))
+
+	ash, err := os.Lstat(filepath.Join(dst, "bin/ash"))
+	assert.NoError(t, err)
+	assert.Equal(t, st.Ino, ash.Sys().(*syscall.Stat_t).Ino)
+
+	link, err := os.Readlink(filepath.Join(dst, "bin/bash"))
+	assert.NoError(t, err)
+	assert.Equal(t, "/bin/sh", link)
+
+	info, err = os.Lstat(filepath.Join(dst, "fifo"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeNamedPipe|0600, info.Mode())
+
+	info, err = os.Lstat(filepath.Join(dst, "dev/null"))
+	assert.NoError(t, err)
+	assert.Equal(t, unix.Mkdev(1, 3), info.Sys().(*syscall.Stat_t).Rdev)
+
+	if xattr {
+		value, err := lgetxattr(filepath.Join(dst, "bin/sh"), "user.test")
+		assert.NoError(t, err)
+		assert.Equal(t, "value", string(value))
+	}
+}
+
+func TestImportRejectsEscape(t *testing.T) {
+	outside := t.TempDir()
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: "../../../../../../" + outside}))
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}))
+	_, _ = tw.Write([]byte("evil"))
+	assert.NoError(t, tw.Close())
+
+	assert.Error(t, Import(buf, t.TempDir()))
+	assert.NoFileExists(t, filepath.Join(outside, "passwd"))
+}
+
+func TestResolveInRoot(t *testing.T) {
+	root := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "usr/lib"), 0755))
+	assert.NoError(t, os.Symlink("/usr/lib", filepath.Join(root, "lib")))
+	assert.NoError(t, os.Symlink("../usr", filepath.Join(root, "usr/self")))
+	assert.NoError(t, os.Symlink("../../..", filepath.Join(root, "usr/lib/up")))
+
+	path, err := ResolveInRoot(root, "/lib/x")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "usr/lib/x"), path)
+
+	path, err = ResolveInRoot(root, "usr/self/lib/../not-exist/a")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "usr/not-exist/a"), path)
+
+	_, err = ResolveInRoot(root, "/lib/up/etc")
+	assert.Error(t, err)
+	_, err = ResolveInRoot(root, "/../etc")
+	assert.Error(t, err)
+}
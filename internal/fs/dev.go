@@ -0,0 +1,139 @@
+package fs
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// 很多镜像不带 /dev 的内容，容器需要自己准备一个最小的 /dev：
+//   - /dev 本身是 tmpfs，不会把设备文件写进容器层
+//   - 标准字符设备 null、zero、full、random、urandom、tty
+//   - devpts 使用 newinstance，容器有独立的 pty 编号，不会看到宿主机的终端
+//   - /dev/shm（tmpfs）和 /dev/mqueue（需要 CLONE_NEWIPC）
+//   - /dev/fd、/dev/stdin 等指向 /proc/self/fd 的符号链接
+
+type device struct {
+	name  string
+	major uint32
+	minor uint32
+}
+
+var defaultDevices = []device{
+	{"null", 1, 3},
+	{"zero", 1, 5},
+	{"full", 1, 7},
+	{"random", 1, 8},
+	{"urandom", 1, 9},
+	{"tty", 5, 0},
+}
+
+// 链接目标 -> /dev 下的链接名
+var defaultDevSymlinks = [][2]string{
+	{"/proc/self/fd", "fd"},
+	{"/proc/self/fd/0", "stdin"},
+	{"/proc/self/fd/1", "stdout"},
+	{"/proc/self/fd/2", "stderr"},
+	{"/proc/kcore", "core"},
+	{"pts/ptmx", "ptmx"},
+}
+
+// setupDev 在 rootfs 下准备 /dev
+// 注意：需要在child的 mount namespace 中、PivotRoot 之前执行，创建设备失败时需要绑定宿主机的 /dev
+func setupDev(rootfs string) error {
+	dev, err := ResolveInRoot(rootfs, "/dev")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dev, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755,size=65536k"); err != nil {
+		return fmt.Errorf("mount /dev: %s", err)
+	}
+
+	for _, d := range defaultDevices {
+		if err := createDevice(dev, d); err != nil {
+			return fmt.Errorf("create /dev/%s: %s", d.name, err)
+		}
+	}
+
+	pts := filepath.Join(dev, "pts")
+	if err := os.MkdirAll(pts, 0755); err != nil {
+		return err
+	}
+	// gid=5 为 tty 组
+	if err := syscall.Mount("devpts", pts, "devpts", syscall.MS_NOSUID|syscall.MS_NOEXEC,
+		"newinstance,ptmxmode=0666,mode=0620,gid=5"); err != nil {
+		return fmt.Errorf("mount /dev/pts: %s", err)
+	}
+
+	for _, link := range defaultDevSymlinks {
+		if err := os.Symlink(link[0], filepath.Join(dev, link[1])); err != nil {
+			return err
+		}
+	}
+
+	shm := filepath.Join(dev, "shm")
+	if err := os.MkdirAll(shm, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("shm", shm, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC,
+		"mode=1777,size=65536k"); err != nil {
+		return fmt.Errorf("mount /dev/shm: %s", err)
+	}
+
+	mqueue := filepath.Join(dev, "mqueue")
+	if err := os.MkdirAll(mqueue, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("mqueue", mqueue, "mqueue", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mount /dev/mqueue: %s", err)
+	}
+	return nil
+}
+
+// createDevice 创建字符设备，没有权限 mknod 时（例如在 user namespace 中）绑定挂载宿主机的同名设备
+func createDevice(dev string, d device) error {
+	path := filepath.Join(dev, d.name)
+	err := unix.Mknod(path, unix.S_IFCHR|0666, int(unix.Mkdev(d.major, d.minor)))
+	if err == nil {
+		// mknod 的权限受 umask 影响
+		return os.Chmod(path, 0666)
+	}
+	if !os.IsPermission(err) {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return syscall.Mount(filepath.Join("/dev", d.name), path, "bind", syscall.MS_BIND, "")
+}
+
+// mountSys 以只读方式挂载 sysfs，网络设备等信息与容器的 network namespace 对应
+// 没有权限挂载新的 sysfs 时，只读绑定宿主机的 /sys
+func mountSys(rootfs string) error {
+	sys, err := ResolveInRoot(rootfs, "/sys")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(sys, 0755); err != nil {
+		return err
+	}
+
+	flags := uintptr(syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV)
+	err = syscall.Mount("sysfs", sys, "sysfs", flags, "")
+	if err == nil || !os.IsPermission(err) {
+		return err
+	}
+
+	if err := syscall.Mount("/sys", sys, "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+	return syscall.Mount("", sys, "", syscall.MS_BIND|syscall.MS_REMOUNT|flags, "")
+}
@@ -0,0 +1,80 @@
+package fs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"mini-container/common"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+// inNewMountNamespace 在新的 mount namespace 中执行 fn，根目录与 ChangeRoot 相同设置为 rslave
+// 执行 fn 的线程不再解锁，goroutine 结束时线程随之退出，其中的挂载一起销毁
+func inNewMountNamespace(t *testing.T, fn func()) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runtime.LockOSThread()
+		if err := common.Err(common.ErrGroup(syscall.Unshare(syscall.CLONE_NEWNS), slaveRoot())); err != nil {
+			t.Errorf("new mount namespace: %v", err)
+			return
+		}
+		fn()
+	}()
+	<-done
+}
+
+func TestSetupDevAndSys(t *testing.T) {
+	rootfs := t.TempDir()
+	hostPts, err := os.Stat("/dev/pts")
+	if err != nil {
+		t.Skipf("host /dev/pts: %v", err)
+	}
+
+	inNewMountNamespace(t, func() {
+		if !assert.NoError(t, setupDev(rootfs)) || !assert.NoError(t, mountSys(rootfs)) {
+			return
+		}
+		dev := filepath.Join(rootfs, "dev")
+
+		for _, d := range defaultDevices {
+			var stat unix.Stat_t
+			if !assert.NoError(t, unix.Stat(filepath.Join(dev, d.name), &stat), d.name) {
+				continue
+			}
+			assert.Equal(t, uint32(unix.S_IFCHR), stat.Mode&unix.S_IFMT, d.name)
+			assert.Equal(t, unix.Mkdev(d.major, d.minor), stat.Rdev, d.name)
+		}
+
+		// newinstance：容器的 devpts 与宿主机的不是同一个文件系统
+		pts, err := os.Stat(filepath.Join(dev, "pts"))
+		assert.NoError(t, err)
+		assert.NotEqual(t, hostPts.Sys().(*syscall.Stat_t).Dev, pts.Sys().(*syscall.Stat_t).Dev)
+		var statfs unix.Statfs_t
+		assert.NoError(t, unix.Statfs(filepath.Join(dev, "pts"), &statfs))
+		assert.Equal(t, int64(unix.DEVPTS_SUPER_MAGIC), int64(statfs.Type))
+		assert.FileExists(t, filepath.Join(dev, "pts", "ptmx"))
+
+		for _, link := range defaultDevSymlinks {
+			target, err := os.Readlink(filepath.Join(dev, link[1]))
+			assert.NoError(t, err, link[1])
+			assert.Equal(t, link[0], target)
+		}
+		assert.NoError(t, unix.Statfs(filepath.Join(dev, "shm"), &statfs))
+		assert.Equal(t, int64(unix.TMPFS_MAGIC), int64(statfs.Type))
+
+		// /sys 只读
+		sys := filepath.Join(rootfs, "sys")
+		assert.NoError(t, unix.Statfs(sys, &statfs))
+		assert.Equal(t, int64(unix.SYSFS_MAGIC), int64(statfs.Type))
+		assert.NotZero(t, statfs.Flags&unix.ST_RDONLY)
+		assert.ErrorIs(t, unix.Access(filepath.Join(sys, "kernel"), unix.W_OK), unix.EROFS)
+	})
+}
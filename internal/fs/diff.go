@@ -0,0 +1,189 @@
+package fs
+
+import (
+	"mini-container/config"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// overlayfs 在 upperdir 中用特殊文件记录对 lowerdir 的修改：
+//  1. whiteout：主/次设备号均为 0 的字符设备，表示 lowerdir 中的同名文件已被删除
+//  2. opaque 目录：带有 xattr `trusted.overlay.opaque=y` 的目录，表示 lowerdir 中的同名目录内容已被整体替换
+//     （使用 userxattr 挂载时为 `user.overlay.opaque`）
+// 因此 upperdir 中出现的文件并不都代表新增，需要结合 lowerdir 判断
+
+type ChangeKind string
+
+const (
+	ChangeAdded   ChangeKind = "A"
+	ChangeChanged ChangeKind = "C"
+	ChangeDeleted ChangeKind = "D"
+)
+
+var opaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque"}
+
+// Change 容器内的一条文件变更
+type Change struct {
+	Kind ChangeKind `json:"kind"`
+	Path string     `json:"path"` // 容器内的绝对路径
+	Size int64      `json:"size"` // 仅对新增/修改的普通文件有意义
+}
+
+// DiffSummary 变更统计
+type DiffSummary struct {
+	Added   int   `json:"added"`
+	Changed int   `json:"changed"`
+	Deleted int   `json:"deleted"`
+	Size    int64 `json:"size"` // 新增/修改的普通文件总大小，单位byte
+}
+
+// DiffForContainer 列出容器相对镜像的文件变更
+func DiffForContainer(name, imageDir string) ([]Change, error) {
+	return Diff(filepath.Join(config.ContainerCOWDir, name), imageDir)
+}
+
+// Diff 遍历 overlayfs 的 upperDir，对照 lowerDir 给出 Added/Changed/Deleted 列表，按路径排序
+func Diff(upperDir, lowerDir string) ([]Change, error) {
+	changes := make([]Change, 0)
+	// 容器内路径 -> 是否为 opaque 目录
+	opaque := make(map[string]bool)
+
+	err := filepath.Walk(upperDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upperDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		// ChangeRoot 在 rootfs 中创建的旧根挂载点，不属于用户的修改
+		if rel == config.OldRootfsName {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ctrPath := "/" + filepath.ToSlash(rel)
+
+		if isWhiteout(info) {
+			changes = append(changes, Change{Kind: ChangeDeleted, Path: ctrPath})
+			return nil
+		}
+
+		lowerPath := filepath.Join(lowerDir, rel)
+		inLower := !underOpaque(opaque, ctrPath) && lexists(lowerPath)
+
+		if info.IsDir() && isOpaque(path) {
+			opaque[ctrPath] = true
+			if inLower {
+				// 被整体替换的目录：lowerdir 中存在而 upperdir 中没有的条目都视为删除
+				deleted, err := opaqueDeleted(path, lowerPath, ctrPath)
+				if err != nil {
+					return err
+				}
+				changes = append(changes, deleted...)
+			}
+		}
+
+		c := Change{Kind: ChangeAdded, Path: ctrPath}
+		if inLower {
+			c.Kind = ChangeChanged
+		}
+		if info.Mode().IsRegular() {
+			c.Size = info.Size()
+		}
+		changes = append(changes, c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+// SummarizeChanges 统计变更数量和大小
+func SummarizeChanges(changes []Change) DiffSummary {
+	s := DiffSummary{}
+	for _, c := range changes {
+		switch c.Kind {
+		case ChangeAdded:
+			s.Added++
+		case ChangeChanged:
+			s.Changed++
+		case ChangeDeleted:
+			s.Deleted++
+		}
+		s.Size += c.Size
+	}
+	return s
+}
+
+// isWhiteout 主/次设备号均为0的字符设备
+func isWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Rdev == 0
+}
+
+func isOpaque(dir string) bool {
+	buf := make([]byte, 1)
+	for _, attr := range opaqueXattrs {
+		n, err := syscall.Getxattr(dir, attr, buf)
+		if err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+// underOpaque 判断ctrPath的某个祖先目录是否为opaque目录
+func underOpaque(opaque map[string]bool, ctrPath string) bool {
+	for dir := filepath.Dir(ctrPath); dir != "/"; dir = filepath.Dir(dir) {
+		if opaque[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// lexists 与 common.IsExistPath 不同，不跟随符号链接
+func lexists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// opaqueDeleted 列出opaque目录遮盖掉的lowerdir条目（只列出直接子条目）
+func opaqueDeleted(upperPath, lowerPath, ctrPath string) ([]Change, error) {
+	info, err := os.Lstat(lowerPath)
+	if err != nil || !info.IsDir() {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(lowerPath)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]Change, 0)
+	for _, e := range entries {
+		if lexists(filepath.Join(upperPath, e.Name())) {
+			continue
+		}
+		changes = append(changes, Change{
+			Kind: ChangeDeleted,
+			Path: strings.TrimSuffix(ctrPath, "/") + "/" + e.Name(),
+		})
+	}
+	return changes, nil
+}
@@ -0,0 +1,54 @@
+package fs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	lower, upper := t.TempDir(), t.TempDir()
+
+	// lower: /etc/hosts /etc/passwd /var/log/a /var/log/b /tmp
+	assert.NoError(t, os.MkdirAll(filepath.Join(lower, "etc"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(lower, "var/log"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(lower, "tmp"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(lower, "etc/hosts"), []byte("old"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(lower, "etc/passwd"), []byte("old"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(lower, "var/log/a"), []byte("a"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(lower, "var/log/b"), []byte("b"), 0644))
+
+	// upper: 修改 /etc/hosts，删除 /etc/passwd，新增 /root/new，替换 /var/log
+	assert.NoError(t, os.MkdirAll(filepath.Join(upper, "etc"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(upper, "root"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(upper, "var/log"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(upper, ".old"), 0700))
+	assert.NoError(t, os.WriteFile(filepath.Join(upper, "etc/hosts"), []byte("new hosts"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(upper, "root/new"), []byte("12345"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(upper, "var/log/a"), []byte("aa"), 0644))
+
+	if err := syscall.Mknod(filepath.Join(upper, "etc/passwd"), syscall.S_IFCHR|0000, 0); err != nil {
+		t.Skipf("mknod whiteout: %v", err)
+	}
+	if err := syscall.Setxattr(filepath.Join(upper, "var/log"), "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+		t.Skipf("set opaque xattr: %v", err)
+	}
+
+	changes, err := Diff(upper, lower)
+	assert.NoError(t, err)
+	assert.Equal(t, []Change{
+		{Kind: ChangeChanged, Path: "/etc"},
+		{Kind: ChangeChanged, Path: "/etc/hosts", Size: 9},
+		{Kind: ChangeDeleted, Path: "/etc/passwd"},
+		{Kind: ChangeAdded, Path: "/root"},
+		{Kind: ChangeAdded, Path: "/root/new", Size: 5},
+		{Kind: ChangeChanged, Path: "/var"},
+		{Kind: ChangeChanged, Path: "/var/log"},
+		{Kind: ChangeAdded, Path: "/var/log/a", Size: 2},
+		{Kind: ChangeDeleted, Path: "/var/log/b"},
+	}, changes)
+
+	assert.Equal(t, DiffSummary{Added: 3, Changed: 4, Deleted: 2, Size: 16}, SummarizeChanges(changes))
+}
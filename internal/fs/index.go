@@ -7,6 +7,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 )
 
@@ -69,6 +71,58 @@ func UnionMountForContainer(name, imageDir string) error {
 	return nil
 }
 
+// EnsureUnionMounted 检查容器的联合挂载是否存在（例如宿主机重启后挂载会丢失），不存在则重新挂载
+func EnsureUnionMounted(name, imageDir string) error {
+	mounted, err := IsMountPoint(filepath.Join(config.ContainerMountDir, name))
+	if err != nil || mounted {
+		return err
+	}
+	return UnionMountForContainer(name, imageDir)
+}
+
+// IsMountPoint 通过 /proc/self/mountinfo 判断 path 是否为挂载点
+func IsMountPoint(path string) (bool, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false, err
+	}
+	// 格式：36 35 98:0 /mnt1 /mnt/parent rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+	// 第5列为挂载点，其中的空格等字符以八进制转义
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		if unescapeMountPath(fields[4]) == path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// unescapeMountPath 还原 mountinfo 中的八进制转义，例如 \040 -> 空格
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	sb := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				sb.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
 func ExistsContainerDir(name string) bool {
 	mntDir := filepath.Join(config.ContainerMountDir, name)
 	return common.IsExistPath(mntDir)
@@ -85,32 +139,105 @@ func UnionUnmountForContainer(name string) error {
 	))
 }
 
-// ChangeRootForContainer ChangeRoot的封装，用于将 rootfs 切换到指定的目录，同时将 oldRootfs 作为挂载点
+// RootfsOptions 切换 rootfs 时需要额外完成的挂载
+type RootfsOptions struct {
+	Mounts   []*Mount // 绑定挂载的宿主机目录/文件
+	Tmpfs    []*Tmpfs
+	ReadOnly bool // 切换后将根目录重新挂载为只读
+}
+
+// ChangeRootForContainer ChangeRoot的封装，用于将 rootfs 切换到指定的目录
 // 注意：需要在child中执行
-func ChangeRootForContainer(name string) error {
+func ChangeRootForContainer(name string, opts *RootfsOptions) error {
 	rootfs := filepath.Join(config.ContainerMountDir, name)
-	return ChangeRoot(rootfs)
+	return ChangeRoot(rootfs, opts)
+}
+
+// slaveRoot 与 runc 相同将根目录设置为 rslave：当前 namespace 中的挂载操作不会影响到 parent namespace，
+// 宿主机上的挂载仍然会传播进来，volume 的传播类型（默认 rprivate）在 bindMount 中逐个设置
+// 如果设置为 rprivate，volume 的源目录都是私有的，rslave/rshared 等传播类型都不会生效
+func slaveRoot() error {
+	return syscall.Mount("", "/", "", syscall.MS_SLAVE|syscall.MS_REC, "")
 }
 
-// ChangeRoot 用于将 rootfs 切换到指定的目录，同时将 oldRootfs 作为挂载点
+// ChangeRoot 用于将 rootfs 切换到指定的目录，PivotRoot 需要 oldRootfs 作为旧根目录的挂载点，切换后将其卸载并删除
 // 注意：需要在child中执行
-func ChangeRoot(rootfs string) error {
+func ChangeRoot(rootfs string, opts *RootfsOptions) error {
+	if opts == nil {
+		opts = &RootfsOptions{}
+	}
 	oldRootfs := filepath.Join(rootfs, config.OldRootfsName)
-	return common.Err(common.ErrGroup(
-		// 设置私有的 mount namespace，这样在当前 namespace 中的挂载操作不会影响到parent namespace
-		syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""),
+	err := common.Err(common.ErrGroup(
+		slaveRoot(),
 
 		// 重新挂载 rootfs，使得 rootfs 成为当前 namespace 的根目录，以下是固定的4个步骤
 		syscall.Mount(rootfs, rootfs, "bind", syscall.MS_BIND|syscall.MS_REC, ""),
+	))
+	if err != nil {
+		return err
+	}
+
+	// 在 PivotRoot 之前挂载，此时宿主机路径仍然可见
+	// /dev 和 /sys 先挂载，用户指定的 volume 可以覆盖其中的路径
+	if err := setupDev(rootfs); err != nil {
+		return common.ErrTag("setup /dev", err)
+	}
+	if err := mountSys(rootfs); err != nil {
+		return common.ErrTag("mount /sys", err)
+	}
+	for _, m := range opts.Mounts {
+		if err := bindMount(rootfs, m); err != nil {
+			return common.ErrTag("mount volume "+m.Target, err)
+		}
+	}
+	for _, t := range opts.Tmpfs {
+		if err := mountTmpfs(rootfs, t); err != nil {
+			return common.ErrTag("mount tmpfs "+t.Target, err)
+		}
+	}
+
+	err = common.Err(common.ErrGroup(
 		os.MkdirAll(oldRootfs, 0700),
 		syscall.PivotRoot(rootfs, oldRootfs),
 		syscall.Chdir("/"),
+	))
+	// 注意：syscall.Chroot() 只能改变当前进程的根目录，不能改变当前进程所属的 Namespace 的根目录
+	if err != nil {
+		return err
+	}
+
+	// 旧的根目录下挂载着宿主机的全部文件系统，必须卸载，否则容器可以访问宿主机的任意文件
+	// MNT_DETACH：旧根目录下的挂载仍可能被占用，延迟卸载
+	oldRootfs = "/" + config.OldRootfsName
+	err = common.Err(common.ErrGroup(
+		syscall.Unmount(oldRootfs, syscall.MNT_DETACH),
+		os.Remove(oldRootfs),
 
 		os.MkdirAll("/proc", 0700),
 		// 重新挂载 proc 文件系统，使得当前 namespace 中可以访问 proc 文件系统
 		MountProc(),
 	))
-	// 注意：syscall.Chroot() 只能改变当前进程的根目录，不能改变当前进程所属的 Namespace 的根目录
+	if err != nil {
+		return err
+	}
+
+	for _, path := range MaskedPaths {
+		if err := maskPath(path); err != nil {
+			return common.ErrTag("mask "+path, err)
+		}
+	}
+	for _, path := range ReadonlyPaths {
+		if err := readonlyPath(path); err != nil {
+			return common.ErrTag("readonly "+path, err)
+		}
+	}
+
+	if !opts.ReadOnly {
+		return nil
+	}
+	// 根目录是 rootfs 的绑定挂载，重新挂载为只读只影响根目录本身，volume 和 tmpfs 仍然可写
+	return common.ErrTag("remount rootfs read-only",
+		syscall.Mount("", "/", "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""))
 }
 
 // MountProc 用于挂载 proc 文件系统到指定的目录
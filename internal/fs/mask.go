@@ -0,0 +1,61 @@
+package fs
+
+import (
+	"os"
+	"syscall"
+)
+
+// MaskedPaths 容器内不可访问的路径，通过它们可以读取宿主机内核的信息
+// 文件用 /dev/null 覆盖，目录用只读的空 tmpfs 覆盖
+var MaskedPaths = []string{
+	"/proc/acpi",
+	"/proc/asound",
+	"/proc/interrupts",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/sys/devices/virtual/powercap",
+	"/sys/firmware",
+}
+
+// ReadonlyPaths 容器内只读的路径，写入它们会修改宿主机内核的行为
+var ReadonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+// maskPath 屏蔽容器内的路径，路径不存在时忽略
+// 注意：需要在 PivotRoot 和挂载 /proc 之后执行
+func maskPath(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.IsDir() {
+		return syscall.Mount("tmpfs", path, "tmpfs", syscall.MS_RDONLY, "size=0")
+	}
+	return syscall.Mount("/dev/null", path, "bind", syscall.MS_BIND, "")
+}
+
+// readonlyPath 将容器内的路径重新挂载为只读，路径不存在时忽略
+// 注意：需要在 PivotRoot 和挂载 /proc 之后执行
+func readonlyPath(path string) error {
+	if err := syscall.Mount(path, path, "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+	return syscall.Mount(path, path, "", flags, "")
+}
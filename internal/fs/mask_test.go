@@ -0,0 +1,66 @@
+package fs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"mini-container/config"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestChangeRootMask 在新的 mount namespace 中执行 ChangeRoot，检查屏蔽和只读的路径，以及旧根目录已经卸载
+func TestChangeRootMask(t *testing.T) {
+	rootfs := t.TempDir()
+
+	inNewMountNamespace(t, func() {
+		if !assert.NoError(t, ChangeRoot(rootfs, nil)) {
+			return
+		}
+
+		// 屏蔽的文件读出为空，目录为空
+		maskedFile := 0
+		for _, path := range MaskedPaths {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if info.IsDir() {
+				entries, err := os.ReadDir(path)
+				assert.NoError(t, err, path)
+				assert.Empty(t, entries, path)
+				continue
+			}
+			data, err := os.ReadFile(path)
+			assert.NoError(t, err, path)
+			assert.Empty(t, data, path)
+			maskedFile++
+		}
+		assert.NotZero(t, maskedFile, "no masked file exists")
+
+		// 只读的路径拒绝写入
+		file, err := os.OpenFile("/proc/sys/kernel/hostname", os.O_WRONLY, 0)
+		if err == nil {
+			_, err = file.WriteString("mini-container")
+			file.Close()
+		}
+		assert.ErrorIs(t, err, unix.EROFS)
+		for _, path := range ReadonlyPaths {
+			var statfs unix.Statfs_t
+			if err := unix.Statfs(path, &statfs); err == nil {
+				assert.NotZero(t, statfs.Flags&unix.ST_RDONLY, path)
+			}
+		}
+
+		// 旧的根目录已经卸载并删除，宿主机的文件系统不可见
+		assert.NoDirExists(t, "/"+config.OldRootfsName)
+		mountinfo, err := os.ReadFile("/proc/self/mountinfo")
+		assert.NoError(t, err)
+		for _, line := range strings.Split(string(mountinfo), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 4 {
+				assert.False(t, strings.HasPrefix(fields[4], "/"+config.OldRootfsName), line)
+			}
+		}
+	})
+}
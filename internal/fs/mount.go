@@ -0,0 +1,285 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"mini-container/common"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// 挂载传播类型，决定挂载点下后续的挂载/卸载事件是否在宿主机和容器之间传播
+var propagationFlags = map[string]uintptr{
+	"private":  syscall.MS_PRIVATE,
+	"rprivate": syscall.MS_PRIVATE | syscall.MS_REC,
+	"slave":    syscall.MS_SLAVE,
+	"rslave":   syscall.MS_SLAVE | syscall.MS_REC,
+	"shared":   syscall.MS_SHARED,
+	"rshared":  syscall.MS_SHARED | syscall.MS_REC,
+}
+
+const DefaultPropagation = "rprivate"
+
+// Mount 挂载到容器中的宿主机目录/文件或命名卷
+type Mount struct {
+	Volume      string `json:"volume,omitempty"` // 命名卷的名称，为空表示宿主机路径
+	Source      string `json:"source"`           // 宿主机上的绝对路径，命名卷为其数据目录，创建容器时填写
+	Target      string `json:"target"`           // 容器内的绝对路径
+	ReadOnly    bool   `json:"readOnly"`
+	Propagation string `json:"propagation"`
+}
+
+func (m *Mount) String() string {
+	mode := "rw"
+	if m.ReadOnly {
+		mode = "ro"
+	}
+	source := m.Source
+	if m.Volume != "" {
+		source = m.Volume
+	}
+	return fmt.Sprintf("%s:%s:%s,%s", source, m.Target, mode, m.Propagation)
+}
+
+// ParseMount 解析 -v 参数
+// 格式：host-path|volume-name:container-path[:options]，options 以逗号分隔，可选 ro/rw 和挂载传播类型
+// 例如：/data:/data:ro,rslave 或 myvol:/data
+func ParseMount(spec string) (*Mount, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("invalid volume spec %q, format: host-path|volume-name:container-path[:options]", spec)
+	}
+
+	m := &Mount{
+		Source:      parts[0],
+		Target:      parts[1],
+		Propagation: DefaultPropagation,
+	}
+	if m.Source == "" {
+		return nil, fmt.Errorf("invalid volume spec %q, empty source", spec)
+	}
+	if strings.HasPrefix(m.Source, "/") || strings.HasPrefix(m.Source, ".") {
+		source, err := filepath.Abs(m.Source)
+		if err != nil {
+			return nil, err
+		}
+		m.Source = source
+	} else {
+		// 不是路径则视为命名卷，数据目录在创建容器时确定
+		m.Volume, m.Source = m.Source, ""
+	}
+
+	if !filepath.IsAbs(m.Target) {
+		return nil, fmt.Errorf("invalid volume spec %q, container path must be absolute", spec)
+	}
+	m.Target = filepath.Clean(m.Target)
+	if m.Target == "/" {
+		return nil, fmt.Errorf("invalid volume spec %q, container path can not be /", spec)
+	}
+
+	if len(parts) == 3 {
+		for _, opt := range strings.Split(parts[2], ",") {
+			switch {
+			case opt == "ro":
+				m.ReadOnly = true
+			case opt == "rw":
+				m.ReadOnly = false
+			case propagationFlags[opt] != 0:
+				m.Propagation = opt
+			default:
+				return nil, fmt.Errorf("invalid volume spec %q, unknown option %q", spec, opt)
+			}
+		}
+	}
+	return m, nil
+}
+
+// bindMount 将宿主机路径递归绑定挂载到 rootfs 下的容器路径
+// 注意：需要在child的 mount namespace 中、PivotRoot 之前执行
+func bindMount(rootfs string, m *Mount) error {
+	info, err := os.Stat(m.Source)
+	if err != nil {
+		return err
+	}
+
+	// 容器路径中的符号链接按容器视角解析，跳出 rootfs 的路径直接拒绝
+	target, err := ResolveInRoot(rootfs, m.Target)
+	if err != nil {
+		return err
+	}
+	if err := createMountTarget(target, info.IsDir()); err != nil {
+		return err
+	}
+
+	if err := syscall.Mount(m.Source, target, "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind %s: %s", m.Source, err)
+	}
+	// 只读需要重新挂载才能生效
+	if m.ReadOnly {
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+		if err := syscall.Mount("", target, "", flags, ""); err != nil {
+			return fmt.Errorf("remount %s read-only: %s", m.Target, err)
+		}
+	}
+
+	propagation := m.Propagation
+	if propagation == "" {
+		propagation = DefaultPropagation
+	}
+	if err := syscall.Mount("", target, "", propagationFlags[propagation], ""); err != nil {
+		return fmt.Errorf("set %s propagation %s: %s", m.Target, propagation, err)
+	}
+	return nil
+}
+
+// createMountTarget 在 rootfs 中创建缺失的挂载点，目录挂载创建目录，文件挂载创建空文件
+func createMountTarget(target string, isDir bool) error {
+	if isDir {
+		return os.MkdirAll(target, 0755)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(target); err == nil {
+		return nil
+	}
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// CopyDir 将 src 目录的内容拷贝到 dst 目录，保留属主、权限、xattr、硬链接等属性
+// 用于命名卷第一次挂载时拷贝镜像中挂载点的已有内容
+func CopyDir(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", src)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(Export(src, pw))
+	}()
+	err = Import(pr, dst)
+	// Import 提前失败时，让 Export 的写入返回错误而不是一直阻塞
+	pr.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+
+	// tar 中不包含目录本身，单独同步属主和权限
+	st := info.Sys().(*syscall.Stat_t)
+	return common.ErrTag("copy dir", os.Lchown(dst, int(st.Uid), int(st.Gid)), os.Chmod(dst, info.Mode()&os.ModePerm))
+}
+
+// tmpfs 挂载选项中对应挂载flag的部分，其余选项（size、mode 等）作为 tmpfs 的挂载参数
+var tmpfsFlags = map[string]struct {
+	clear bool
+	flag  uintptr
+}{
+	"ro":     {false, syscall.MS_RDONLY},
+	"rw":     {true, syscall.MS_RDONLY},
+	"noexec": {false, syscall.MS_NOEXEC},
+	"exec":   {true, syscall.MS_NOEXEC},
+	"nosuid": {false, syscall.MS_NOSUID},
+	"suid":   {true, syscall.MS_NOSUID},
+	"nodev":  {false, syscall.MS_NODEV},
+	"dev":    {true, syscall.MS_NODEV},
+}
+
+// tmpfs 挂载参数的格式，在解析时检查，避免 child 挂载时才失败
+var tmpfsDataOptions = map[string]*regexp.Regexp{
+	"size":      regexp.MustCompile(`^[0-9]+[kKmMgGtTpPeE%]?$`),
+	"nr_blocks": regexp.MustCompile(`^[0-9]+[kKmMgGtTpPeE]?$`),
+	"nr_inodes": regexp.MustCompile(`^[0-9]+[kKmMgGtTpPeE]?$`),
+	"mode":      regexp.MustCompile(`^[0-7]{1,4}$`),
+	"uid":       regexp.MustCompile(`^[0-9]+$`),
+	"gid":       regexp.MustCompile(`^[0-9]+$`),
+}
+
+// validTmpfsOption 判断是否为支持的 tmpfs 选项：挂载flag或者格式正确的挂载参数
+func validTmpfsOption(opt string) bool {
+	if _, ok := tmpfsFlags[opt]; ok {
+		return true
+	}
+	key, value, ok := strings.Cut(opt, "=")
+	re, known := tmpfsDataOptions[key]
+	return ok && known && re.MatchString(value)
+}
+
+// Tmpfs 挂载到容器中的 tmpfs，用于在只读 rootfs 下提供有大小限制的可写空间
+type Tmpfs struct {
+	Target  string   `json:"target"`  // 容器内的绝对路径
+	Options []string `json:"options"` // 例如 size=64m、mode=1777、exec
+}
+
+func (t *Tmpfs) String() string {
+	return t.Target + ":" + strings.Join(t.Options, ",")
+}
+
+// ParseTmpfs 解析 --tmpfs 参数
+// 格式：container-path[:options]，例如 /run:size=64m,mode=1777
+// 默认带有 noexec、nosuid、nodev，可以通过 exec、suid、dev 取消
+// 支持的参数为 size、nr_blocks、nr_inodes、mode、uid、gid，其他选项直接报错
+func ParseTmpfs(spec string) (*Tmpfs, error) {
+	target, options, _ := strings.Cut(spec, ":")
+	if !filepath.IsAbs(target) {
+		return nil, fmt.Errorf("invalid tmpfs spec %q, container path must be absolute", spec)
+	}
+	t := &Tmpfs{Target: filepath.Clean(target), Options: make([]string, 0)}
+	if t.Target == "/" {
+		return nil, fmt.Errorf("invalid tmpfs spec %q, container path can not be /", spec)
+	}
+	if options != "" {
+		for _, opt := range strings.Split(options, ",") {
+			if opt == "" {
+				return nil, fmt.Errorf("invalid tmpfs spec %q, empty option", spec)
+			}
+			if !validTmpfsOption(opt) {
+				return nil, fmt.Errorf("invalid tmpfs spec %q, unsupported option %q", spec, opt)
+			}
+			t.Options = append(t.Options, opt)
+		}
+	}
+	return t, nil
+}
+
+// mountFlagsAndData 将选项拆分为挂载flag和 tmpfs 参数
+func (t *Tmpfs) mountFlagsAndData() (uintptr, string) {
+	flags := uintptr(syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV)
+	data := make([]string, 0)
+	for _, opt := range t.Options {
+		if f, ok := tmpfsFlags[opt]; ok {
+			if f.clear {
+				flags &^= f.flag
+			} else {
+				flags |= f.flag
+			}
+			continue
+		}
+		data = append(data, opt)
+	}
+	return flags, strings.Join(data, ",")
+}
+
+// mountTmpfs 在 rootfs 下的容器路径挂载 tmpfs
+// 注意：需要在child的 mount namespace 中、PivotRoot 之前执行
+func mountTmpfs(rootfs string, t *Tmpfs) error {
+	target, err := ResolveInRoot(rootfs, t.Target)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	flags, data := t.mountFlagsAndData()
+	return syscall.Mount("tmpfs", target, "tmpfs", flags, data)
+}
@@ -0,0 +1,125 @@
+package fs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"mini-container/common"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestParseMount(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    *Mount
+		wantErr bool
+	}{
+		{"T1", "/data:/data", &Mount{Source: "/data", Target: "/data", Propagation: "rprivate"}, false},
+		{"T2", "/data:/mnt/data/:ro", &Mount{Source: "/data", Target: "/mnt/data", ReadOnly: true, Propagation: "rprivate"}, false},
+		{"T3", "/data:/data:ro,rslave", &Mount{Source: "/data", Target: "/data", ReadOnly: true, Propagation: "rslave"}, false},
+		{"T4", "/data:/data:rshared,rw", &Mount{Source: "/data", Target: "/data", Propagation: "rshared"}, false},
+		{"T5", "myvol:/data:ro", &Mount{Volume: "myvol", Target: "/data", ReadOnly: true, Propagation: "rprivate"}, false},
+		{"T6", "/data", nil, true},
+		{"T7", "/data:data", nil, true},
+		{"T8", "/data:/", nil, true},
+		{"T9", "/data:/data:rx", nil, true},
+		{"T10", "/a:/b:ro:rw", nil, true},
+		{"T11", ":/data", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMount(tt.spec)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseTmpfs(t *testing.T) {
+	tmpfs, err := ParseTmpfs("/run:size=64m,mode=1777,exec")
+	assert.NoError(t, err)
+	assert.Equal(t, &Tmpfs{Target: "/run", Options: []string{"size=64m", "mode=1777", "exec"}}, tmpfs)
+	flags, data := tmpfs.mountFlagsAndData()
+	assert.Equal(t, uintptr(syscall.MS_NOSUID|syscall.MS_NODEV), flags)
+	assert.Equal(t, "size=64m,mode=1777", data)
+
+	tmpfs, err = ParseTmpfs("/tmp/")
+	assert.NoError(t, err)
+	assert.Equal(t, &Tmpfs{Target: "/tmp", Options: []string{}}, tmpfs)
+	flags, data = tmpfs.mountFlagsAndData()
+	assert.Equal(t, uintptr(syscall.MS_NOEXEC|syscall.MS_NOSUID|syscall.MS_NODEV), flags)
+	assert.Equal(t, "", data)
+
+	tmpfs, err = ParseTmpfs("/data:size=50%,nr_inodes=10k,mode=755,uid=1000,gid=1000,ro")
+	assert.NoError(t, err)
+	flags, data = tmpfs.mountFlagsAndData()
+	assert.Equal(t, uintptr(syscall.MS_NOEXEC|syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_RDONLY), flags)
+	assert.Equal(t, "size=50%,nr_inodes=10k,mode=755,uid=1000,gid=1000", data)
+
+	for _, spec := range []string{"/run:size=abc", "/run:size=", "/run:size=64mb", "/run:mode=999", "/run:mode=rwx",
+		"/run:uid=-1", "/run:sizee=64m", "/run:noexe", "/run:size", "/run:nr_inodes=1%"} {
+		_, err = ParseTmpfs(spec)
+		assert.Error(t, err, spec)
+	}
+	_, err = ParseTmpfs("/run:size=abc")
+	assert.EqualError(t, err, `invalid tmpfs spec "/run:size=abc", unsupported option "size=abc"`)
+
+	_, err = ParseTmpfs("run:size=1m")
+	assert.Error(t, err)
+	_, err = ParseTmpfs("/:size=1m")
+	assert.Error(t, err)
+}
+
+// TestBindMountPropagation 在新的 mount namespace 中执行与 ChangeRoot 相同的步骤，
+// 宿主机在 rslave volume 源目录中新的挂载对容器可见，rprivate 的不可见
+func TestBindMountPropagation(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	src, rootfs := t.TempDir(), t.TempDir()
+	// 源目录所在的挂载需要是 shared 才有传播，bind 到自身后单独设置
+	if err := syscall.Mount(src, src, "bind", syscall.MS_BIND, ""); err != nil {
+		t.Skipf("bind: %v", err)
+	}
+	defer syscall.Unmount(src, syscall.MNT_DETACH)
+	assert.NoError(t, syscall.Mount("", src, "", syscall.MS_SHARED, ""))
+	assert.NoError(t, os.Mkdir(filepath.Join(src, "sub"), 0755))
+
+	ready, mounted, done := make(chan error), make(chan struct{}), make(chan [2]bool)
+	go func() {
+		// 线程进入新的 mount namespace 后不再解锁，goroutine 结束时线程随之退出
+		runtime.LockOSThread()
+		ready <- common.Err(common.ErrGroup(
+			syscall.Unshare(syscall.CLONE_NEWNS),
+			slaveRoot(),
+			bindMount(rootfs, &Mount{Source: src, Target: "/slave", Propagation: "rslave"}),
+			bindMount(rootfs, &Mount{Source: src, Target: "/private", Propagation: "rprivate"}),
+		))
+		<-mounted
+		_, slaveErr := os.Stat(filepath.Join(rootfs, "slave", "sub", "file"))
+		_, privateErr := os.Stat(filepath.Join(rootfs, "private", "sub", "file"))
+		done <- [2]bool{slaveErr == nil, privateErr == nil}
+	}()
+	if err := <-ready; err != nil {
+		close(mounted)
+		<-done
+		t.Fatal(err)
+	}
+
+	sub := filepath.Join(src, "sub")
+	assert.NoError(t, syscall.Mount("tmpfs", sub, "tmpfs", 0, ""))
+	defer syscall.Unmount(sub, syscall.MNT_DETACH)
+	assert.NoError(t, os.WriteFile(filepath.Join(sub, "file"), nil, 0644))
+	close(mounted)
+
+	visible := <-done
+	assert.True(t, visible[0], "rslave volume should see host mount")
+	assert.False(t, visible[1], "rprivate volume should not see host mount")
+}
@@ -0,0 +1,72 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const maxSymlinks = 255
+
+// ResolveInRoot 把容器内路径 unsafePath 解析为宿主机上 root 下的路径
+// 解析过程中遇到的符号链接按容器视角处理：绝对路径的链接相对于 root 解析，
+// 如果通过 ".." 跳出了 root（例如 ../../etc），返回错误，而不是静默地访问宿主机文件
+// 不存在的路径部分按字面拼接，不要求路径存在
+func ResolveInRoot(root, unsafePath string) (string, error) {
+	resolved := "" // 相对 root 的路径
+	remaining := unsafePath
+	links := 0
+
+	for remaining != "" {
+		var part string
+		if i := strings.IndexByte(remaining, '/'); i == -1 {
+			part, remaining = remaining, ""
+		} else {
+			part, remaining = remaining[:i], remaining[i+1:]
+		}
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if resolved == "" {
+				return "", fmt.Errorf("path %s escapes from %s", unsafePath, root)
+			}
+			resolved = filepath.Dir(resolved)
+			if resolved == "." {
+				resolved = ""
+			}
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				resolved = next
+				continue
+			}
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("path %s: too many levels of symbolic links", unsafePath)
+		}
+		dest, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(dest) {
+			resolved = ""
+		}
+		remaining = dest + "/" + remaining
+	}
+
+	return filepath.Join(root, resolved), nil
+}
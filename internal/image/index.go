@@ -0,0 +1,167 @@
+package image
+
+import (
+	"fmt"
+	"io"
+	"mini-container/common"
+	"mini-container/config"
+	"mini-container/internal/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// 本地镜像仓库：每个镜像只有一层，即一个完整的 rootfs 目录
+// ~/.mini-container/images/<name>/<tag>/image.json
+// ~/.mini-container/images/<name>/<tag>/rootfs/
+
+const (
+	DefaultTag = "latest"
+	MetaName   = "image.json"
+	RootfsName = "rootfs"
+)
+
+var (
+	nameRegexp = regexp.MustCompile(`^[a-z0-9]+(?:[._-][a-z0-9]+)*(?:/[a-z0-9]+(?:[._-][a-z0-9]+)*)*$`)
+	tagRegexp  = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+)
+
+type Image struct {
+	Name    string    `json:"name"`
+	Tag     string    `json:"tag"`
+	Created time.Time `json:"created"`
+	Size    int64     `json:"size"` // 导入的tar流大小，单位byte
+}
+
+func (img *Image) Ref() string {
+	return img.Name + ":" + img.Tag
+}
+
+func (img *Image) Dir() string {
+	return filepath.Join(config.ImageStoreDir, img.Name, img.Tag)
+}
+
+// RootfsDir 镜像的 rootfs，作为容器的 lowerdir
+func (img *Image) RootfsDir() string {
+	return filepath.Join(img.Dir(), RootfsName)
+}
+
+// ParseRef "name[:tag]" -> name, tag，tag 默认为 latest
+func ParseRef(ref string) (string, string, error) {
+	name, tag := ref, DefaultTag
+	// 最后一个 '/' 之后的 ':' 才是tag分隔符
+	if i := strings.LastIndexByte(ref, ':'); i > strings.LastIndexByte(ref, '/') {
+		name, tag = ref[:i], ref[i+1:]
+	}
+	if !nameRegexp.MatchString(name) {
+		return "", "", fmt.Errorf("invalid image name %q", name)
+	}
+	if !tagRegexp.MatchString(tag) {
+		return "", "", fmt.Errorf("invalid image tag %q", tag)
+	}
+	return name, tag, nil
+}
+
+// Get 读取本地镜像
+func Get(ref string) (*Image, error) {
+	name, tag, err := ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{Name: name, Tag: tag}
+	if err := common.ReadJSON(filepath.Join(img.Dir(), MetaName), img); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("image %s not found", img.Ref())
+		}
+		return nil, err
+	}
+	return img, nil
+}
+
+// ResolveDir 将 run 命令中的镜像参数解析为 rootfs 目录：
+// 已存在的目录直接使用，否则视为本地镜像仓库中的 name[:tag]
+func ResolveDir(imageArg string) (string, error) {
+	if common.IsExistPath(imageArg) {
+		return imageArg, nil
+	}
+	img, err := Get(imageArg)
+	if err != nil {
+		return "", err
+	}
+	return img.RootfsDir(), nil
+}
+
+// Import 将 tar 流导入为单层镜像，已存在的同名镜像会被替换
+// 注意：已有容器以该镜像为 lowerdir 时，替换镜像会改变这些容器看到的文件
+func Import(r io.Reader, ref string) (*Image, error) {
+	name, tag, err := ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{Name: name, Tag: tag, Created: time.Now()}
+
+	if err := os.MkdirAll(filepath.Dir(img.Dir()), 0755); err != nil {
+		return nil, err
+	}
+	// 先解压到临时目录，成功后再替换，避免留下不完整的镜像
+	tmpDir, err := os.MkdirTemp(filepath.Dir(img.Dir()), "."+tag+"-import-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	counter := &countingReader{r: r}
+	if err := fs.Import(counter, filepath.Join(tmpDir, RootfsName)); err != nil {
+		return nil, common.ErrTag("import rootfs", err)
+	}
+	img.Size = counter.n
+	if err := common.WriteJSONSync(filepath.Join(tmpDir, MetaName), img); err != nil {
+		return nil, err
+	}
+
+	if err := os.RemoveAll(img.Dir()); err != nil {
+		return nil, err
+	}
+	return img, os.Rename(tmpDir, img.Dir())
+}
+
+// List 列出本地镜像
+func List() ([]*Image, error) {
+	images := make([]*Image, 0)
+	if !common.IsExistPath(config.ImageStoreDir) {
+		return images, nil
+	}
+
+	err := filepath.Walk(config.ImageStoreDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// rootfs 和导入中的临时目录不需要遍历
+		if info.IsDir() && (info.Name() == RootfsName || strings.HasPrefix(info.Name(), ".")) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || info.Name() != MetaName {
+			return nil
+		}
+		img := &Image{}
+		if err := common.ReadJSON(path, img); err != nil {
+			return err
+		}
+		images = append(images, img)
+		return nil
+	})
+	return images, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
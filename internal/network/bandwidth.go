@@ -0,0 +1,74 @@
+package network
+
+import (
+	"fmt"
+	"math"
+	"mini-container/internal/network/bridge"
+	"strconv"
+	"strings"
+)
+
+// 容器网卡的限速通过 tc 实现，见 bridge.SetBandwidth，速率的单位为 bit/s，为0时不限速
+
+const maxRate = 100 * 1000 * 1000 * 1000 // 100gbit
+
+// rateUnits 速率的单位，与 tc 相同：bit 为比特，bps 为字节，k/m/g 为 1000 的倍数
+var rateUnits = []struct {
+	suffix string
+	bits   uint64
+}{
+	{"gbit", 1000 * 1000 * 1000},
+	{"mbit", 1000 * 1000},
+	{"kbit", 1000},
+	{"bit", 1},
+	{"gbps", 8 * 1000 * 1000 * 1000},
+	{"mbps", 8 * 1000 * 1000},
+	{"kbps", 8 * 1000},
+	{"bps", 8},
+	{"g", 1000 * 1000 * 1000},
+	{"m", 1000 * 1000},
+	{"k", 1000},
+}
+
+// ParseRate 解析 --network-ingress-rate/--network-egress-rate 参数，返回 bit/s
+// 格式：数字[单位]，没有单位时为 bit/s，例如：10mbit、512kbit、1.5mbps、0（不限速）
+func ParseRate(spec string) (uint64, error) {
+	s := strings.ToLower(strings.TrimSpace(spec))
+	multiplier := uint64(1)
+	for _, unit := range rateUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, multiplier = strings.TrimSuffix(s, unit.suffix), unit.bits
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(value) || value < 0 {
+		return 0, fmt.Errorf("invalid rate %q, for example: 10mbit, 512kbit, 1mbps", spec)
+	}
+	bits := math.Round(value * float64(multiplier))
+	if bits != 0 && (bits < 8 || bits > maxRate) {
+		return 0, fmt.Errorf("invalid rate %q, must be between 8bit and 100gbit", spec)
+	}
+	return uint64(bits), nil
+}
+
+// FormatRate bit/s 转换为 ParseRate 的格式，为0时返回 unlimited
+func FormatRate(rate uint64) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+	for _, unit := range rateUnits[:3] {
+		if rate%unit.bits == 0 {
+			return fmt.Sprintf("%d%s", rate/unit.bits, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dbit", rate)
+}
+
+// SetBandwidth 设置或更新容器在网络中的网卡的限速，Endpoint 没有 veth 时忽略
+func SetBandwidth(ep *Endpoint, ingressRate, egressRate uint64) error {
+	if ep.VethName == "" {
+		return nil
+	}
+	return bridge.SetBandwidth(ep.VethName, ingressRate, egressRate)
+}
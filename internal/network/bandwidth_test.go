@@ -0,0 +1,40 @@
+package network
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	cases := map[string]uint64{
+		"0":        0,
+		"1000":     1000,
+		"10mbit":   10 * 1000 * 1000,
+		"512Kbit":  512 * 1000,
+		"1.5mbit":  1500 * 1000,
+		"1mbps":    8 * 1000 * 1000,
+		"2g":       2 * 1000 * 1000 * 1000,
+		" 100bps ": 800,
+	}
+	for spec, want := range cases {
+		rate, err := ParseRate(spec)
+		assert.NoError(t, err, spec)
+		assert.Equal(t, want, rate, spec)
+	}
+
+	for _, spec := range []string{"", "mbit", "-1mbit", "10mb", "1bit", "nan", "inf", "101gbit"} {
+		_, err := ParseRate(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestFormatRate(t *testing.T) {
+	assert.Equal(t, "unlimited", FormatRate(0))
+	assert.Equal(t, "10mbit", FormatRate(10*1000*1000))
+	assert.Equal(t, "1500kbit", FormatRate(1500*1000))
+	assert.Equal(t, "800bit", FormatRate(800))
+
+	rate, err := ParseRate(FormatRate(2 * 1000 * 1000 * 1000))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2*1000*1000*1000), rate)
+}
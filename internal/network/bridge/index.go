@@ -4,9 +4,9 @@ import (
 	"fmt"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 	"net"
 	"os"
-	"os/exec"
 	"runtime"
 	"strings"
 )
@@ -19,9 +19,11 @@ func truncate(maxLen int, str string) string {
 }
 
 // createBridge 使用给定的名称和接口IP创建桥接。
-func createBridge(bridgeName string, interfaceIPNet *net.IPNet) error {
+// mtu 为0时使用内核默认值
+func createBridge(bridgeName string, interfaceIPNet *net.IPNet, mtu int) error {
 	la := netlink.NewLinkAttrs()
 	la.Name = bridgeName
+	la.MTU = mtu
 	br := &netlink.Bridge{LinkAttrs: la}
 
 	if err := netlink.LinkAdd(br); err != nil {
@@ -49,37 +51,37 @@ func ParseIPNet(ipNetStr string) (*net.IPNet, error) {
 	return ipNet, nil
 }
 
-// setSNAT 在 Linux 网络配置中，SNAT（Source Network Address Translation）
-// 主要用于改变出站数据包的源 IP 地址。对于 Linux bridge 设备，设置 SNAT 有以下可能的用途：
-//
-//	1 -> 提供网络隔离：在虚拟化或容器化环境中，通常会创建多个网络命名空间以隔离不同的工作负载。
-//	  这些网络命名空间可能会连接到同一个 Linux bridge。通过在 bridge 上设置 SNAT，
-//	  可以确保每个网络命名空间的出站流量都具有唯一的源 IP 地址，从而避免 IP 地址冲突。
-//	2 -> 实现 IP 伪装：在某些情况下，你可能希望隐藏内部网络的真实 IP 地址。通过在 bridge
-//	  上设置 SNAT，可以将所有出站流量的源 IP 地址改为 bridge 的 IP 地址，从而隐藏内部网络的真实 IP 地址。
-//	3 -> 提供网络访问：在某些情况下，你可能希望让没有公网 IP 地址的内部网络能够访问公网。
-//	  通过在连接到公网的 bridge 上设置 SNAT，可以让内部网络的出站流量看起来像是来自 bridge 的 IP 地址，
-//	  从而实现内部网络访问公网。
-//
-// bridgeName string：需要设置SNAT规则的网桥名称。
-// subnet *net.IPNet：源IP地址的子网，这通常是与网桥关联的网络的子网。
-func setSNAT(bridgeName string, subnet *net.IPNet) error {
-	iptablesCMD := fmt.Sprintf("-t nat -A POSTROUTING -s %s ! -o %s -j MASQUERADE", subnet.String(), bridgeName)
-	cmd := exec.Command("iptables", strings.Split(iptablesCMD, " ")...)
-	_, err := cmd.Output()
-	if err != nil {
-		return fmt.Errorf("set snat fail %s", err)
+// EnableIPForward 开启内核的 IPv4 转发，ipv6 为 true 时同时开启 IPv6 转发，宿主机重启后会恢复为默认值
+func EnableIPForward(ipv6 bool) error {
+	if err := writeSysctl("/proc/sys/net/ipv4/ip_forward", "1"); err != nil {
+		return err
 	}
-	return nil
+	if !ipv6 {
+		return nil
+	}
+	return writeSysctl("/proc/sys/net/ipv6/conf/all/forwarding", "1")
+}
+
+// writeSysctl 值不同时才写入
+func writeSysctl(path, value string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(data)) == value {
+		return nil
+	}
+	return os.WriteFile(path, []byte(value), 0644)
 }
 
 // enterNetworkNameSpace 主要用于将一个网络链接（veth pair的一端）移动到
 // 特定的网络命名空间（通常是容器的网络命名空间），并且将当前的执行线程也切换到
 // 这个网络命名空间。当函数执行完成后，会恢复到原来的网络命名空间。
+// netnsPath string：网络命名空间的路径，例如 CreateNetworkNameSpace 创建的句柄或 /proc/<pid>/ns/net
 // return: recover function 执行它会将当前线程恢复到原来的网络命名空间。
 // 注意：无论函数是否执行成功，都需要执行返回的recover function。
-func enterNetworkNameSpace(vethLink *netlink.Link, pid int) (func(), error) {
-	file, err := os.OpenFile(fmt.Sprintf("/proc/%d/ns/net", pid), os.O_RDONLY, 0)
+func enterNetworkNameSpace(vethLink *netlink.Link, netnsPath string) (func(), error) {
+	file, err := os.OpenFile(netnsPath, os.O_RDONLY, 0)
 	if err != nil {
 		return func() {}, fmt.Errorf("error get container net namespace, %v", err)
 	}
@@ -118,31 +120,150 @@ func enterNetworkNameSpace(vethLink *netlink.Link, pid int) (func(), error) {
 	return recoverFunc, nil
 }
 
+// SetLoopbackUp 启用容器 network namespace 中的回环网卡，用于没有其他网卡的容器
+func SetLoopbackUp(netnsPath string) error {
+	file, err := os.OpenFile(netnsPath, os.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("error get container net namespace, %v", err)
+	}
+	defer file.Close()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origns, err := netns.Get()
+	if err != nil {
+		return fmt.Errorf("error get current netns, %v", err)
+	}
+	defer origns.Close()
+	if err := netns.Set(netns.NsHandle(file.Fd())); err != nil {
+		return fmt.Errorf("error set netns, %v", err)
+	}
+	defer netns.Set(origns)
+
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		return err
+	}
+	return netlink.LinkSetUp(lo)
+}
+
+// JoinNetworkNameSpace 当前线程加入 netnsPath 的 network namespace，并锁定在当前线程上不再恢复
+// 用于 child 在 exec 之前加入容器自己或另一个容器的网络，exec 后的进程继承该线程的 namespace
+func JoinNetworkNameSpace(netnsPath string) error {
+	handle, err := netns.GetFromPath(netnsPath)
+	if err != nil {
+		return fmt.Errorf("error get net namespace %s, %v", netnsPath, err)
+	}
+	defer handle.Close()
+	runtime.LockOSThread()
+	if err := netns.Set(handle); err != nil {
+		return fmt.Errorf("error set netns, %v", err)
+	}
+	return nil
+}
+
 // setInterfaceIPNet 用于设置网络接口的IP地址
+// IPv6 地址跳过重复地址检测（DAD），否则地址在检测完成前不可用
 func setInterfaceIPNet(iface netlink.Link, ipNet *net.IPNet) error {
 	addr := &netlink.Addr{IPNet: ipNet, Peer: ipNet, Label: "", Flags: 0, Scope: 0}
+	if ipNet.IP.To4() == nil {
+		addr.Flags = unix.IFA_F_NODAD
+	}
 	return netlink.AddrAdd(iface, addr)
 }
 
-// CreateBridgeAndSetSNAT 创建网桥并设置SNAT规则
-// bridgeName string：网桥名称，长度不能超过15个字符
-// ipNetStr string：网桥的IP地址，格式为：x.x.x.x/x
-// 注意：使用前请检查bridgeName是否已经存在，系统重启后需要重新建立网桥配置
-func CreateBridgeAndSetSNAT(bridgeName string, ipNetStr string) error {
-	bridgeName = truncate(15, bridgeName)
+// CreateBridge 按配置创建网桥，防火墙规则由调用方通过 firewall 设置
+// 注意：使用前请检查网桥是否已经存在，系统重启后需要重新建立网桥配置
+func CreateBridge(bc *BridgeConfig) error {
+	bridgeName := truncate(15, bc.Name)
+	if err := createBridge(bridgeName, bc.IPNet, bc.MTU); err != nil {
+		return fmt.Errorf("createBridge err=%s", err)
+	}
+	if bc.IPNet6 != nil {
+		link, err := netlink.LinkByName(bridgeName)
+		if err != nil {
+			return fmt.Errorf("link by name fail err=%s", err)
+		}
+		if err := enableIPv6(bridgeName); err != nil {
+			return err
+		}
+		if err := setInterfaceIPNet(link, bc.IPNet6); err != nil {
+			return fmt.Errorf("bridge add addr fail %s", err)
+		}
+	}
+	return nil
+}
+
+// EnsureBridge 检查并修复网桥的配置，可以重复调用：
+// 网桥不存在时创建；已存在时检查设备类型、地址、MTU、是否启用
+func EnsureBridge(bc *BridgeConfig) error {
+	bridgeName := truncate(15, bc.Name)
+	link, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return CreateBridge(bc)
+		}
+		return fmt.Errorf("link by name fail err=%s", err)
+	}
+	if link.Type() != "bridge" {
+		return fmt.Errorf("device %s exists but is not a bridge", bridgeName)
+	}
+
+	for _, f := range bc.families() {
+		if f.family == netlink.FAMILY_V6 {
+			if err := enableIPv6(bridgeName); err != nil {
+				return err
+			}
+		}
+		if err := ensureAddr(link, f.family, f.ipNet); err != nil {
+			return err
+		}
+	}
+
+	if bc.MTU > 0 && link.Attrs().MTU != bc.MTU {
+		if err := netlink.LinkSetMTU(link, bc.MTU); err != nil {
+			return fmt.Errorf("set mtu of %s fail err=%s", bridgeName, err)
+		}
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("error enabling interface for %s: %v", bridgeName, err)
+		}
+	}
+	return nil
+}
 
-	// 创建网桥
-	interfaceIP, err := ParseIPNet(ipNetStr)
+// ensureAddr 网卡上没有该地址时添加
+func ensureAddr(link netlink.Link, family int, ipNet *net.IPNet) error {
+	addrs, err := netlink.AddrList(link, family)
 	if err != nil {
-		return fmt.Errorf("ParseIPNet err=%s", err)
+		return fmt.Errorf("list addr of %s fail err=%s", link.Attrs().Name, err)
+	}
+	for _, addr := range addrs {
+		if addr.IPNet.String() == ipNet.String() {
+			return nil
+		}
 	}
+	if err := setInterfaceIPNet(link, ipNet); err != nil {
+		return fmt.Errorf("bridge add addr fail %s", err)
+	}
+	return nil
+}
 
-	err = createBridge(bridgeName, interfaceIP)
+// DeleteBridge 删除网桥，网桥不存在时忽略
+func DeleteBridge(bc *BridgeConfig) error {
+	bridgeName := truncate(15, bc.Name)
+	br, err := netlink.LinkByName(bridgeName)
 	if err != nil {
-		return fmt.Errorf("createBridge err=%s", err)
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("link by name fail err=%s", err)
+	}
+	if err := netlink.LinkDel(br); err != nil {
+		return fmt.Errorf("delete bridge %s fail err=%s", bridgeName, err)
 	}
-	_, subnet, _ := net.ParseCIDR(ipNetStr)
-	return setSNAT(bridgeName, subnet)
+	return nil
 }
 
 func ExistsBridge(bridgeName string) bool {
@@ -155,20 +276,22 @@ func ExistsBridge(bridgeName string) bool {
 // CreateVeth 创建veth设备
 // bridgeName string：网桥名称，长度不能超过15个字符
 // vethName string：veth设备名称，长度不能超过10个字符
-// return: veth peer name
+// return: 宿主机端 veth name, veth peer name
 // 注意：使用前请检查bridgeName是否已经存在
-func CreateVeth(bridgeName, vethName string) (string, error) {
+func CreateVeth(bridgeName, vethName string) (string, string, error) {
 	bridgeName = truncate(15, bridgeName)
 	vethName = truncate(10, vethName)
 
 	br, err := netlink.LinkByName(bridgeName)
 	if err != nil {
-		return "", fmt.Errorf("link by name fail err=%s", err)
+		return "", "", fmt.Errorf("link by name fail err=%s", err)
 	}
 
 	la := netlink.NewLinkAttrs()
 	la.Name = "veth-" + vethName
 	la.MasterIndex = br.Attrs().Index
+	// 与网桥保持一致，peer 端使用相同的 MTU
+	la.MTU = br.Attrs().MTU
 
 	// 创建veth设备
 	vethLink := &netlink.Veth{
@@ -177,17 +300,67 @@ func CreateVeth(bridgeName, vethName string) (string, error) {
 	}
 
 	if err := netlink.LinkAdd(vethLink); err != nil {
-		return "", fmt.Errorf("veth creation failed for bridge %s: %s", bridgeName, err)
+		return "", "", fmt.Errorf("veth creation failed for bridge %s: %s", bridgeName, err)
 	}
 
 	if err := netlink.LinkSetUp(vethLink); err != nil {
-		return "", fmt.Errorf("error enabling interface for %s: %v", vethName, err)
+		return "", "", fmt.Errorf("error enabling interface for %s: %v", vethName, err)
+	}
+
+	return vethLink.Name, vethLink.PeerName, nil
+}
+
+// DeleteVeth 删除宿主机端的 veth，peer 端会一起被删除，不存在时忽略
+func DeleteVeth(hostVethName string) error {
+	return DeleteLink(hostVethName)
+}
+
+// DeleteLink 删除宿主机上的网卡，不存在时忽略
+func DeleteLink(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("link by name fail err=%s", err)
 	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("delete link %s fail err=%s", name, err)
+	}
+	return nil
+}
+
+// HardwareAddr 网卡的 MAC 地址
+func HardwareAddr(linkName string) (net.HardwareAddr, error) {
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		return nil, fmt.Errorf("link by name fail err=%s", err)
+	}
+	return link.Attrs().HardwareAddr, nil
+}
+
+// SetHairpin 开启 veth 在网桥端口上的 hairpin 模式，允许数据包从进入的端口发回
+// hostVethName string：CreateVeth 返回的宿主机端 veth 名称
+func SetHairpin(hostVethName string) error {
+	link, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("link by name fail err=%s", err)
+	}
+	return netlink.LinkSetHairpin(link, true)
+}
 
-	return vethLink.PeerName, nil
+// EndpointAddr 容器在一个地址族中的地址
+type EndpointAddr struct {
+	IP      net.IP
+	Gateway *net.IPNet // 网桥（macvlan/ipvlan 为物理网络中的路由器）的地址，提供子网掩码和默认路由的网关
+	// DeviceRoute 默认路由直接经过网卡而不经过网关，用于 ipvlan l3 模式，由 parent 所在的网络命名空间路由
+	DeviceRoute bool
 }
 
-func SetContainerIP(peerName string, pid int, containerIP net.IP, gateway *net.IPNet) error {
+// SetContainerIP 将 veth peer（或 macvlan/ipvlan 子接口）移入容器的网络命名空间并配置地址
+// addrs: 容器的 IPv4 地址，以及可选的 IPv6 地址
+// defaultRoute: 是否添加经过网关的默认路由，内部网络只能访问同一子网
+func SetContainerIP(peerName, netnsPath string, addrs []*EndpointAddr, defaultRoute bool) error {
 	peerLink, err := netlink.LinkByName(peerName)
 	if err != nil {
 		return fmt.Errorf("fail config endpoint: %v", err)
@@ -198,19 +371,26 @@ func SetContainerIP(peerName string, pid int, containerIP net.IP, gateway *net.I
 	}
 
 	// 进入容器的网络命名空间
-	recoverFunc, err := enterNetworkNameSpace(&peerLink, pid)
+	recoverFunc, err := enterNetworkNameSpace(&peerLink, netnsPath)
 	defer recoverFunc()
 	if err != nil {
 		return fmt.Errorf("enterNetworkNameSpace fail err=%s", err)
 	}
 
-	peerIPNet := &net.IPNet{
-		IP:   containerIP,
-		Mask: gateway.Mask,
-	}
-
-	if err := setInterfaceIPNet(peerLink, peerIPNet); err != nil {
-		return fmt.Errorf("%v,%s", containerIP, err)
+	for _, addr := range addrs {
+		if addr.IP.To4() == nil {
+			// 当前线程已经在容器的网络命名空间中，/proc/sys/net 对应容器的配置
+			if err := enableIPv6(peerName); err != nil {
+				return err
+			}
+		}
+		peerIPNet := &net.IPNet{
+			IP:   addr.IP,
+			Mask: addr.Gateway.Mask,
+		}
+		if err := setInterfaceIPNet(peerLink, peerIPNet); err != nil {
+			return fmt.Errorf("%v,%s", addr.IP, err)
+		}
 	}
 	if err := netlink.LinkSetUp(peerLink); err != nil {
 		return fmt.Errorf("netlink.LinkSetUp fail  name=%s err=%s", peerName, err)
@@ -219,19 +399,44 @@ func SetContainerIP(peerName string, pid int, containerIP net.IP, gateway *net.I
 		return fmt.Errorf("netlink.LinkSetUp fail  name=%s err=%s", peerName, err)
 	}
 
+	if !defaultRoute {
+		return nil
+	}
+
 	// 为容器设置默认路由
 	// LinkIndex: 是网卡的索引，这里是Veth peer的索引
 	// Gw: 网关地址
 	// Dst: 目标地址
-	_, cidr, _ := net.ParseCIDR("0.0.0.0/0")
-	defaultRoute := &netlink.Route{
-		LinkIndex: peerLink.Attrs().Index,
-		Gw:        gateway.IP,
-		Dst:       cidr,
-	}
-	if err = netlink.RouteAdd(defaultRoute); err != nil {
-		return fmt.Errorf("router add fail %s", err)
+	for _, addr := range addrs {
+		_, cidr, _ := net.ParseCIDR("0.0.0.0/0")
+		if addr.IP.To4() == nil {
+			_, cidr, _ = net.ParseCIDR("::/0")
+		}
+		route := &netlink.Route{
+			LinkIndex: peerLink.Attrs().Index,
+			Gw:        addr.Gateway.IP,
+			Dst:       cidr,
+		}
+		if addr.DeviceRoute {
+			route.Gw = nil
+			route.Scope = netlink.SCOPE_LINK
+		}
+		if err = netlink.RouteAdd(route); err != nil {
+			return fmt.Errorf("router add fail %s", err)
+		}
 	}
 
 	return nil
 }
+
+// enableIPv6 开启网卡的 IPv6，部分发行版默认关闭了 IPv6
+func enableIPv6(ifName string) error {
+	path := fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/disable_ipv6", ifName)
+	if err := writeSysctl(path, "0"); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("ipv6 is not supported by the kernel")
+		}
+		return fmt.Errorf("enable ipv6 on %s fail err=%s", ifName, err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// macvlan/ipvlan 子接口：在宿主机网卡（parent）上创建，移入容器的网络命名空间后由 SetContainerIP 配置地址
+// 子接口随容器的网络命名空间一起销毁，宿主机上不需要清理；容器运行中断开网络时由 DeleteLinkInNetNS 删除
+
+const (
+	IPVlanModeL2 = "l2"
+	IPVlanModeL3 = "l3"
+)
+
+// EnsureParent 检查 parent 网卡存在并启用它，子接口只有在 parent 启用时才能收发数据包
+func EnsureParent(parent string) error {
+	link, err := netlink.LinkByName(parent)
+	if err != nil {
+		return fmt.Errorf("parent interface %s: %s", parent, err)
+	}
+	if link.Attrs().Flags&net.FlagUp != 0 {
+		return nil
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("error enabling interface for %s: %v", parent, err)
+	}
+	return nil
+}
+
+// CreateMacvlan 在 parent 上创建 bridge 模式的 macvlan 子接口，同一 parent 上的子接口之间可以直接通信
+// name string：子接口名称，长度不能超过15个字符，移入容器后保持不变
+// mtu 为0时与 parent 相同
+func CreateMacvlan(parent, name string, mtu int) error {
+	la, err := subInterfaceAttrs(parent, name, mtu)
+	if err != nil {
+		return err
+	}
+	link := &netlink.Macvlan{LinkAttrs: la, Mode: netlink.MACVLAN_MODE_BRIDGE}
+	if err := netlink.LinkAdd(link); err != nil {
+		return fmt.Errorf("macvlan creation failed for parent %s: %s", parent, err)
+	}
+	return nil
+}
+
+// CreateIPVlan 在 parent 上创建 ipvlan 子接口，子接口与 parent 使用相同的 MAC 地址
+// mode：l2 或 l3，l3 模式下子接口不处理 ARP 和广播，由 parent 所在的网络命名空间路由
+func CreateIPVlan(parent, name, mode string, mtu int) error {
+	la, err := subInterfaceAttrs(parent, name, mtu)
+	if err != nil {
+		return err
+	}
+	link := &netlink.IPVlan{LinkAttrs: la, Mode: netlink.IPVLAN_MODE_L2}
+	if mode == IPVlanModeL3 {
+		link.Mode = netlink.IPVLAN_MODE_L3
+	}
+	if err := netlink.LinkAdd(link); err != nil {
+		return fmt.Errorf("ipvlan creation failed for parent %s: %s", parent, err)
+	}
+	return nil
+}
+
+func subInterfaceAttrs(parent, name string, mtu int) (netlink.LinkAttrs, error) {
+	la := netlink.NewLinkAttrs()
+	parentLink, err := netlink.LinkByName(parent)
+	if err != nil {
+		return la, fmt.Errorf("parent interface %s: %s", parent, err)
+	}
+	la.Name = name
+	la.ParentIndex = parentLink.Attrs().Index
+	la.MTU = mtu
+	return la, nil
+}
+
+// DeleteLinkInNetNS 删除 netnsPath 对应的 network namespace 中的网卡 name，句柄或网卡不存在时忽略
+// 子接口没有宿主机端，移入容器之后只能在容器的 namespace 中删除；通过 netlink handle 操作，不需要切换当前线程
+func DeleteLinkInNetNS(netnsPath, name string) error {
+	ns, err := netns.GetFromPath(netnsPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("error get container net namespace, %v", err)
+	}
+	defer ns.Close()
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return fmt.Errorf("error get netlink handle, %v", err)
+	}
+	defer handle.Delete()
+
+	link, err := handle.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("link by name fail err=%s", err)
+	}
+	if err := handle.LinkDel(link); err != nil {
+		return fmt.Errorf("delete link %s fail err=%s", name, err)
+	}
+	return nil
+}
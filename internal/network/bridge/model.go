@@ -1,9 +1,31 @@
 package bridge
 
-import "net"
+import (
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
 
 type BridgeConfig struct {
-	Name   string     `json:"name"`
-	IPNet  *net.IPNet `json:"ipNet"`
-	Subnet *net.IPNet `json:"subnet"`
+	Name    string     `json:"name"`
+	IPNet   *net.IPNet `json:"ipNet"` // 网桥的地址，也是容器的网关，x.x.x.x/x
+	Subnet  *net.IPNet `json:"subnet"`
+	IPNet6  *net.IPNet `json:"ipNet6"` // 网桥的 IPv6 地址，为 nil 时不启用 IPv6
+	Subnet6 *net.IPNet `json:"subnet6"`
+	MTU     int        `json:"mtu"` // 为0时使用内核默认值
+}
+
+// family 网桥在一个地址族中的配置
+type family struct {
+	family int
+	ipNet  *net.IPNet
+}
+
+// families 网桥启用的地址族，IPv4 总是启用
+func (bc *BridgeConfig) families() []family {
+	families := []family{{netlink.FAMILY_V4, bc.IPNet}}
+	if bc.IPNet6 != nil {
+		families = append(families, family{netlink.FAMILY_V6, bc.IPNet6})
+	}
+	return families
 }
@@ -0,0 +1,81 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// CreateNetworkNameSpace 创建一个新的 network namespace 并 bind mount 到 path，与 ip netns add 相同：
+// namespace 不依赖任何进程，直到 DeleteNetworkNameSpace；path 已经存在时先删除上次残留的
+func CreateNetworkNameSpace(path string) error {
+	if err := DeleteNetworkNameSpace(path); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return err
+	}
+	file.Close()
+
+	// 在单独的 goroutine 中切换 namespace，恢复失败时不解锁线程，goroutine 结束时该线程随之退出，不会被其他 goroutine 使用
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		errCh <- bindNewNetworkNameSpace(path)
+	}()
+	if err := <-errCh; err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// bindNewNetworkNameSpace 当前线程进入新的 network namespace 并 bind mount 到 path，之后切换回来
+// 只有切换回原来的 namespace 之后才解锁线程
+// 注意：需要在已经 LockOSThread 的 goroutine 中执行
+func bindNewNetworkNameSpace(path string) error {
+	origns, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("error get current netns, %v", err)
+	}
+	defer origns.Close()
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("unshare net namespace fail err=%s", err)
+	}
+	mountErr := unix.Mount(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()), path, "none", unix.MS_BIND, "")
+	if err := netns.Set(origns); err != nil {
+		if mountErr == nil {
+			unix.Unmount(path, unix.MNT_DETACH)
+		}
+		return fmt.Errorf("error set netns, %v", err)
+	}
+	runtime.UnlockOSThread()
+	if mountErr != nil {
+		return fmt.Errorf("bind net namespace to %s fail err=%s", path, mountErr)
+	}
+	return nil
+}
+
+// DeleteNetworkNameSpace 卸载并删除 CreateNetworkNameSpace 创建的句柄，不存在时忽略
+// 没有进程使用时 namespace 随之销毁，其中的网卡（veth peer、macvlan/ipvlan 子接口）一起删除
+func DeleteNetworkNameSpace(path string) error {
+	err := unix.Unmount(path, unix.MNT_DETACH)
+	if err != nil && !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("unmount %s fail err=%s", path, err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package bridge
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// 容器网卡的限速，与 CNI 的 bandwidth 插件相同，都在宿主机端的 veth 上配置：
+//  - 进入容器的流量：veth 的出口，root qdisc 为 tbf
+//  - 容器发出的流量：veth 的入口只能 police 丢包，这里通过 ingress qdisc 和 mirred 将流量重定向到 ifb 设备，在 ifb 的出口使用 tbf
+// 速率的单位为 bit/s，为0时不限速
+
+const (
+	tbfLatencyUsec = 25000     // 数据包在 tbf 队列中的最长等待时间
+	tbfMinBurst    = 64 * 1024 // 令牌桶的最小容量，单位 byte
+)
+
+// ifbName veth 对应的 ifb 设备名称，veth-<pid>-<rand> -> ifb-<pid>-<rand>
+func ifbName(hostVethName string) string {
+	return truncate(15, "ifb-"+strings.TrimPrefix(hostVethName, "veth-"))
+}
+
+// SetBandwidth 设置宿主机端 veth 的限速，可以重复调用更新速率，速率为0时删除对应方向的限速
+// hostVethName string：CreateVeth 返回的宿主机端 veth 名称
+// ingressRate：进入容器的速率，egressRate：容器发出的速率
+func SetBandwidth(hostVethName string, ingressRate, egressRate uint64) error {
+	link, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("link by name fail err=%s", err)
+	}
+	if err := setTBF(link, ingressRate); err != nil {
+		return fmt.Errorf("set ingress rate fail err=%s", err)
+	}
+	if err := setEgress(link, egressRate); err != nil {
+		return fmt.Errorf("set egress rate fail err=%s", err)
+	}
+	return nil
+}
+
+// DeleteBandwidth 删除 veth 的 ifb 设备，veth 上的 qdisc 随 veth 一起删除，ifb 不存在时忽略
+func DeleteBandwidth(hostVethName string) error {
+	return DeleteLink(ifbName(hostVethName))
+}
+
+// setTBF 替换 link 的 root qdisc 为 tbf，rate 为0时删除
+func setTBF(link netlink.Link, rate uint64) error {
+	if rate == 0 {
+		return deleteQdisc(link, "tbf")
+	}
+	rateInBytes := rate / 8
+	burst := uint32(rateInBytes / 100) // 10ms 的流量
+	if burst < tbfMinBurst {
+		burst = tbfMinBurst
+	}
+	qdisc := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   rateInBytes,
+		Buffer: uint32(netlink.Xmittime(rateInBytes, burst)),
+		Limit:  uint32(rateInBytes*tbfLatencyUsec/netlink.TIME_UNITS_PER_SEC) + burst,
+	}
+	return netlink.QdiscReplace(qdisc)
+}
+
+// setEgress 将 link 入口的流量重定向到 ifb，并在 ifb 上限速，rate 为0时删除 ingress qdisc 和 ifb
+func setEgress(link netlink.Link, rate uint64) error {
+	name := ifbName(link.Attrs().Name)
+	if rate == 0 {
+		if err := deleteQdisc(link, "ingress"); err != nil {
+			return err
+		}
+		return DeleteLink(name)
+	}
+
+	ifb, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		la := netlink.NewLinkAttrs()
+		la.Name = name
+		la.MTU = link.Attrs().MTU
+		la.TxQLen = 1000
+		if err := netlink.LinkAdd(&netlink.Ifb{LinkAttrs: la}); err != nil {
+			return fmt.Errorf("ifb creation failed for %s: %s", name, err)
+		}
+		ifb, err = netlink.LinkByName(name)
+	}
+	if err != nil {
+		return fmt.Errorf("link by name fail err=%s", err)
+	}
+	if err := netlink.LinkSetUp(ifb); err != nil {
+		return fmt.Errorf("error enabling interface for %s: %v", name, err)
+	}
+	if err := setTBF(ifb, rate); err != nil {
+		return err
+	}
+
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	if err := netlink.QdiscReplace(ingress); err != nil {
+		return fmt.Errorf("add ingress qdisc fail err=%s", err)
+	}
+	// Sel 为空时匹配所有数据包
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    ingress.Handle,
+			Priority:  1,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		ClassId: netlink.MakeHandle(1, 1),
+		Actions: []netlink.Action{netlink.NewMirredAction(ifb.Attrs().Index)},
+	}
+	if err := netlink.FilterReplace(filter); err != nil {
+		return fmt.Errorf("add redirect filter fail err=%s", err)
+	}
+	return nil
+}
+
+// deleteQdisc 删除 link 上指定类型的 qdisc，不存在时忽略
+func deleteQdisc(link netlink.Link, qdiscType string) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("list qdisc fail err=%s", err)
+	}
+	for _, qdisc := range qdiscs {
+		if qdisc.Type() != qdiscType {
+			continue
+		}
+		if err := netlink.QdiscDel(qdisc); err != nil {
+			return fmt.Errorf("delete %s qdisc fail err=%s", qdiscType, err)
+		}
+	}
+	return nil
+}
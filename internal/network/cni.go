@@ -0,0 +1,122 @@
+package network
+
+import (
+	"encoding/json"
+	"mini-container/common"
+	"mini-container/config"
+	"mini-container/internal/network/cni"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// cni:<name> 模式：
+//  - 容器启动时以容器 network namespace 的句柄（见 NetNSPath）作为 CNI_NETNS、容器名作为 CNI_CONTAINERID，
+//    执行网络配置中所有插件的 ADD，结果保存在容器的状态中
+//  - 容器停止时使用保存的结果执行 DEL，之后再删除 netns 句柄
+// 网络的地址、路由、端口映射等全部由插件负责，mini-container 不做任何宿主机上的配置
+
+const (
+	// EnvCNIConfDir CNI 网络配置的目录，为空时使用 config.CNIConfDir
+	EnvCNIConfDir = "MINI_CONTAINER_CNI_CONF_DIR"
+	// EnvCNIPath CNI 插件的目录，多个目录用 : 分隔，为空时使用 config.CNIBinDir
+	EnvCNIPath = "MINI_CONTAINER_CNI_PATH"
+
+	// cniIfName 容器中网卡的名称
+	cniIfName = "eth0"
+)
+
+func cniConfDir() string {
+	if dir := os.Getenv(EnvCNIConfDir); dir != "" {
+		return dir
+	}
+	return config.CNIConfDir
+}
+
+func cniBinDirs() []string {
+	if path := os.Getenv(EnvCNIPath); path != "" {
+		return filepath.SplitList(path)
+	}
+	return []string{config.CNIBinDir}
+}
+
+// GetCNIConfList 按名字读取 CNI 网络配置
+func GetCNIConfList(name string) (*cni.ConfList, error) {
+	return cni.LoadConfList(cniConfDir(), name)
+}
+
+func cniRuntimeConf(containerName, netnsPath string) *cni.RuntimeConf {
+	return &cni.RuntimeConf{
+		ContainerID: containerName,
+		NetNS:       netnsPath,
+		IfName:      cniIfName,
+		Args:        [][2]string{{"IgnoreUnknown", "1"}},
+		BinDirs:     cniBinDirs(),
+	}
+}
+
+// AttachCNI 为 netnsPath 的 network namespace 执行 CNI 网络 name 的 ADD，返回插件的结果
+// 失败时撤销已经执行的插件
+func AttachCNI(name, containerName, netnsPath string) (json.RawMessage, error) {
+	list, err := GetCNIConfList(name)
+	if err != nil {
+		return nil, err
+	}
+	rt := cniRuntimeConf(containerName, netnsPath)
+	result, err := cni.AddNetworkList(list, rt)
+	if err != nil {
+		common.ErrLog("attach cni network "+name, cni.DelNetworkList(list, rt, nil))
+		return nil, err
+	}
+	return result, nil
+}
+
+// DetachCNI 使用 ADD 的结果执行 CNI 网络 name 的 DEL，需要在删除 netns 句柄之前调用，插件可以删除其中的网卡
+// netnsPath 不存在时 CNI_NETNS 为空，插件只释放宿主机上的资源
+func DetachCNI(name, containerName, netnsPath string, result json.RawMessage) error {
+	list, err := GetCNIConfList(name)
+	if err != nil {
+		return common.ErrTag("detach cni network "+name, err)
+	}
+	if _, err := os.Stat(netnsPath); err != nil {
+		netnsPath = ""
+	}
+	return common.ErrTag("detach cni network "+name, cni.DelNetworkList(list, cniRuntimeConf(containerName, netnsPath), result))
+}
+
+// CheckCNI 执行 CNI 网络 name 的 CHECK，检查容器的网络与 ADD 的结果一致
+func CheckCNI(name, containerName, netnsPath string, result json.RawMessage) error {
+	list, err := GetCNIConfList(name)
+	if err != nil {
+		return err
+	}
+	return cni.CheckNetworkList(list, cniRuntimeConf(containerName, netnsPath), result)
+}
+
+// CNIResultIPNets CNI 结果中分配给容器的地址，结果无法解析时返回 nil
+func CNIResultIPNets(result json.RawMessage) []*net.IPNet {
+	r, err := cni.ParseResult(result)
+	if err != nil {
+		return nil
+	}
+	return r.IPNets()
+}
+
+// CNIResultIPs 同 CNIResultIPNets，只返回IP
+func CNIResultIPs(result json.RawMessage) []net.IP {
+	ipNets := CNIResultIPNets(result)
+	ips := make([]net.IP, 0, len(ipNets))
+	for _, ipNet := range ipNets {
+		ips = append(ips, ipNet.IP)
+	}
+	return ips
+}
+
+// CNIResultNameservers CNI 结果中的 DNS 服务器，没有时返回 nil
+func CNIResultNameservers(result json.RawMessage) []string {
+	r, err := cni.ParseResult(result)
+	if err != nil || len(r.DNS.Nameservers) == 0 {
+		return nil
+	}
+	return r.DNS.Nameservers
+}
@@ -0,0 +1,274 @@
+package cni
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 最小的 CNI 运行时，见 https://github.com/containernetworking/cni/blob/main/SPEC.md：
+//  - 从配置目录读取网络配置列表（*.conflist），也支持只有一个插件的 *.conf/*.json
+//  - 按顺序执行插件的 ADD/CHECK，逆序执行 DEL；插件的配置通过 stdin 传入，参数通过 CNI_* 环境变量传入
+//  - 上一个插件的结果作为 prevResult 传给下一个插件，DEL 和 CHECK 使用 ADD 的最终结果
+// 结果只支持 0.3.0 及以上版本的格式（ips 字段）
+
+const (
+	CommandAdd   = "ADD"
+	CommandDel   = "DEL"
+	CommandCheck = "CHECK"
+)
+
+// ConfList 网络配置列表
+type ConfList struct {
+	CNIVersion   string                       `json:"cniVersion"`
+	Name         string                       `json:"name"`
+	DisableCheck bool                         `json:"disableCheck"`
+	Plugins      []map[string]json.RawMessage `json:"plugins"`
+	Path         string                       `json:"-"` // 配置文件路径
+}
+
+// RuntimeConf 执行插件时的参数
+type RuntimeConf struct {
+	ContainerID string
+	NetNS       string      // network namespace 的路径，DEL 时可以为空
+	IfName      string      // 容器中网卡的名称
+	Args        [][2]string // CNI_ARGS
+	BinDirs     []string    // 插件所在的目录，即 CNI_PATH
+}
+
+// Error 插件失败时在 stdout 输出的错误
+type Error struct {
+	Code    uint   `json:"code"`
+	Msg     string `json:"msg"`
+	Details string `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Details == "" {
+		return fmt.Sprintf("%s (code %d)", e.Msg, e.Code)
+	}
+	return fmt.Sprintf("%s: %s (code %d)", e.Msg, e.Details, e.Code)
+}
+
+// LoadConfList 在配置目录中按文件名顺序查找名为 name 的网络配置
+func LoadConfList(dir, name string) (*ConfList, error) {
+	lists, err := LoadConfLists(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, list := range lists {
+		if list.Name == name {
+			return list, nil
+		}
+	}
+	return nil, fmt.Errorf("cni network %s not found in %s", name, dir)
+}
+
+// LoadConfLists 读取配置目录中的所有网络配置，按文件名排序
+func LoadConfLists(dir string) ([]*ConfList, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		switch filepath.Ext(e.Name()) {
+		case ".conflist", ".conf", ".json":
+			if !e.IsDir() {
+				names = append(names, e.Name())
+			}
+		}
+	}
+	sort.Strings(names)
+
+	lists := make([]*ConfList, 0, len(names))
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		list, err := ParseConfList(data, filepath.Ext(name) != ".conflist")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		list.Path = path
+		lists = append(lists, list)
+	}
+	return lists, nil
+}
+
+// ParseConfList 解析网络配置，single 为 true 时为只有一个插件的配置
+func ParseConfList(data []byte, single bool) (*ConfList, error) {
+	list := &ConfList{}
+	if single {
+		plugin := map[string]json.RawMessage{}
+		if err := json.Unmarshal(data, &plugin); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, list); err != nil {
+			return nil, err
+		}
+		list.Plugins = []map[string]json.RawMessage{plugin}
+	} else if err := json.Unmarshal(data, list); err != nil {
+		return nil, err
+	}
+
+	if list.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	if len(list.Plugins) == 0 {
+		return nil, fmt.Errorf("no plugins in network %s", list.Name)
+	}
+	for i, plugin := range list.Plugins {
+		if pluginType(plugin) == "" {
+			return nil, fmt.Errorf("type of plugin %d in network %s is required", i, list.Name)
+		}
+	}
+	return list, nil
+}
+
+func pluginType(plugin map[string]json.RawMessage) string {
+	var typ string
+	json.Unmarshal(plugin["type"], &typ)
+	return typ
+}
+
+// AddNetworkList 按顺序执行所有插件的 ADD，返回最后一个插件的结果
+// 注意：失败时已经执行过 ADD 的插件不会被撤销，调用方需要执行 DelNetworkList
+func AddNetworkList(list *ConfList, rt *RuntimeConf) (json.RawMessage, error) {
+	var result json.RawMessage
+	for _, plugin := range list.Plugins {
+		out, err := list.exec(CommandAdd, plugin, result, rt)
+		if err != nil {
+			return nil, err
+		}
+		// 没有输出的插件沿用上一个插件的结果
+		if len(bytes.TrimSpace(out)) > 0 {
+			result = out
+		}
+	}
+	return result, nil
+}
+
+// DelNetworkList 逆序执行所有插件的 DEL，result 为 ADD 的结果，没有时为 nil
+func DelNetworkList(list *ConfList, rt *RuntimeConf, result json.RawMessage) error {
+	for i := len(list.Plugins) - 1; i >= 0; i-- {
+		if _, err := list.exec(CommandDel, list.Plugins[i], result, rt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckNetworkList 按顺序执行所有插件的 CHECK，检查网络配置和 ADD 的结果一致，需要 0.4.0 以上的版本
+func CheckNetworkList(list *ConfList, rt *RuntimeConf, result json.RawMessage) error {
+	if compareVersion(list.CNIVersion, "0.4.0") < 0 {
+		return fmt.Errorf("CHECK is not supported by cniVersion %q of network %s", list.CNIVersion, list.Name)
+	}
+	if list.DisableCheck {
+		return nil
+	}
+	if result == nil {
+		return fmt.Errorf("no result of network %s to check", list.Name)
+	}
+	for _, plugin := range list.Plugins {
+		if _, err := list.exec(CommandCheck, plugin, result, rt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exec 执行一个插件，stdin 为插件的配置加上网络的 name、cniVersion 和 prevResult
+func (list *ConfList) exec(command string, plugin map[string]json.RawMessage, prevResult json.RawMessage, rt *RuntimeConf) ([]byte, error) {
+	typ := pluginType(plugin)
+	conf := make(map[string]json.RawMessage, len(plugin)+3)
+	for k, v := range plugin {
+		conf[k] = v
+	}
+	conf["name"], _ = json.Marshal(list.Name)
+	conf["cniVersion"], _ = json.Marshal(list.CNIVersion)
+	delete(conf, "prevResult")
+	if prevResult != nil {
+		conf["prevResult"] = prevResult
+	}
+	stdin, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	bin, err := findPlugin(typ, rt.BinDirs)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, len(rt.Args))
+	for _, kv := range rt.Args {
+		args = append(args, kv[0]+"="+kv[1])
+	}
+	cmd := exec.Command(bin)
+	cmd.Env = append(os.Environ(),
+		"CNI_COMMAND="+command,
+		"CNI_CONTAINERID="+rt.ContainerID,
+		"CNI_NETNS="+rt.NetNS,
+		"CNI_IFNAME="+rt.IfName,
+		"CNI_ARGS="+strings.Join(args, ";"),
+		"CNI_PATH="+strings.Join(rt.BinDirs, string(os.PathListSeparator)),
+	)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// 插件失败时在 stdout 输出 Error
+		pluginErr := &Error{}
+		if json.Unmarshal(stdout.Bytes(), pluginErr) == nil && pluginErr.Msg != "" {
+			err = pluginErr
+		} else if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%s: %s", err, msg)
+		}
+		return nil, fmt.Errorf("plugin %s %s: %w", typ, command, err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// findPlugin 在插件目录中查找可执行文件
+func findPlugin(typ string, dirs []string) (string, error) {
+	if strings.ContainsRune(typ, os.PathSeparator) {
+		return "", fmt.Errorf("invalid plugin type %q", typ)
+	}
+	for _, dir := range dirs {
+		path := filepath.Join(dir, typ)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("plugin %s not found in %s", typ, strings.Join(dirs, string(os.PathListSeparator)))
+}
+
+// compareVersion 比较 x.y.z 格式的版本号，无法解析的部分视为0
+func compareVersion(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < 3; i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
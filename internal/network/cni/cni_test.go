@@ -0,0 +1,146 @@
+package cni
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakePlugin 记录每次调用的环境变量和 stdin，ADD 时输出固定的结果
+const fakePlugin = `#!/bin/sh
+log="$(dirname "$0")/calls.log"
+conf=$(cat)
+echo "$CNI_COMMAND $CNI_CONTAINERID $CNI_NETNS $CNI_IFNAME $CNI_ARGS $(basename "$0") $conf" >> "$log"
+case "$CNI_COMMAND" in
+ADD) echo '{"cniVersion":"1.0.0","interfaces":[{"name":"eth0","sandbox":"'"$CNI_NETNS"'"}],"ips":[{"address":"10.22.0.5/16","gateway":"10.22.0.1","interface":0}],"dns":{"nameservers":["10.22.0.1"]}}' ;;
+esac
+`
+
+const failPlugin = `#!/bin/sh
+echo '{"cniVersion":"1.0.0","code":11,"msg":"failed to allocate","details":"range is full"}'
+exit 1
+`
+
+func writePlugin(t *testing.T, dir, name, script string) {
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(script), 0755))
+}
+
+func calls(t *testing.T, dir string) []string {
+	data, err := os.ReadFile(filepath.Join(dir, "calls.log"))
+	assert.NoError(t, err)
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestLoadConfList(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "10-mynet.conflist"), []byte(`{
+		"cniVersion": "1.0.0", "name": "mynet",
+		"plugins": [{"type": "bridge", "bridge": "cni0", "ipam": {"type": "host-local", "subnet": "10.22.0.0/16"}}, {"type": "portmap"}]
+	}`), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "20-lo.conf"), []byte(`{"cniVersion": "0.3.1", "name": "lo", "type": "loopback"}`), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("ignored"), 0644))
+
+	list, err := LoadConfList(dir, "mynet")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.0.0", list.CNIVersion)
+	assert.Len(t, list.Plugins, 2)
+	assert.Equal(t, "portmap", pluginType(list.Plugins[1]))
+	assert.Equal(t, filepath.Join(dir, "10-mynet.conflist"), list.Path)
+
+	list, err = LoadConfList(dir, "lo")
+	assert.NoError(t, err)
+	assert.Len(t, list.Plugins, 1)
+	assert.Equal(t, "loopback", pluginType(list.Plugins[0]))
+
+	_, err = LoadConfList(dir, "other")
+	assert.Error(t, err)
+
+	for _, conf := range []string{`{"name": "x", "plugins": []}`, `{"plugins": [{"type": "bridge"}]}`, `{"name": "x", "plugins": [{}]}`, `{`} {
+		_, err := ParseConfList([]byte(conf), false)
+		assert.Error(t, err, conf)
+	}
+}
+
+func TestNetworkList(t *testing.T) {
+	bin := t.TempDir()
+	writePlugin(t, bin, "first", fakePlugin)
+	writePlugin(t, bin, "second", fakePlugin)
+	list, err := ParseConfList([]byte(`{"cniVersion": "1.0.0", "name": "mynet", "plugins": [{"type": "first", "mtu": 1450}, {"type": "second"}]}`), false)
+	assert.NoError(t, err)
+	rt := &RuntimeConf{
+		ContainerID: "test",
+		NetNS:       "/var/run/netns/test",
+		IfName:      "eth0",
+		Args:        [][2]string{{"IgnoreUnknown", "1"}},
+		BinDirs:     []string{t.TempDir(), bin},
+	}
+
+	result, err := AddNetworkList(list, rt)
+	assert.NoError(t, err)
+	r, err := ParseResult(result)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.22.0.5/16", r.IPNets()[0].String())
+	assert.Equal(t, "10.22.0.5", r.IPNets()[0].IP.String())
+	assert.Equal(t, []string{"10.22.0.1"}, r.DNS.Nameservers)
+
+	assert.NoError(t, CheckNetworkList(list, rt, result))
+	assert.NoError(t, DelNetworkList(list, rt, result))
+
+	lines := calls(t, bin)
+	assert.Len(t, lines, 6)
+	// ADD 按顺序执行，第二个插件收到第一个插件的结果
+	assert.True(t, strings.HasPrefix(lines[0], "ADD test /var/run/netns/test eth0 IgnoreUnknown=1 first {"))
+	assert.NotContains(t, lines[0], "prevResult")
+	assert.Contains(t, lines[0], `"mtu":1450`)
+	assert.Contains(t, lines[0], `"name":"mynet"`)
+	assert.True(t, strings.HasPrefix(lines[1], "ADD test /var/run/netns/test eth0 IgnoreUnknown=1 second {"))
+	assert.Contains(t, lines[1], `"prevResult":{"cniVersion":"1.0.0"`)
+	assert.True(t, strings.HasPrefix(lines[2], "CHECK"))
+	assert.Contains(t, lines[2], " first ")
+	// DEL 逆序执行
+	assert.True(t, strings.HasPrefix(lines[4], "DEL"))
+	assert.Contains(t, lines[4], " second ")
+	assert.Contains(t, lines[5], " first ")
+	assert.Contains(t, lines[5], "prevResult")
+}
+
+func TestNetworkListError(t *testing.T) {
+	bin := t.TempDir()
+	writePlugin(t, bin, "fail", failPlugin)
+	rt := &RuntimeConf{ContainerID: "test", IfName: "eth0", BinDirs: []string{bin}}
+
+	list := &ConfList{CNIVersion: "1.0.0", Name: "mynet", Plugins: []map[string]json.RawMessage{{"type": json.RawMessage(`"fail"`)}}}
+	_, err := AddNetworkList(list, rt)
+	assert.EqualError(t, err, "plugin fail ADD: failed to allocate: range is full (code 11)")
+	var pluginErr *Error
+	assert.ErrorAs(t, err, &pluginErr)
+	assert.Equal(t, uint(11), pluginErr.Code)
+
+	list.Plugins[0]["type"] = json.RawMessage(`"missing"`)
+	_, err = AddNetworkList(list, rt)
+	assert.Error(t, err)
+
+	// 0.4.0 之前的版本不支持 CHECK
+	list.CNIVersion = "0.3.1"
+	assert.Error(t, CheckNetworkList(list, rt, json.RawMessage(`{}`)))
+	list.CNIVersion = "1.0.0"
+	list.DisableCheck = true
+	assert.NoError(t, CheckNetworkList(list, rt, json.RawMessage(`{}`)))
+}
+
+func TestParseResult(t *testing.T) {
+	_, err := ParseResult(json.RawMessage(`{"cniVersion":"0.2.0","ip4":{"ip":"10.0.0.2/24"}}`))
+	assert.Error(t, err)
+
+	r, err := ParseResult(json.RawMessage(`{"cniVersion":"0.4.0","ips":[{"address":"fd00::5/64"},{"address":"bad"}]}`))
+	assert.NoError(t, err)
+	assert.Len(t, r.IPNets(), 1)
+	assert.Equal(t, "fd00::5/64", r.IPNets()[0].String())
+
+	assert.Equal(t, -1, compareVersion("0.3.1", "0.4.0"))
+	assert.Equal(t, 0, compareVersion("1.0", "1.0.0"))
+	assert.Equal(t, 1, compareVersion("1.1.0", "1.0.9"))
+}
@@ -0,0 +1,61 @@
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+// Result ADD 的结果中 mini-container 使用的部分
+type Result struct {
+	CNIVersion string       `json:"cniVersion"`
+	Interfaces []*Interface `json:"interfaces"`
+	IPs        []*IPConfig  `json:"ips"`
+	DNS        DNS          `json:"dns"`
+}
+
+// Interface 插件创建的网卡，Sandbox 为空表示宿主机上的网卡
+type Interface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac"`
+	Sandbox string `json:"sandbox"`
+}
+
+// IPConfig 分配的地址，Interface 为 Interfaces 的下标
+type IPConfig struct {
+	Address   string `json:"address"` // x.x.x.x/x
+	Gateway   string `json:"gateway"`
+	Interface *int   `json:"interface"`
+}
+
+type DNS struct {
+	Nameservers []string `json:"nameservers"`
+	Domain      string   `json:"domain"`
+	Search      []string `json:"search"`
+}
+
+// ParseResult 解析 ADD 的结果
+func ParseResult(data json.RawMessage) (*Result, error) {
+	r := &Result{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+	if compareVersion(r.CNIVersion, "0.3.0") < 0 {
+		return nil, fmt.Errorf("result of cniVersion %q is not supported", r.CNIVersion)
+	}
+	return r, nil
+}
+
+// IPNets 分配的地址，无法解析的地址跳过
+func (r *Result) IPNets() []*net.IPNet {
+	ipNets := make([]*net.IPNet, 0, len(r.IPs))
+	for _, ipc := range r.IPs {
+		ip, ipNet, err := net.ParseCIDR(ipc.Address)
+		if err != nil {
+			continue
+		}
+		ipNet.IP = ip
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets
+}
@@ -0,0 +1,199 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"mini-container/common"
+	"mini-container/config"
+	"mini-container/internal/network/dns"
+	"mini-container/internal/network/firewall"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 每个网络一个内置 DNS 进程（mini-container dns-serve <network name>），监听网关地址的 53 端口：
+//  - 容器名、主机名和 --network-alias 由容器的配置应答，其他查询转发给宿主机的上游 DNS
+//  - 第一个使用该网络的容器启动时创建，删除网络或 clear 时停止
+//  - 进程 pid 记录在 ~/.mini-container/networks/<network name>.dns.pid，日志在 .dns.log
+
+// DNSServeCommand 内置 DNS 进程的命令名
+const DNSServeCommand = "dns-serve"
+
+// dnsReadyTimeout 等待 DNS 进程监听成功的时间
+const dnsReadyTimeout = 3 * time.Second
+
+func (n *Network) dnsPidPath() string {
+	return filepath.Join(config.NetworkDir, n.Name+".dns.pid")
+}
+
+func (n *Network) dnsLogPath() string {
+	return filepath.Join(config.NetworkDir, n.Name+".dns.log")
+}
+
+// DNSAddr 内置 DNS 的地址，即网关地址，macvlan/ipvlan 网络没有内置 DNS，返回 nil
+func (n *Network) DNSAddr() net.IP {
+	if !n.IsBridge() {
+		return nil
+	}
+	return n.Gateway().IP
+}
+
+// dnsServerPid 运行中的 DNS 进程，没有时返回 0
+// 宿主机重启后 pid 可能被其他进程复用，需要检查进程的命令行
+func (n *Network) dnsServerPid() int {
+	data, err := os.ReadFile(n.dnsPidPath())
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return 0
+	}
+	args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+	if len(args) != 3 || args[1] != DNSServeCommand || args[2] != n.Name {
+		return 0
+	}
+	return pid
+}
+
+// EnsureDNSServer 启动网络的内置 DNS 进程，已经在运行时或者网络没有内置 DNS 时不做处理
+func (n *Network) EnsureDNSServer() error {
+	if n.DNSAddr() == nil {
+		return nil
+	}
+	if err := os.MkdirAll(config.NetworkDir, 0755); err != nil {
+		return err
+	}
+	return common.WithFileLock(n.dnsPidPath()+".lock", common.DefaultLockTimeout, func() error {
+		if n.dnsServerPid() != 0 {
+			return n.allowDNS()
+		}
+		return common.Err(common.ErrGroup(n.allowDNS(), n.startDNSServer()))
+	})
+}
+
+// startDNSServer 启动 DNS 进程，等待其监听成功
+func (n *Network) startDNSServer() error {
+	logFile, err := os.OpenFile(n.dnsLogPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command("/proc/self/exe", DNSServeCommand, n.Name)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// fd 3，监听成功或失败后写入一行
+	cmd.ExtraFiles = []*os.File{readyW}
+	// 新的会话，不随启动它的容器进程退出
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+
+	result := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(readyR).ReadString('\n')
+		result <- strings.TrimSpace(line)
+	}()
+	select {
+	case line := <-result:
+		if line != "ok" {
+			cmd.Wait()
+			if line == "" {
+				line = "exited"
+			}
+			return fmt.Errorf("dns server of network %s: %s", n.Name, line)
+		}
+	case <-time.After(dnsReadyTimeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("dns server of network %s: ready timeout", n.Name)
+	}
+
+	if err := os.WriteFile(n.dnsPidPath(), []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// StopDNSServer 停止网络的内置 DNS 进程
+func (n *Network) StopDNSServer() error {
+	if pid := n.dnsServerPid(); pid != 0 {
+		if err := common.KillProc(pid); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(n.dnsPidPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// allowDNS 允许容器访问网关的 53 端口，INPUT 默认策略为 DROP 时也能使用内置 DNS
+// 规则属于网桥，删除网桥时一并清理
+func (n *Network) allowDNS() error {
+	fw, err := firewall.Default()
+	if err != nil {
+		return err
+	}
+	return fw.AllowDNS(n.Bridge.Name, n.DNSAddr())
+}
+
+// ServeDNS 运行网络的内置 DNS，由 dns-serve 进程调用，不会返回，除非出错
+// records: 网络中运行的容器的名字和地址
+func ServeDNS(name string, records func() ([]*dns.Record, error)) error {
+	// 启动者通过 fd 3 等待监听结果
+	ready := os.NewFile(3, "ready")
+	notify := func(msg string) {
+		if ready != nil {
+			fmt.Fprintln(ready, msg)
+			ready.Close()
+			ready = nil
+		}
+	}
+
+	n, err := GetNetwork(name)
+	if err != nil {
+		notify(err.Error())
+		return err
+	}
+	rc, err := HostResolvConf()
+	if err != nil {
+		notify(err.Error())
+		return err
+	}
+	logger := log.New(os.Stderr, "dns-serve "+name+" ", log.LstdFlags)
+	server := &dns.Server{
+		Addr:      net.JoinHostPort(n.DNSAddr().String(), "53"),
+		Records:   records,
+		Upstreams: dns.UpstreamAddrs(rc.Nameservers),
+		Logf:      logger.Printf,
+	}
+	if err := server.Listen(); err != nil {
+		notify(err.Error())
+		return err
+	}
+	logger.Printf("listening on %s, upstreams %v", server.Addr, server.Upstreams)
+	notify("ok")
+	return server.Serve()
+}
@@ -0,0 +1,151 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// 只实现内置 DNS 需要的部分：解析查询的第一个问题，构造 A/AAAA/PTR 应答
+// 报文格式见 RFC 1035 4.1
+
+const (
+	TypeA    uint16 = 1
+	TypePTR  uint16 = 12
+	TypeAAAA uint16 = 28
+	ClassIN  uint16 = 1
+
+	RcodeSuccess  = 0
+	RcodeServFail = 2
+
+	headerLen = 12
+	// 应答中的记录 TTL，容器的地址随时可能变化，不宜缓存太久
+	answerTTL = 10
+)
+
+var errUnsupported = errors.New("unsupported message")
+
+// Question 查询的问题
+type Question struct {
+	Name  string // 小写，不带末尾的点
+	Type  uint16
+	Class uint16
+	raw   []byte // 问题在报文中的原始字节，应答时原样复制
+}
+
+// parseQuery 解析只有一个问题的标准查询
+func parseQuery(msg []byte) (*Question, error) {
+	if len(msg) < headerLen {
+		return nil, errors.New("message too short")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	if flags&0x8000 != 0 || (flags>>11)&0xF != 0 || binary.BigEndian.Uint16(msg[4:6]) != 1 {
+		// 应答、非标准查询、多个问题
+		return nil, errUnsupported
+	}
+
+	labels := make([]string, 0, 4)
+	i := headerLen
+	for {
+		if i >= len(msg) {
+			return nil, errors.New("bad name")
+		}
+		n := int(msg[i])
+		i++
+		if n == 0 {
+			break
+		}
+		if n&0xC0 != 0 || i+n > len(msg) {
+			// 问题中不会出现压缩指针
+			return nil, errors.New("bad label")
+		}
+		labels = append(labels, string(msg[i:i+n]))
+		i += n
+	}
+	if i+4 > len(msg) {
+		return nil, errors.New("bad question")
+	}
+	return &Question{
+		Name:  strings.ToLower(strings.Join(labels, ".")),
+		Type:  binary.BigEndian.Uint16(msg[i : i+2]),
+		Class: binary.BigEndian.Uint16(msg[i+2 : i+4]),
+		raw:   msg[headerLen : i+4],
+	}, nil
+}
+
+// answer 一条应答记录的类型和数据
+type answer struct {
+	typ   uint16
+	rdata []byte
+}
+
+// buildResponse 构造应答，answers 为空表示名字存在但没有该类型的记录（NODATA）
+func buildResponse(query []byte, q *Question, rcode int, answers []*answer) []byte {
+	resp := make([]byte, headerLen, headerLen+len(q.raw)+len(answers)*28)
+	copy(resp[0:2], query[0:2]) // ID
+	reqFlags := binary.BigEndian.Uint16(query[2:4])
+	// QR=1 AA=1 RA=1，保留 RD
+	flags := uint16(0x8000|0x0400|0x0080) | reqFlags&0x0100 | uint16(rcode&0xF)
+	binary.BigEndian.PutUint16(resp[2:4], flags)
+	binary.BigEndian.PutUint16(resp[4:6], 1)
+	binary.BigEndian.PutUint16(resp[6:8], uint16(len(answers)))
+
+	resp = append(resp, q.raw...)
+	for _, a := range answers {
+		// 名字指向问题中的名字：0xC000 | 12
+		rr := make([]byte, 12, 12+len(a.rdata))
+		binary.BigEndian.PutUint16(rr[0:2], 0xC000|headerLen)
+		binary.BigEndian.PutUint16(rr[2:4], a.typ)
+		binary.BigEndian.PutUint16(rr[4:6], ClassIN)
+		binary.BigEndian.PutUint32(rr[6:10], answerTTL)
+		binary.BigEndian.PutUint16(rr[10:12], uint16(len(a.rdata)))
+		resp = append(resp, append(rr, a.rdata...)...)
+	}
+	return resp
+}
+
+// encodeName 将域名编码为 label 序列
+func encodeName(name string) []byte {
+	buf := make([]byte, 0, len(name)+2)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+	return append(buf, 0)
+}
+
+// reverseIP 解析 PTR 查询的名字，例如 2.0.172.192.in-addr.arpa -> 192.172.0.2
+func reverseIP(name string) net.IP {
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		parts := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(parts) != 4 {
+			return nil
+		}
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+		return net.ParseIP(strings.Join(parts, ".")).To4()
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(nibbles) != 32 {
+			return nil
+		}
+		sb := strings.Builder{}
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			if len(nibbles[i]) != 1 {
+				return nil
+			}
+			sb.WriteString(nibbles[i])
+			if i%4 == 0 && i != 0 {
+				sb.WriteByte(':')
+			}
+		}
+		return net.ParseIP(sb.String())
+	}
+	return nil
+}
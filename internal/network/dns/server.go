@@ -0,0 +1,204 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record 一个容器在网络中的名字和地址
+type Record struct {
+	Names []string // 容器名、主机名和网络别名
+	IPs   []net.IP
+}
+
+const (
+	// recordsTTL 两次读取容器记录的最短间隔
+	recordsTTL = time.Second
+	// forwardTimeout 等待上游 DNS 应答的超时时间
+	forwardTimeout = 2 * time.Second
+	maxMessageSize = 65535
+)
+
+// Server 网络的内置 DNS：容器的名字由 Records 应答，其他查询转发给上游
+// 只支持 UDP
+type Server struct {
+	Addr      string                    // 监听地址，网关地址:53
+	Records   func() ([]*Record, error) // 网络中运行的容器
+	Upstreams []string                  // 上游 DNS，ip:port
+	Logf      func(string, ...any)      // 为 nil 时不输出日志
+
+	conn      net.PacketConn
+	mu        sync.Mutex
+	records   []*Record
+	updatedAt time.Time
+}
+
+// Listen 监听 Addr，监听成功后再通过 Serve 处理查询
+func (s *Server) Listen() error {
+	conn, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// Serve 处理查询，直到连接关闭
+func (s *Server) Serve() error {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		go func() {
+			if resp := s.handle(query); resp != nil {
+				_, _ = s.conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (s *Server) Close() error {
+	return s.conn.Close()
+}
+
+// handle 处理一个查询，返回 nil 表示不应答
+func (s *Server) handle(query []byte) []byte {
+	q, err := parseQuery(query)
+	if err != nil {
+		if err == errUnsupported {
+			return s.forward(query)
+		}
+		return nil
+	}
+	if q.Class == ClassIN {
+		if answers, ok := s.lookup(q); ok {
+			return buildResponse(query, q, RcodeSuccess, answers)
+		}
+	}
+	return s.forward(query)
+}
+
+// lookup 查找容器的记录，ok 为 false 表示不是容器的名字
+func (s *Server) lookup(q *Question) (answers []*answer, ok bool) {
+	records, err := s.getRecords()
+	if err != nil {
+		s.logf("load records: %v", err)
+		return nil, false
+	}
+
+	if q.Type == TypePTR {
+		ip := reverseIP(q.Name)
+		if ip == nil {
+			return nil, false
+		}
+		for _, r := range records {
+			for _, rip := range r.IPs {
+				if rip.Equal(ip) && len(r.Names) > 0 {
+					return []*answer{{typ: TypePTR, rdata: encodeName(r.Names[0])}}, true
+				}
+			}
+		}
+		return nil, false
+	}
+
+	for _, r := range records {
+		if !hasName(r, q.Name) {
+			continue
+		}
+		ok = true
+		for _, ip := range r.IPs {
+			if v4 := ip.To4(); v4 != nil && q.Type == TypeA {
+				answers = append(answers, &answer{typ: TypeA, rdata: v4})
+			} else if v4 == nil && q.Type == TypeAAAA {
+				answers = append(answers, &answer{typ: TypeAAAA, rdata: ip.To16()})
+			}
+		}
+	}
+	return answers, ok
+}
+
+func hasName(r *Record, name string) bool {
+	for _, n := range r.Names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// getRecords 读取容器记录，recordsTTL 内重复使用上次的结果
+func (s *Server) getRecords() ([]*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.records != nil && time.Since(s.updatedAt) < recordsTTL {
+		return s.records, nil
+	}
+	records, err := s.Records()
+	if err != nil {
+		return nil, err
+	}
+	s.records, s.updatedAt = records, time.Now()
+	return records, nil
+}
+
+// forward 依次尝试上游 DNS，全部失败时应答 SERVFAIL
+func (s *Server) forward(query []byte) []byte {
+	for _, upstream := range s.Upstreams {
+		resp, err := exchange(upstream, query)
+		if err == nil {
+			return resp
+		}
+		s.logf("forward to %s: %v", upstream, err)
+	}
+	q, err := parseQuery(query)
+	if err != nil {
+		return nil
+	}
+	return buildResponse(query, q, RcodeServFail, nil)
+}
+
+func exchange(upstream string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", upstream, forwardTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(forwardTimeout)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// 忽略 ID 不匹配的应答
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+	}
+}
+
+// UpstreamAddrs nameserver 地址加上 53 端口
+func UpstreamAddrs(nameservers []string) []string {
+	addrs := make([]string, 0, len(nameservers))
+	for _, ns := range nameservers {
+		addrs = append(addrs, net.JoinHostPort(ns, "53"))
+	}
+	return addrs
+}
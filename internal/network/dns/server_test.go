@@ -0,0 +1,119 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newQuery 构造一个标准查询
+func newQuery(id uint16, name string, typ uint16) []byte {
+	msg := make([]byte, headerLen)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	binary.BigEndian.PutUint16(msg[2:4], 0x0100) // RD
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+	msg = append(msg, encodeName(name)...)
+	msg = binary.BigEndian.AppendUint16(msg, typ)
+	return binary.BigEndian.AppendUint16(msg, ClassIN)
+}
+
+// answersOf 应答的 rcode 和每条记录的 rdata
+func answersOf(resp []byte) (int, [][]byte) {
+	// 跳过问题：名字、类型和类
+	i := headerLen
+	for resp[i] != 0 {
+		i += int(resp[i]) + 1
+	}
+	i += 5
+	rdatas := make([][]byte, 0)
+	for n := int(binary.BigEndian.Uint16(resp[6:8])); n > 0; n-- {
+		l := int(binary.BigEndian.Uint16(resp[i+10 : i+12]))
+		rdatas = append(rdatas, resp[i+12:i+12+l])
+		i += 12 + l
+	}
+	return int(resp[3] & 0xF), rdatas
+}
+
+func testRecords() ([]*Record, error) {
+	return []*Record{
+		{Names: []string{"web", "www"}, IPs: []net.IP{net.ParseIP("192.172.0.2"), net.ParseIP("fd00:1::2")}},
+		{Names: []string{"db"}, IPs: []net.IP{net.ParseIP("192.172.0.3")}},
+	}, nil
+}
+
+func TestLookup(t *testing.T) {
+	s := &Server{Records: testRecords}
+
+	resp := s.handle(newQuery(1, "WWW", TypeA))
+	assert.Equal(t, []byte{0, 1}, resp[:2])
+	rcode, rdatas := answersOf(resp)
+	assert.Equal(t, RcodeSuccess, rcode)
+	assert.Equal(t, [][]byte{net.ParseIP("192.172.0.2").To4()}, rdatas)
+
+	_, rdatas = answersOf(s.handle(newQuery(2, "web", TypeAAAA)))
+	assert.Equal(t, [][]byte{[]byte(net.ParseIP("fd00:1::2"))}, rdatas)
+
+	// 名字存在但没有 IPv6 地址，不转发
+	rcode, rdatas = answersOf(s.handle(newQuery(3, "db", TypeAAAA)))
+	assert.Equal(t, RcodeSuccess, rcode)
+	assert.Empty(t, rdatas)
+
+	_, rdatas = answersOf(s.handle(newQuery(4, "3.0.172.192.in-addr.arpa", TypePTR)))
+	assert.Equal(t, [][]byte{encodeName("db")}, rdatas)
+
+	// 没有上游时应答 SERVFAIL
+	rcode, _ = answersOf(s.handle(newQuery(5, "example.com", TypeA)))
+	assert.Equal(t, RcodeServFail, rcode)
+}
+
+func TestForward(t *testing.T) {
+	// 上游直接把查询改为应答返回
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			buf[2] |= 0x80
+			upstream.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	s := &Server{Addr: "127.0.0.1:0", Records: testRecords, Upstreams: []string{upstream.LocalAddr().String()}}
+	assert.NoError(t, s.Listen())
+	defer s.Close()
+	go s.Serve()
+
+	conn, err := net.Dial("udp", s.conn.LocalAddr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	buf := make([]byte, 512)
+
+	query := newQuery(7, "example.com", TypeA)
+	_, err = conn.Write(query)
+	assert.NoError(t, err)
+	n, err := conn.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, query[4:], buf[4:n])
+	assert.Equal(t, byte(0x81), buf[2])
+
+	_, err = conn.Write(newQuery(8, "web", TypeA))
+	assert.NoError(t, err)
+	n, err = conn.Read(buf)
+	assert.NoError(t, err)
+	_, rdatas := answersOf(buf[:n])
+	assert.Len(t, rdatas, 1)
+}
+
+func TestReverseIP(t *testing.T) {
+	assert.Equal(t, "192.172.0.2", reverseIP("2.0.172.192.in-addr.arpa").String())
+	assert.Equal(t, "fd00:1::2", reverseIP("2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.1.0.0.0.0.0.d.f.ip6.arpa").String())
+	assert.Nil(t, reverseIP("0.172.192.in-addr.arpa"))
+	assert.Nil(t, reverseIP("example.com"))
+}
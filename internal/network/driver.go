@@ -0,0 +1,133 @@
+package network
+
+import (
+	"fmt"
+	"mini-container/common"
+	"mini-container/internal/network/bridge"
+	"mini-container/internal/network/firewall"
+)
+
+// 网络驱动，创建网络时选择（network create --driver），决定网络和容器网卡在宿主机上的配置：
+//  - bridge：默认驱动，网桥 + veth，容器通过 SNAT 访问外部，支持端口映射、内置 DNS、网络之间的隔离和限速
+//  - macvlan：在宿主机网卡（--parent）上创建 bridge 模式的 macvlan 子接口并移入容器，
+//    容器有自己的 MAC 地址，直接出现在物理网络中
+//  - ipvlan：在 --parent 上创建 ipvlan 子接口，与 parent 共用 MAC 地址，适用于限制 MAC 数量的交换机和云主机；
+//    l2 模式与 macvlan 相同，l3 模式由宿主机路由，物理网络需要添加经过宿主机的路由才能访问容器
+// macvlan 和 ipvlan 的流量不经过宿主机的网桥和防火墙，不支持端口映射、内置 DNS、网络之间的隔离和限速，
+// 宿主机也不能通过 parent 访问这些容器
+
+const (
+	DriverBridge  = "bridge"
+	DriverMacvlan = "macvlan"
+	DriverIPVlan  = "ipvlan"
+)
+
+// Driver 网络驱动
+type Driver interface {
+	// Name 驱动名
+	Name() string
+	// Create 创建网络时在宿主机上的配置
+	Create(n *Network) error
+	// Ensure 检查并修复网络在宿主机上的配置，可以重复调用
+	Ensure(n *Network) error
+	// Release 删除网络在宿主机上的配置，网络的配置保留
+	Release(n *Network) error
+	// CreateLink 在宿主机上创建容器的网卡，name 为 <pid>-<rand>
+	// return: 宿主机端 veth 的名称（没有时为空），需要移入容器的网卡名称
+	CreateLink(n *Network, name string) (string, string, error)
+}
+
+// GetDriver 按名字返回驱动，name 为空时为 bridge
+func GetDriver(name string) (Driver, error) {
+	switch name {
+	case "", DriverBridge:
+		return bridgeDriver{}, nil
+	case DriverMacvlan:
+		return macvlanDriver{}, nil
+	case DriverIPVlan:
+		return ipvlanDriver{}, nil
+	default:
+		return nil, fmt.Errorf("invalid driver %q, must be %s, %s or %s", name, DriverBridge, DriverMacvlan, DriverIPVlan)
+	}
+}
+
+type bridgeDriver struct{}
+
+func (bridgeDriver) Name() string {
+	return DriverBridge
+}
+
+// Create 创建网桥，添加网桥的防火墙规则
+func (bridgeDriver) Create(n *Network) error {
+	if err := bridge.CreateBridge(n.Bridge); err != nil {
+		return err
+	}
+	return n.ensureFirewall()
+}
+
+// Ensure 网桥（宿主机重启或 clear 之后需要重新创建）、地址、SNAT 和 FORWARD 规则、ip_forward、网络之间的隔离规则
+func (bridgeDriver) Ensure(n *Network) error {
+	err := common.Err(common.ErrGroup(
+		bridge.EnsureBridge(n.Bridge),
+		n.ensureFirewall(),
+		bridge.EnableIPForward(n.Gateway6() != nil),
+	))
+	if err != nil {
+		return err
+	}
+	return SyncIsolation()
+}
+
+// Release 删除网桥和内置 DNS 进程，以及 mini-container 为该网桥添加的所有防火墙规则
+func (bridgeDriver) Release(n *Network) error {
+	fw, err := firewall.Default()
+	if err != nil {
+		return err
+	}
+	return common.ErrTag("release bridge "+n.Bridge.Name,
+		n.StopDNSServer(),
+		fw.ReleaseBridge(n.Bridge.Name),
+		bridge.DeleteBridge(n.Bridge),
+	)
+}
+
+func (bridgeDriver) CreateLink(n *Network, name string) (string, string, error) {
+	return bridge.CreateVeth(n.Bridge.Name, name)
+}
+
+type macvlanDriver struct{}
+
+func (macvlanDriver) Name() string {
+	return DriverMacvlan
+}
+
+func (macvlanDriver) Create(n *Network) error {
+	return bridge.EnsureParent(n.Parent)
+}
+
+func (macvlanDriver) Ensure(n *Network) error {
+	return bridge.EnsureParent(n.Parent)
+}
+
+// Release 子接口随容器的网络命名空间一起销毁，宿主机上没有需要删除的配置
+func (macvlanDriver) Release(*Network) error {
+	return nil
+}
+
+func (macvlanDriver) CreateLink(n *Network, name string) (string, string, error) {
+	linkName := "mv-" + name
+	return "", linkName, bridge.CreateMacvlan(n.Parent, linkName, n.Bridge.MTU)
+}
+
+type ipvlanDriver struct {
+	macvlanDriver
+}
+
+func (ipvlanDriver) Name() string {
+	return DriverIPVlan
+}
+
+func (ipvlanDriver) CreateLink(n *Network, name string) (string, string, error) {
+	linkName := "ipv-" + name
+	return "", linkName, bridge.CreateIPVlan(n.Parent, linkName, n.IPVlanMode, n.Bridge.MTU)
+}
@@ -0,0 +1,181 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	HostResolvConfPath = "/etc/resolv.conf"
+	// systemd-resolved 管理的主机上 /etc/resolv.conf 只有 127.0.0.53，真正的上游 DNS 在这里
+	SystemdResolvConfPath = "/run/systemd/resolve/resolv.conf"
+)
+
+// RFC 1123 主机名：由点分隔的 label 组成，每个 label 不超过63个字符
+var hostnameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+// ValidHostname 判断是否为合法的主机名/域名，内核限制 UTS 中的名字不超过64个字符
+func ValidHostname(name string) bool {
+	return len(name) <= 64 && hostnameRegexp.MatchString(name)
+}
+
+// HostAliases 容器在 /etc/hosts 中的名字：有域名时 FQDN 在前，其次为主机名
+func HostAliases(hostname, domainname string) []string {
+	if domainname == "" {
+		return []string{hostname}
+	}
+	return []string{hostname + "." + domainname, hostname}
+}
+
+// 宿主机上没有可用的 DNS 时使用
+var DefaultNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+// ResolvConf resolv.conf 中容器关心的部分
+type ResolvConf struct {
+	Nameservers []string
+	Search      []string
+	Options     []string
+}
+
+// ParseResolvConf 解析 resolv.conf 的内容
+func ParseResolvConf(content string) *ResolvConf {
+	rc := &ResolvConf{
+		Nameservers: make([]string, 0),
+		Search:      make([]string, 0),
+		Options:     make([]string, 0),
+	}
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			rc.Nameservers = append(rc.Nameservers, fields[1])
+		case "search", "domain":
+			// 后出现的 search/domain 覆盖前面的
+			rc.Search = fields[1:]
+		case "options":
+			rc.Options = append(rc.Options, fields[1:]...)
+		}
+	}
+	return rc
+}
+
+// withoutLoopback 去掉回环地址的 nameserver，它们在容器的 network namespace 中不可达
+func (rc *ResolvConf) withoutLoopback() *ResolvConf {
+	nameservers := make([]string, 0, len(rc.Nameservers))
+	for _, ns := range rc.Nameservers {
+		if ip := net.ParseIP(ns); ip != nil && !ip.IsLoopback() {
+			nameservers = append(nameservers, ns)
+		}
+	}
+	return &ResolvConf{Nameservers: nameservers, Search: rc.Search, Options: rc.Options}
+}
+
+func (rc *ResolvConf) String() string {
+	sb := strings.Builder{}
+	sb.WriteString("# Generated by mini-container\n")
+	for _, ns := range rc.Nameservers {
+		sb.WriteString("nameserver " + ns + "\n")
+	}
+	if len(rc.Search) > 0 {
+		sb.WriteString("search " + strings.Join(rc.Search, " ") + "\n")
+	}
+	if len(rc.Options) > 0 {
+		sb.WriteString("options " + strings.Join(rc.Options, " ") + "\n")
+	}
+	return sb.String()
+}
+
+// HostResolvConf 读取宿主机的 DNS 配置，跳过回环地址的 nameserver
+// 全部是回环地址时（例如 systemd-resolved），尝试读取 systemd-resolved 的上游配置，
+// 仍然没有可用的 nameserver 时使用 DefaultNameservers
+func HostResolvConf() (*ResolvConf, error) {
+	data, err := os.ReadFile(HostResolvConfPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	rc := ParseResolvConf(string(data)).withoutLoopback()
+
+	if len(rc.Nameservers) == 0 {
+		if data, err := os.ReadFile(SystemdResolvConfPath); err == nil {
+			rc.Nameservers = ParseResolvConf(string(data)).withoutLoopback().Nameservers
+		}
+	}
+	if len(rc.Nameservers) == 0 {
+		rc.Nameservers = DefaultNameservers
+	}
+	return rc, nil
+}
+
+// BuildResolvConf 生成容器的 resolv.conf，指定了 dns 时替换宿主机的 nameserver
+// hostNetwork: 容器使用宿主机网络，回环地址的 nameserver 可达，直接使用宿主机的配置
+func BuildResolvConf(dns []string, hostNetwork bool) (string, error) {
+	var rc *ResolvConf
+	if hostNetwork {
+		data, err := os.ReadFile(HostResolvConfPath)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		rc = ParseResolvConf(string(data))
+		if len(rc.Nameservers) == 0 {
+			rc.Nameservers = DefaultNameservers
+		}
+	} else {
+		var err error
+		if rc, err = HostResolvConf(); err != nil {
+			return "", err
+		}
+	}
+	if len(dns) > 0 {
+		rc.Nameservers = dns
+	}
+	return rc.String(), nil
+}
+
+// ParseExtraHost 解析 --add-host 参数，格式：hostname:ip
+func ParseExtraHost(spec string) (string, net.IP, error) {
+	// IPv6 地址中含有 ':'，以第一个 ':' 分隔
+	host, ipStr, ok := strings.Cut(spec, ":")
+	if !ok || host == "" {
+		return "", nil, fmt.Errorf("invalid extra host %q, format: hostname:ip", spec)
+	}
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return "", nil, fmt.Errorf("invalid extra host %q, invalid ip %q", spec, ipStr)
+	}
+	return host, ip, nil
+}
+
+// BuildHosts 生成容器的 /etc/hosts
+// ips: 容器的地址，IPv4 和可选的 IPv6，为空时不写入容器自己的记录
+// hostnames: 容器自己的名字，见 HostAliases
+// extraHosts: --add-host 指定的额外记录，格式 hostname:ip
+func BuildHosts(ips []net.IP, hostnames []string, extraHosts []string) (string, error) {
+	sb := strings.Builder{}
+	sb.WriteString("# Generated by mini-container\n")
+	sb.WriteString("127.0.0.1\tlocalhost\n")
+	sb.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+	sb.WriteString("fe00::0\tip6-localnet\n")
+	sb.WriteString("ff00::0\tip6-mcastprefix\n")
+	sb.WriteString("ff02::1\tip6-allnodes\n")
+	sb.WriteString("ff02::2\tip6-allrouters\n")
+
+	if len(hostnames) > 0 {
+		for _, ip := range ips {
+			sb.WriteString(ip.String() + "\t" + strings.Join(hostnames, " ") + "\n")
+		}
+	}
+	for _, spec := range extraHosts {
+		host, hostIP, err := ParseExtraHost(spec)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(hostIP.String() + "\t" + host + "\n")
+	}
+	return sb.String(), nil
+}
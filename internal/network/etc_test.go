@@ -0,0 +1,61 @@
+package network
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestParseResolvConf(t *testing.T) {
+	rc := ParseResolvConf(`# comment
+nameserver 127.0.0.53
+nameserver 10.0.0.2
+nameserver ::1
+search example.com
+options edns0 trust-ad
+`)
+	assert.Equal(t, []string{"127.0.0.53", "10.0.0.2", "::1"}, rc.Nameservers)
+	assert.Equal(t, []string{"10.0.0.2"}, rc.withoutLoopback().Nameservers)
+	assert.Equal(t, "# Generated by mini-container\nnameserver 10.0.0.2\nsearch example.com\noptions edns0 trust-ad\n",
+		rc.withoutLoopback().String())
+}
+
+func TestParseExtraHost(t *testing.T) {
+	host, ip, err := ParseExtraHost("db:192.172.0.10")
+	assert.NoError(t, err)
+	assert.Equal(t, "db", host)
+	assert.Equal(t, "192.172.0.10", ip.String())
+
+	host, ip, err = ParseExtraHost("db6:fd00::10")
+	assert.NoError(t, err)
+	assert.Equal(t, "db6", host)
+	assert.Equal(t, "fd00::10", ip.String())
+
+	_, _, err = ParseExtraHost("db")
+	assert.Error(t, err)
+	_, _, err = ParseExtraHost("db:not-ip")
+	assert.Error(t, err)
+}
+
+func TestBuildHosts(t *testing.T) {
+	hosts, err := BuildHosts([]net.IP{net.ParseIP("192.172.0.2"), net.ParseIP("fd00:1::2")}, []string{"test1"}, []string{"db:192.172.0.10"})
+	assert.NoError(t, err)
+	assert.Contains(t, hosts, "127.0.0.1\tlocalhost\n")
+	assert.Contains(t, hosts, "192.172.0.2\ttest1\n")
+	assert.Contains(t, hosts, "fd00:1::2\ttest1\n")
+	assert.Contains(t, hosts, "192.172.0.10\tdb\n")
+
+	hosts, err = BuildHosts(nil, []string{"test1"}, nil)
+	assert.NoError(t, err)
+	assert.NotContains(t, hosts, "test1")
+}
+
+func TestValidHostname(t *testing.T) {
+	assert.True(t, ValidHostname("test1"))
+	assert.True(t, ValidHostname("web-1.example.com"))
+	assert.False(t, ValidHostname("-web"))
+	assert.False(t, ValidHostname("web_1"))
+	assert.False(t, ValidHostname(""))
+	assert.Equal(t, []string{"web.example.com", "web"}, HostAliases("web", "example.com"))
+	assert.Equal(t, []string{"web"}, HostAliases("web", ""))
+}
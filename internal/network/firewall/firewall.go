@@ -0,0 +1,138 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// 防火墙规则的抽象，mini-container 需要的规则都通过 Firewall 添加和删除：
+//  - 网桥：FORWARD 放行和 SNAT
+//  - 端口映射：DNAT、hairpin 和本机访问的 MASQUERADE、FORWARD 放行
+//  - 内置 DNS：INPUT 放行
+//  - 网络之间的隔离
+// 有两种实现：
+//  - iptables：调用 iptables/ip6tables 命令，规则通过 mini-container 注释识别
+//  - nftables：调用 nft 命令，所有规则位于 mini-container 自己的 inet mini-container 表中
+// 每条规则都属于一个网桥（owner）或者是全局规则（owner 为空），删除网桥时删除它的所有规则
+
+const (
+	BackendIPTables = "iptables"
+	BackendNFTables = "nftables"
+
+	// EnvBackend 指定防火墙的实现，为空时自动选择
+	EnvBackend = "MINI_CONTAINER_FIREWALL"
+)
+
+// Bridge 网桥需要的规则
+type Bridge struct {
+	Name     string
+	Subnets  []*net.IPNet // IPv4 子网，以及启用 IPv6 时的 IPv6 子网
+	External bool         // 是否允许访问网桥之外的网络，为 true 时设置 SNAT
+}
+
+// PortMapping 宿主机端口到容器端口的映射
+type PortMapping struct {
+	HostIP        string // 为空表示宿主机的所有地址
+	HostPort      int
+	ContainerPort int
+	Protocol      string // tcp/udp
+}
+
+func (pm *PortMapping) String() string {
+	hostIP := pm.HostIP
+	if hostIP == "" {
+		hostIP = "0.0.0.0"
+	}
+	return fmt.Sprintf("%d/%s -> %s", pm.ContainerPort, pm.Protocol, net.JoinHostPort(hostIP, strconv.Itoa(pm.HostPort)))
+}
+
+// Isolation 网络之间的隔离规则
+type Isolation struct {
+	Bridges  []string // 所有网络的网桥
+	Internal []string // 内部网络的网桥，和其他接口之间的流量都丢弃
+	Allows   []*Allow
+	IPv6     bool // 是否有网络启用了 IPv6
+}
+
+// Allow 允许 From 网桥中的容器访问 To 网桥中的容器
+type Allow struct {
+	From     string
+	To       string
+	Port     int    // 为0时放行所有端口
+	Protocol string // tcp/udp，Port 为0时为空
+}
+
+// Rule mini-container 添加的一条规则，用于列出和清理
+type Rule struct {
+	Family string // ipv4/ipv6/inet
+	Table  string
+	Chain  string
+	Owner  string // 所属的网桥，为空表示全局规则
+	Spec   string // 规则的内容
+}
+
+// Firewall 防火墙规则的操作，添加规则都是幂等的，删除不存在的规则时忽略
+type Firewall interface {
+	// Name 实现的名字，iptables 或 nftables
+	Name() string
+	// EnsureBridge 添加网桥的 FORWARD 和 SNAT 规则
+	EnsureBridge(b *Bridge) error
+	// ReleaseBridge 删除网桥的所有规则，包括端口映射和内置 DNS 的规则
+	ReleaseBridge(name string) error
+	// AddPortMappings 添加容器的端口映射规则
+	AddPortMappings(bridgeName string, containerIP net.IP, ports []*PortMapping) error
+	// RemovePortMappings 删除容器的端口映射规则，删除失败时继续删除其余规则
+	RemovePortMappings(bridgeName string, containerIP net.IP, ports []*PortMapping) error
+	// AllowDNS 放行容器对网关 53 端口的访问
+	AllowDNS(bridgeName string, gateway net.IP) error
+	// SetIsolation 原子地替换网络之间的隔离规则
+	SetIsolation(iso *Isolation) error
+	// List 列出 mini-container 添加的所有规则
+	List() ([]*Rule, error)
+	// ReleaseAll 删除 mini-container 添加的所有规则和链
+	ReleaseAll() error
+}
+
+var (
+	defaultOnce sync.Once
+	defaultFW   Firewall
+	defaultErr  error
+)
+
+// Default 当前宿主机使用的防火墙实现，只选择一次
+func Default() (Firewall, error) {
+	defaultOnce.Do(func() {
+		defaultFW, defaultErr = New(os.Getenv(EnvBackend))
+	})
+	return defaultFW, defaultErr
+}
+
+// New 按名字创建防火墙实现，name 为空时自动选择：
+// 有 iptables 命令时使用 iptables（包括 iptables-nft，它同样会被 nftables 正确处理），否则使用 nftables
+func New(name string) (Firewall, error) {
+	switch name {
+	case BackendIPTables:
+		return newIPTables(), nil
+	case BackendNFTables:
+		return newNFTables(), nil
+	case "":
+		if commandExists("iptables") {
+			return newIPTables(), nil
+		}
+		if commandExists("nft") {
+			return newNFTables(), nil
+		}
+		return nil, fmt.Errorf("neither iptables nor nft is found in PATH")
+	default:
+		return nil, fmt.Errorf("invalid %s %q, must be %s or %s", EnvBackend, name, BackendIPTables, BackendNFTables)
+	}
+}
+
+func commandExists(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
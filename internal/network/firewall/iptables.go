@@ -0,0 +1,290 @@
+package firewall
+
+import (
+	"mini-container/common"
+	"mini-container/internal/network/iptables"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// iptables 实现：
+//  - 网桥：filter 表 FORWARD 开头放行网桥的流量，nat 表 POSTROUTING 对子网做 MASQUERADE
+//  - 端口映射：nat 表的 PREROUTING 和 OUTPUT 中，目的地址为本机的流量跳转到 MINI-CONTAINER 链，
+//    其中每个映射一条 DNAT 规则，分别处理外部访问和宿主机本机访问
+//  - 宿主机通过 127.0.0.1 访问时，对来源为本机地址、发往网桥的流量做 MASQUERADE，
+//    否则容器的回包会发往容器自己的回环地址
+//  - 容器通过宿主机地址访问自己映射出去的端口（hairpin）时，对该流量做 MASQUERADE，否则容器会直接回包给自己
+//  - 隔离：filter 表中 mini-container 自己的两条链，见 isolationRules
+// 规则都带有 mini-container 注释，隔离链和端口映射链中的规则除外，删除链时一并删除
+
+const (
+	PortMappingChain = "MINI-CONTAINER"
+	IsolationChain1  = "MINI-CONTAINER-ISOLATION-1"
+	IsolationChain2  = "MINI-CONTAINER-ISOLATION-2"
+)
+
+type ipTables struct{}
+
+func newIPTables() *ipTables {
+	return &ipTables{}
+}
+
+func (*ipTables) Name() string {
+	return BackendIPTables
+}
+
+// ipTablesOf 地址对应的 iptables 或 ip6tables
+func ipTablesOf(ip net.IP) *iptables.IPTables {
+	if ip.To4() == nil {
+		return iptables.IPv6
+	}
+	return iptables.IPv4
+}
+
+// available 宿主机上存在的 iptables 和 ip6tables，清理规则时使用
+func available() []*iptables.IPTables {
+	ipts := []*iptables.IPTables{iptables.IPv4}
+	if iptables.IPv6.Available() {
+		ipts = append(ipts, iptables.IPv6)
+	}
+	return ipts
+}
+
+func (*ipTables) EnsureBridge(b *Bridge) error {
+	for _, subnet := range b.Subnets {
+		ipt := ipTablesOf(subnet.IP)
+		for _, rule := range forwardRules(b.Name, b.External) {
+			if err := ipt.Insert(iptables.TableFilter, "FORWARD", rule...); err != nil {
+				return common.ErrTag("set forward", err)
+			}
+		}
+		if !b.External {
+			continue
+		}
+		if err := ipt.Append(iptables.TableNat, "POSTROUTING", snatRule(b.Name, subnet)...); err != nil {
+			return common.ErrTag("set snat", err)
+		}
+	}
+	return nil
+}
+
+// snatRule 对子网发往网桥之外的流量做 MASQUERADE，容器通过宿主机的地址访问外网
+func snatRule(bridgeName string, subnet *net.IPNet) []string {
+	rule := []string{"-s", subnet.String(), "!", "-o", bridgeName}
+	rule = append(rule, iptables.Comment(bridgeName)...)
+	return append(rule, "-j", "MASQUERADE")
+}
+
+// forwardRules filter 表 FORWARD 链中放行网桥流量的规则
+// FORWARD 默认策略为 DROP 时（例如安装了 docker 的主机），没有这些规则容器无法访问外网
+// external: 是否允许容器访问网桥之外的网络，为 false 时只放行同一网桥内的流量
+func forwardRules(bridgeName string, external bool) [][]string {
+	comment := iptables.Comment(bridgeName)
+	out := []string{"-i", bridgeName}
+	if !external {
+		out = append(out, "-o", bridgeName)
+	}
+	out = append(append(out, comment...), "-j", "ACCEPT")
+	in := []string{"-o", bridgeName, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED"}
+	in = append(append(in, comment...), "-j", "ACCEPT")
+	return [][]string{out, in}
+}
+
+func (*ipTables) ReleaseBridge(name string) error {
+	errs := make([]error, 0, 4)
+	for _, ipt := range available() {
+		errs = append(errs,
+			ipt.DeleteByComment(iptables.TableNat, name),
+			ipt.DeleteByComment(iptables.TableFilter, name),
+		)
+	}
+	return common.Err(common.ErrGroup(errs...))
+}
+
+// initPortMappingChains 创建端口映射使用的链，以及本机访问需要的规则，可以重复调用
+func initPortMappingChains(bridgeName string) error {
+	ipt := iptables.IPv4
+	jump := append([]string{"-m", "addrtype", "--dst-type", "LOCAL"}, iptables.Comment("")...)
+	jump = append(jump, "-j", PortMappingChain)
+	local := append([]string{"-o", bridgeName, "-m", "addrtype", "--src-type", "LOCAL"}, iptables.Comment(bridgeName)...)
+	local = append(local, "-j", "MASQUERADE")
+	return common.Err(common.ErrGroup(
+		ipt.EnsureChain(iptables.TableNat, PortMappingChain),
+		ipt.Append(iptables.TableNat, "PREROUTING", jump...),
+		ipt.Append(iptables.TableNat, "OUTPUT", jump...),
+		ipt.Append(iptables.TableNat, "POSTROUTING", local...),
+	))
+}
+
+// portMappingRules 一个端口映射对应的全部规则：table, chain, rule
+// 规则带有网桥的注释，删除网络时可以一并清理
+func portMappingRules(bridgeName string, containerIP net.IP, pm *PortMapping) [][]string {
+	ctrIP := containerIP.String()
+	ctrPort := strconv.Itoa(pm.ContainerPort)
+	comment := iptables.Comment(bridgeName)
+
+	dnat := []string{iptables.TableNat, PortMappingChain, "-p", pm.Protocol}
+	if pm.HostIP != "" {
+		dnat = append(dnat, "-d", pm.HostIP)
+	}
+	dnat = append(dnat, "--dport", strconv.Itoa(pm.HostPort))
+	dnat = append(dnat, comment...)
+	dnat = append(dnat, "-j", "DNAT", "--to-destination", net.JoinHostPort(ctrIP, ctrPort))
+
+	hairpin := []string{iptables.TableNat, "POSTROUTING", "-p", pm.Protocol, "-s", ctrIP, "-d", ctrIP, "--dport", ctrPort}
+	hairpin = append(hairpin, comment...)
+	hairpin = append(hairpin, "-j", "MASQUERADE")
+
+	forward := []string{iptables.TableFilter, "FORWARD", "-p", pm.Protocol, "-d", ctrIP, "-o", bridgeName, "--dport", ctrPort}
+	forward = append(forward, comment...)
+	forward = append(forward, "-j", "ACCEPT")
+
+	return [][]string{dnat, hairpin, forward}
+}
+
+func (*ipTables) AddPortMappings(bridgeName string, containerIP net.IP, ports []*PortMapping) error {
+	if err := initPortMappingChains(bridgeName); err != nil {
+		return common.ErrTag("init port mapping", err)
+	}
+	for _, pm := range ports {
+		for _, r := range portMappingRules(bridgeName, containerIP, pm) {
+			var err error
+			if r[1] == "FORWARD" {
+				// 放在最前面，FORWARD 默认策略为 DROP 时也能生效
+				err = iptables.IPv4.Insert(r[0], r[1], r[2:]...)
+			} else {
+				err = iptables.IPv4.Append(r[0], r[1], r[2:]...)
+			}
+			if err != nil {
+				return common.ErrTag("port mapping "+pm.String(), err)
+			}
+		}
+	}
+	return nil
+}
+
+func (*ipTables) RemovePortMappings(bridgeName string, containerIP net.IP, ports []*PortMapping) error {
+	var firstErr error
+	for _, pm := range ports {
+		for _, r := range portMappingRules(bridgeName, containerIP, pm) {
+			if err := iptables.IPv4.Delete(r[0], r[1], r[2:]...); err != nil && firstErr == nil {
+				firstErr = common.ErrTag("port mapping "+pm.String(), err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// AllowDNS INPUT 默认策略为 DROP 时也能使用内置 DNS，规则带有网桥的注释，删除网桥时一并清理
+func (*ipTables) AllowDNS(bridgeName string, gateway net.IP) error {
+	rule := []string{"-i", bridgeName, "-p", "udp", "-d", gateway.String(), "--dport", "53"}
+	rule = append(rule, iptables.Comment(bridgeName)...)
+	rule = append(rule, "-j", "ACCEPT")
+	return ipTablesOf(gateway).Insert(iptables.TableFilter, "INPUT", rule...)
+}
+
+// SetIsolation 通过 iptables-restore 整体替换两条隔离链，有网络启用 IPv6 时同时提交到 ip6tables
+func (*ipTables) SetIsolation(iso *Isolation) error {
+	ipts := []*iptables.IPTables{iptables.IPv4}
+	if iso.IPv6 {
+		ipts = append(ipts, iptables.IPv6)
+	}
+	lines := isolationRules(iso)
+	jump := append(iptables.Comment(""), "-j", IsolationChain1)
+	for _, ipt := range ipts {
+		// 跳转规则需要在 FORWARD 的最前面，新网桥的 FORWARD 规则插入在它前面，需要重新插入
+		jumpLines := []string{}
+		if ipt.Exists(iptables.TableFilter, "FORWARD", jump...) {
+			jumpLines = append(jumpLines, "-D FORWARD "+strings.Join(jump, " "))
+		}
+		jumpLines = append(jumpLines, "-I FORWARD 1 "+strings.Join(jump, " "))
+		if err := ipt.Restore(iptables.TableFilter, append(lines, jumpLines...)); err != nil {
+			return common.ErrTag("apply isolation rules", err)
+		}
+	}
+	return nil
+}
+
+// isolationRules 两条隔离链的内容，iptables-restore 格式：
+//   - FORWARD 的第一条规则跳转到 MINI-CONTAINER-ISOLATION-1
+//   - ISOLATION-1：已建立的连接放行；network allow 添加的放行规则直接 ACCEPT，内部网络的 FORWARD 规则只放行网桥内的流量，
+//     返回 FORWARD 时会落到默认策略，策略为 DROP 时被丢弃；内部网络与其他接口之间的流量丢弃；
+//     从网桥转发到其他接口的流量进入 ISOLATION-2
+//   - ISOLATION-2：发往任意网桥的流量丢弃，其余（发往宿主机的外部网卡）返回 FORWARD 继续处理
+func isolationRules(iso *Isolation) []string {
+	rule := func(chain string, args ...string) string {
+		return "-A " + chain + " " + strings.Join(args, " ")
+	}
+
+	lines := []string{
+		":" + IsolationChain1 + " - [0:0]",
+		":" + IsolationChain2 + " - [0:0]",
+		rule(IsolationChain1, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN"),
+	}
+	for _, a := range iso.Allows {
+		args := []string{"-i", a.From, "-o", a.To}
+		if a.Port != 0 {
+			args = append(args, "-p", a.Protocol, "--dport", strconv.Itoa(a.Port))
+		}
+		lines = append(lines, rule(IsolationChain1, append(args, "-j", "ACCEPT")...))
+	}
+	for _, br := range iso.Internal {
+		lines = append(lines,
+			rule(IsolationChain1, "-i", br, "!", "-o", br, "-j", "DROP"),
+			rule(IsolationChain1, "!", "-i", br, "-o", br, "-j", "DROP"),
+		)
+	}
+	for _, br := range iso.Bridges {
+		lines = append(lines, rule(IsolationChain1, "-i", br, "!", "-o", br, "-j", IsolationChain2))
+	}
+	for _, br := range iso.Bridges {
+		lines = append(lines, rule(IsolationChain2, "-o", br, "-j", "DROP"))
+	}
+	return lines
+}
+
+// List 列出带有 mini-container 注释的规则
+func (*ipTables) List() ([]*Rule, error) {
+	rules := make([]*Rule, 0)
+	for _, ipt := range available() {
+		family := "ipv4"
+		if ipt == iptables.IPv6 {
+			family = "ipv6"
+		}
+		for _, table := range []string{iptables.TableNat, iptables.TableFilter} {
+			lines, err := ipt.List(table)
+			if err != nil {
+				return nil, err
+			}
+			for _, line := range lines {
+				fields := strings.Fields(line)
+				if len(fields) < 2 || fields[0] != "-A" {
+					continue
+				}
+				owner, ok := iptables.CommentOwner(fields)
+				if !ok {
+					continue
+				}
+				rules = append(rules, &Rule{Family: family, Table: table, Chain: fields[1], Owner: owner, Spec: line})
+			}
+		}
+	}
+	return rules, nil
+}
+
+// ReleaseAll 删除带有 mini-container 注释的所有规则，以及端口映射和隔离链
+// 跳转到链的规则带有全局注释，需要先删除规则再删除链
+func (*ipTables) ReleaseAll() error {
+	errs := make([]error, 0, 10)
+	for _, ipt := range available() {
+		errs = append(errs,
+			ipt.DeleteByComment(iptables.TableNat, ""),
+			ipt.DeleteByComment(iptables.TableFilter, ""),
+			ipt.DeleteChain(iptables.TableFilter, IsolationChain1),
+			ipt.DeleteChain(iptables.TableFilter, IsolationChain2),
+		)
+	}
+	errs = append(errs, iptables.IPv4.DeleteChain(iptables.TableNat, PortMappingChain))
+	return common.Err(common.ErrGroup(errs...))
+}
@@ -0,0 +1,69 @@
+package firewall
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestForwardRules(t *testing.T) {
+	comment := []string{"-m", "comment", "--comment", "mini-container:mc-test"}
+
+	rules := forwardRules("mc-test", true)
+	assert.Equal(t, append(append([]string{"-i", "mc-test"}, comment...), "-j", "ACCEPT"), rules[0])
+	assert.Equal(t, append(append([]string{"-o", "mc-test", "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED"},
+		comment...), "-j", "ACCEPT"), rules[1])
+
+	rules = forwardRules("mc-test", false)
+	assert.Equal(t, append(append([]string{"-i", "mc-test", "-o", "mc-test"}, comment...), "-j", "ACCEPT"), rules[0])
+}
+
+func TestPortMappingRules(t *testing.T) {
+	pm := &PortMapping{HostIP: "127.0.0.1", HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}
+	rules := portMappingRules("mini-br0", net.ParseIP("192.172.0.2"), pm)
+	assert.Equal(t, []string{"nat", PortMappingChain, "-p", "tcp", "-d", "127.0.0.1", "--dport", "8080",
+		"-m", "comment", "--comment", "mini-container:mini-br0",
+		"-j", "DNAT", "--to-destination", "192.172.0.2:80"}, rules[0])
+	assert.Equal(t, "POSTROUTING", rules[1][1])
+	assert.Equal(t, "FORWARD", rules[2][1])
+	assert.Equal(t, "80/tcp -> 127.0.0.1:8080", pm.String())
+}
+
+func TestIsolationRules(t *testing.T) {
+	iso := &Isolation{
+		Bridges:  []string{"mini-ctr0", "mc-web", "mc-db"},
+		Internal: []string{"mc-db"},
+		Allows:   []*Allow{{From: "mc-web", To: "mc-db", Port: 5432, Protocol: "tcp"}},
+	}
+	assert.Equal(t, []string{
+		":MINI-CONTAINER-ISOLATION-1 - [0:0]",
+		":MINI-CONTAINER-ISOLATION-2 - [0:0]",
+		"-A MINI-CONTAINER-ISOLATION-1 -m conntrack --ctstate RELATED,ESTABLISHED -j RETURN",
+		"-A MINI-CONTAINER-ISOLATION-1 -i mc-web -o mc-db -p tcp --dport 5432 -j ACCEPT",
+		"-A MINI-CONTAINER-ISOLATION-1 -i mc-db ! -o mc-db -j DROP",
+		"-A MINI-CONTAINER-ISOLATION-1 ! -i mc-db -o mc-db -j DROP",
+		"-A MINI-CONTAINER-ISOLATION-1 -i mini-ctr0 ! -o mini-ctr0 -j MINI-CONTAINER-ISOLATION-2",
+		"-A MINI-CONTAINER-ISOLATION-1 -i mc-web ! -o mc-web -j MINI-CONTAINER-ISOLATION-2",
+		"-A MINI-CONTAINER-ISOLATION-1 -i mc-db ! -o mc-db -j MINI-CONTAINER-ISOLATION-2",
+		"-A MINI-CONTAINER-ISOLATION-2 -o mini-ctr0 -j DROP",
+		"-A MINI-CONTAINER-ISOLATION-2 -o mc-web -j DROP",
+		"-A MINI-CONTAINER-ISOLATION-2 -o mc-db -j DROP",
+	}, isolationRules(iso))
+
+	// 内部网络的 FORWARD 规则只放行网桥内的流量，放行到其他网络的流量需要在隔离链中 ACCEPT，不能返回 FORWARD 的默认策略
+	iso.Allows = []*Allow{{From: "mc-db", To: "mc-web"}}
+	lines := isolationRules(iso)
+	assert.Equal(t, "-A MINI-CONTAINER-ISOLATION-1 -i mc-db -o mc-web -j ACCEPT", lines[3])
+	assert.Equal(t, "-A MINI-CONTAINER-ISOLATION-1 -i mc-db ! -o mc-db -j DROP", lines[4])
+}
+
+func TestNew(t *testing.T) {
+	fw, err := New(BackendNFTables)
+	assert.NoError(t, err)
+	assert.Equal(t, BackendNFTables, fw.Name())
+	fw, err = New(BackendIPTables)
+	assert.NoError(t, err)
+	assert.Equal(t, BackendIPTables, fw.Name())
+	_, err = New("pf")
+	assert.Error(t, err)
+}
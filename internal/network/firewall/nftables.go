@@ -0,0 +1,393 @@
+package firewall
+
+import (
+	"encoding/json"
+	"fmt"
+	"mini-container/common"
+	"mini-container/internal/network/iptables"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// nftables 实现，所有规则位于 mini-container 自己的 inet mini-container 表中，同时处理 IPv4 和 IPv6：
+//  - prerouting/output/postrouting：nat 链，端口映射的 DNAT 和 SNAT、MASQUERADE
+//  - forward/input：filter 链，放行网桥、端口映射和内置 DNS 的流量，第一条规则跳转到隔离链
+//  - portmap：目的地址为本机的流量从 prerouting 和 output 跳转到这里，每个端口映射一条 DNAT 规则
+//  - isolation1/isolation2：网络之间的隔离，规则和 iptables 实现相同
+// 每条规则的注释为 "mini-container[:<owner>] <id>"，同一条链中注释唯一，据此判断规则是否已经存在
+// 规则通过 nft -f 提交，一次提交中的修改要么全部生效，要么都不生效；通过 nft -j 读取已有的规则
+// 注意：nftables 中一个表的 accept 不会跳过其他表，宿主机上其他程序（例如 docker）的 FORWARD 默认策略为 DROP 时，
+// 需要使用 iptables 实现
+
+const (
+	nftFamily = "inet"
+	nftTable  = "mini-container"
+
+	nftChainPrerouting  = "prerouting"
+	nftChainOutput      = "output"
+	nftChainPostrouting = "postrouting"
+	nftChainForward     = "forward"
+	nftChainInput       = "input"
+	nftChainPortMapping = "portmap"
+	nftChainIsolation1  = "isolation1"
+	nftChainIsolation2  = "isolation2"
+)
+
+// nftBaseChains 表和链的定义，add 已存在的表和链时不做处理，每次提交前都带上
+var nftBaseChains = []string{
+	"add table inet mini-container",
+	"add chain inet mini-container prerouting { type nat hook prerouting priority -100; policy accept; }",
+	"add chain inet mini-container output { type nat hook output priority -100; policy accept; }",
+	"add chain inet mini-container postrouting { type nat hook postrouting priority 100; policy accept; }",
+	"add chain inet mini-container forward { type filter hook forward priority 0; policy accept; }",
+	"add chain inet mini-container input { type filter hook input priority 0; policy accept; }",
+	"add chain inet mini-container portmap",
+	"add chain inet mini-container isolation1",
+	"add chain inet mini-container isolation2",
+}
+
+type nfTables struct{}
+
+func newNFTables() *nfTables {
+	return &nfTables{}
+}
+
+func (*nfTables) Name() string {
+	return BackendNFTables
+}
+
+// nftRule mini-container 添加的一条规则
+type nftRule struct {
+	chain  string
+	expr   string
+	owner  string // 所属的网桥，为空表示全局规则
+	id     string // 在链中和 owner 一起唯一标识规则
+	insert bool   // 插入到链的开头
+}
+
+func (r *nftRule) comment() string {
+	comment := iptables.CommentPrefix
+	if r.owner != "" {
+		comment += ":" + r.owner
+	}
+	return comment + " " + r.id
+}
+
+// add 添加规则的 nft 命令
+func (r *nftRule) add() string {
+	verb := "add"
+	if r.insert {
+		verb = "insert"
+	}
+	return fmt.Sprintf("%s rule %s %s %s %s comment %q", verb, nftFamily, nftTable, r.chain, r.expr, r.comment())
+}
+
+// parseNFTComment 解析规则的注释，ok 为 false 表示不是 mini-container 添加的规则
+func parseNFTComment(comment string) (owner, id string, ok bool) {
+	head, id, _ := strings.Cut(comment, " ")
+	if head == iptables.CommentPrefix {
+		return "", id, true
+	}
+	if owner, ok := strings.CutPrefix(head, iptables.CommentPrefix+":"); ok && owner != "" {
+		return owner, id, true
+	}
+	return "", "", false
+}
+
+// nftListedRule nft -j 列出的一条规则
+type nftListedRule struct {
+	Family  string          `json:"family"`
+	Table   string          `json:"table"`
+	Chain   string          `json:"chain"`
+	Handle  int             `json:"handle"`
+	Comment string          `json:"comment"`
+	Expr    json.RawMessage `json:"expr"`
+}
+
+func (r *nftListedRule) delete() string {
+	return fmt.Sprintf("delete rule %s %s %s handle %d", nftFamily, nftTable, r.Chain, r.Handle)
+}
+
+// parseNFTListing 解析 nft -j list ruleset 的输出，返回 mini-container 表是否存在以及表中的规则
+func parseNFTListing(data []byte) (exists bool, rules []*nftListedRule, err error) {
+	var listing struct {
+		Nftables []struct {
+			Table *struct {
+				Family string `json:"family"`
+				Name   string `json:"name"`
+			} `json:"table"`
+			Rule *nftListedRule `json:"rule"`
+		} `json:"nftables"`
+	}
+	if err := json.Unmarshal(data, &listing); err != nil {
+		return false, nil, fmt.Errorf("parse nft ruleset fail err=%s", err)
+	}
+	for _, item := range listing.Nftables {
+		switch {
+		case item.Table != nil:
+			exists = exists || item.Table.Family == nftFamily && item.Table.Name == nftTable
+		case item.Rule != nil:
+			if item.Rule.Family == nftFamily && item.Rule.Table == nftTable {
+				rules = append(rules, item.Rule)
+			}
+		}
+	}
+	return exists, rules, nil
+}
+
+func (*nfTables) list() (exists bool, rules []*nftListedRule, err error) {
+	output, err := exec.Command("nft", "-j", "list", "ruleset", nftFamily).Output()
+	if err != nil {
+		return false, nil, fmt.Errorf("nft -j list ruleset fail err=%s", err)
+	}
+	return parseNFTListing(output)
+}
+
+// apply 通过 nft -f 原子地提交一组命令
+func (*nfTables) apply(lines []string) error {
+	script := strings.Join(lines, "\n") + "\n"
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft -f fail err=%s output=%s input=%q", err, strings.TrimSpace(string(output)), script)
+	}
+	return nil
+}
+
+// ensure 添加不存在的规则
+func (n *nfTables) ensure(rules []*nftRule) error {
+	_, listed, err := n.list()
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool, len(listed))
+	for _, r := range listed {
+		have[r.Chain+" "+r.Comment] = true
+	}
+	lines := append([]string{}, nftBaseChains...)
+	for _, r := range rules {
+		if !have[r.chain+" "+r.comment()] {
+			lines = append(lines, r.add())
+		}
+	}
+	return n.apply(lines)
+}
+
+// remove 删除满足条件的规则
+func (n *nfTables) remove(match func(*nftListedRule) bool) error {
+	exists, listed, err := n.list()
+	if err != nil || !exists {
+		return err
+	}
+	lines := make([]string, 0)
+	for _, r := range listed {
+		if match(r) {
+			lines = append(lines, r.delete())
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return n.apply(lines)
+}
+
+// nftIP 地址对应的 nft 协议名
+func nftIP(ip net.IP) string {
+	if ip.To4() == nil {
+		return "ip6"
+	}
+	return "ip"
+}
+
+func (n *nfTables) EnsureBridge(b *Bridge) error {
+	return common.ErrTag("ensure bridge rules", n.ensure(nftBridgeRules(b)))
+}
+
+// nftBridgeRules 放行网桥流量的规则和子网的 SNAT 规则
+func nftBridgeRules(b *Bridge) []*nftRule {
+	br := strconv.Quote(b.Name)
+	out := "iifname " + br + " accept"
+	if !b.External {
+		out = "iifname " + br + " oifname " + br + " accept"
+	}
+	rules := []*nftRule{
+		{chain: nftChainForward, expr: out, owner: b.Name, id: "forward-out"},
+		{chain: nftChainForward, expr: "oifname " + br + " ct state related,established accept", owner: b.Name, id: "forward-in"},
+	}
+	if !b.External {
+		return rules
+	}
+	for _, subnet := range b.Subnets {
+		rules = append(rules, &nftRule{
+			chain: nftChainPostrouting,
+			expr:  fmt.Sprintf("%s saddr %s oifname != %s masquerade", nftIP(subnet.IP), subnet, br),
+			owner: b.Name,
+			id:    "snat " + subnet.String(),
+		})
+	}
+	return rules
+}
+
+func (n *nfTables) ReleaseBridge(name string) error {
+	return n.remove(func(r *nftListedRule) bool {
+		owner, _, ok := parseNFTComment(r.Comment)
+		return ok && owner == name
+	})
+}
+
+// nftPortMappingChains 端口映射共用的规则：目的地址为本机的流量跳转到 portmap 链，以及本机访问的 MASQUERADE
+func nftPortMappingChains(bridgeName string) []*nftRule {
+	jump := "fib daddr type local jump " + nftChainPortMapping
+	return []*nftRule{
+		{chain: nftChainPrerouting, expr: jump, id: "portmap"},
+		{chain: nftChainOutput, expr: jump, id: "portmap"},
+		{chain: nftChainPostrouting, expr: fmt.Sprintf("oifname %q fib saddr type local masquerade", bridgeName), owner: bridgeName, id: "local"},
+	}
+}
+
+// nftPortMappingRules 每个端口映射的 DNAT、hairpin 和 FORWARD 规则
+func nftPortMappingRules(bridgeName string, containerIP net.IP, ports []*PortMapping) []*nftRule {
+	br := strconv.Quote(bridgeName)
+	rules := make([]*nftRule, 0, len(ports)*3)
+	ctrIP := containerIP.String()
+	for _, pm := range ports {
+		ctrAddr := net.JoinHostPort(ctrIP, strconv.Itoa(pm.ContainerPort))
+		dnat := "meta nfproto ipv4 "
+		if pm.HostIP != "" {
+			dnat = "ip daddr " + pm.HostIP + " "
+		}
+		dnat += fmt.Sprintf("%s dport %d dnat ip to %s", pm.Protocol, pm.HostPort, ctrAddr)
+		key := fmt.Sprintf("%s %s:%d %s", pm.Protocol, pm.HostIP, pm.HostPort, ctrAddr)
+		rules = append(rules,
+			&nftRule{chain: nftChainPortMapping, expr: dnat, owner: bridgeName, id: "dnat " + key},
+			&nftRule{
+				chain: nftChainPostrouting,
+				expr:  fmt.Sprintf("ip saddr %s ip daddr %s %s dport %d masquerade", ctrIP, ctrIP, pm.Protocol, pm.ContainerPort),
+				owner: bridgeName,
+				id:    "hairpin " + key,
+			},
+			&nftRule{
+				chain: nftChainForward,
+				expr:  fmt.Sprintf("ip daddr %s oifname %s %s dport %d accept", ctrIP, br, pm.Protocol, pm.ContainerPort),
+				owner: bridgeName,
+				id:    "forward " + key,
+			},
+		)
+	}
+	return rules
+}
+
+func (n *nfTables) AddPortMappings(bridgeName string, containerIP net.IP, ports []*PortMapping) error {
+	rules := append(nftPortMappingChains(bridgeName), nftPortMappingRules(bridgeName, containerIP, ports)...)
+	return common.ErrTag("port mappings", n.ensure(rules))
+}
+
+// RemovePortMappings 只删除每个映射自己的规则，跳转和本机访问的规则是共用的，删除网桥时清理
+func (n *nfTables) RemovePortMappings(bridgeName string, containerIP net.IP, ports []*PortMapping) error {
+	if len(ports) == 0 {
+		return nil
+	}
+	keys := make(map[string]bool)
+	for _, r := range nftPortMappingRules(bridgeName, containerIP, ports) {
+		keys[r.chain+" "+r.comment()] = true
+	}
+	return common.ErrTag("port mappings", n.remove(func(r *nftListedRule) bool {
+		return keys[r.Chain+" "+r.Comment]
+	}))
+}
+
+func (n *nfTables) AllowDNS(bridgeName string, gateway net.IP) error {
+	return n.ensure([]*nftRule{{
+		chain: nftChainInput,
+		expr:  fmt.Sprintf("iifname %q %s daddr %s udp dport 53 accept", bridgeName, nftIP(gateway), gateway),
+		owner: bridgeName,
+		id:    "dns",
+	}})
+}
+
+// SetIsolation 清空并重新生成隔离链，forward 链中的跳转规则重新插入到最前面，在同一次提交中完成
+func (n *nfTables) SetIsolation(iso *Isolation) error {
+	_, listed, err := n.list()
+	if err != nil {
+		return err
+	}
+	jump := &nftRule{chain: nftChainForward, expr: "jump " + nftChainIsolation1, id: "isolation", insert: true}
+	lines := append([]string{}, nftBaseChains...)
+	for _, r := range listed {
+		if r.Chain == jump.chain && r.Comment == jump.comment() {
+			lines = append(lines, r.delete())
+		}
+	}
+	lines = append(lines,
+		fmt.Sprintf("flush chain %s %s %s", nftFamily, nftTable, nftChainIsolation1),
+		fmt.Sprintf("flush chain %s %s %s", nftFamily, nftTable, nftChainIsolation2),
+	)
+	for _, r := range nftIsolationRules(iso) {
+		lines = append(lines, r.add())
+	}
+	lines = append(lines, jump.add())
+	return common.ErrTag("apply isolation rules", n.apply(lines))
+}
+
+// nftIsolationRules 两条隔离链的内容，和 iptables 实现的 isolationRules 相同，放行规则同样直接 accept
+func nftIsolationRules(iso *Isolation) []*nftRule {
+	rules := []*nftRule{
+		{chain: nftChainIsolation1, expr: "ct state related,established return", id: "established"},
+	}
+	for _, a := range iso.Allows {
+		expr := fmt.Sprintf("iifname %q oifname %q", a.From, a.To)
+		id := "allow " + a.From + " " + a.To
+		if a.Port != 0 {
+			expr += fmt.Sprintf(" %s dport %d", a.Protocol, a.Port)
+			id += fmt.Sprintf(" %d/%s", a.Port, a.Protocol)
+		}
+		rules = append(rules, &nftRule{chain: nftChainIsolation1, expr: expr + " accept", owner: a.From, id: id})
+	}
+	for _, br := range iso.Internal {
+		rules = append(rules,
+			&nftRule{chain: nftChainIsolation1, expr: fmt.Sprintf("iifname %q oifname != %q drop", br, br), owner: br, id: "internal-out"},
+			&nftRule{chain: nftChainIsolation1, expr: fmt.Sprintf("iifname != %q oifname %q drop", br, br), owner: br, id: "internal-in"},
+		)
+	}
+	for _, br := range iso.Bridges {
+		rules = append(rules, &nftRule{
+			chain: nftChainIsolation1,
+			expr:  fmt.Sprintf("iifname %q oifname != %q jump %s", br, br, nftChainIsolation2),
+			owner: br,
+			id:    "isolation",
+		})
+	}
+	for _, br := range iso.Bridges {
+		rules = append(rules, &nftRule{chain: nftChainIsolation2, expr: fmt.Sprintf("oifname %q drop", br), owner: br, id: "isolation"})
+	}
+	return rules
+}
+
+// List 列出 mini-container 表中的所有规则，Spec 为注释中的规则标识
+func (n *nfTables) List() ([]*Rule, error) {
+	_, listed, err := n.list()
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]*Rule, 0, len(listed))
+	for _, r := range listed {
+		owner, id, ok := parseNFTComment(r.Comment)
+		if !ok {
+			// 不是 mini-container 添加的规则，例如手动添加到表中的规则
+			id = string(r.Expr)
+		}
+		rules = append(rules, &Rule{Family: nftFamily, Table: nftTable, Chain: r.Chain, Owner: owner, Spec: id})
+	}
+	return rules, nil
+}
+
+// ReleaseAll 删除整个 mini-container 表
+func (n *nfTables) ReleaseAll() error {
+	exists, _, err := n.list()
+	if err != nil || !exists {
+		return err
+	}
+	return n.apply([]string{fmt.Sprintf("delete table %s %s", nftFamily, nftTable)})
+}
@@ -0,0 +1,107 @@
+package firewall
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestNFTRuleAdd(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.172.0.0/24")
+	_, subnet6, _ := net.ParseCIDR("fd00:1::/64")
+	rules := nftBridgeRules(&Bridge{Name: "mc-web", Subnets: []*net.IPNet{subnet, subnet6}, External: true})
+	assert.Len(t, rules, 4)
+	assert.Equal(t, `add rule inet mini-container forward iifname "mc-web" accept comment "mini-container:mc-web forward-out"`, rules[0].add())
+	assert.Equal(t, `add rule inet mini-container postrouting ip saddr 192.172.0.0/24 oifname != "mc-web" masquerade comment "mini-container:mc-web snat 192.172.0.0/24"`, rules[2].add())
+	assert.Equal(t, `ip6 saddr fd00:1::/64 oifname != "mc-web" masquerade`, rules[3].expr)
+
+	rules = nftBridgeRules(&Bridge{Name: "mc-db", Subnets: []*net.IPNet{subnet}})
+	assert.Len(t, rules, 2)
+	assert.Equal(t, `iifname "mc-db" oifname "mc-db" accept`, rules[0].expr)
+}
+
+func TestNFTPortMappingRules(t *testing.T) {
+	ports := []*PortMapping{
+		{HostIP: "127.0.0.1", HostPort: 8080, ContainerPort: 80, Protocol: "tcp"},
+		{HostPort: 8053, ContainerPort: 53, Protocol: "udp"},
+	}
+	rules := nftPortMappingRules("mini-ctr0", net.ParseIP("192.172.0.2"), ports)
+	assert.Len(t, rules, 6)
+	assert.Equal(t, "ip daddr 127.0.0.1 tcp dport 8080 dnat ip to 192.172.0.2:80", rules[0].expr)
+	assert.Equal(t, "mini-container:mini-ctr0 dnat tcp 127.0.0.1:8080 192.172.0.2:80", rules[0].comment())
+	assert.Equal(t, "ip saddr 192.172.0.2 ip daddr 192.172.0.2 tcp dport 80 masquerade", rules[1].expr)
+	assert.Equal(t, `ip daddr 192.172.0.2 oifname "mini-ctr0" tcp dport 80 accept`, rules[2].expr)
+	assert.Equal(t, "meta nfproto ipv4 udp dport 8053 dnat ip to 192.172.0.2:53", rules[3].expr)
+}
+
+func TestNFTIsolationRules(t *testing.T) {
+	iso := &Isolation{
+		Bridges:  []string{"mini-ctr0", "mc-db"},
+		Internal: []string{"mc-db"},
+		Allows:   []*Allow{{From: "mini-ctr0", To: "mc-db", Port: 5432, Protocol: "tcp"}},
+	}
+	exprs := []string{}
+	for _, r := range nftIsolationRules(iso) {
+		exprs = append(exprs, r.chain+": "+r.expr)
+	}
+	assert.Equal(t, []string{
+		"isolation1: ct state related,established return",
+		`isolation1: iifname "mini-ctr0" oifname "mc-db" tcp dport 5432 accept`,
+		`isolation1: iifname "mc-db" oifname != "mc-db" drop`,
+		`isolation1: iifname != "mc-db" oifname "mc-db" drop`,
+		`isolation1: iifname "mini-ctr0" oifname != "mini-ctr0" jump isolation2`,
+		`isolation1: iifname "mc-db" oifname != "mc-db" jump isolation2`,
+		`isolation2: oifname "mini-ctr0" drop`,
+		`isolation2: oifname "mc-db" drop`,
+	}, exprs)
+
+	// 内部网络发往其他网络的放行流量在丢弃规则之前 accept
+	iso.Allows = []*Allow{{From: "mc-db", To: "mini-ctr0"}}
+	rules := nftIsolationRules(iso)
+	assert.Equal(t, `iifname "mc-db" oifname "mini-ctr0" accept`, rules[1].expr)
+	assert.Equal(t, `iifname "mc-db" oifname != "mc-db" drop`, rules[2].expr)
+}
+
+func TestParseNFTComment(t *testing.T) {
+	owner, id, ok := parseNFTComment("mini-container:mc-web snat 192.172.0.0/24")
+	assert.True(t, ok)
+	assert.Equal(t, "mc-web", owner)
+	assert.Equal(t, "snat 192.172.0.0/24", id)
+
+	owner, id, ok = parseNFTComment("mini-container portmap")
+	assert.True(t, ok)
+	assert.Equal(t, "", owner)
+	assert.Equal(t, "portmap", id)
+
+	for _, comment := range []string{"", "docker", "mini-container-foo x", "mini-container: x"} {
+		_, _, ok := parseNFTComment(comment)
+		assert.False(t, ok, comment)
+	}
+}
+
+func TestParseNFTListing(t *testing.T) {
+	data := []byte(`{"nftables": [
+		{"metainfo": {"version": "1.0.6", "release_name": "Lester Gooch #5", "json_schema_version": 1}},
+		{"table": {"family": "inet", "name": "filter", "handle": 1}},
+		{"table": {"family": "inet", "name": "mini-container", "handle": 2}},
+		{"chain": {"family": "inet", "table": "mini-container", "name": "forward", "handle": 1, "type": "filter", "hook": "forward", "prio": 0, "policy": "accept"}},
+		{"rule": {"family": "inet", "table": "filter", "chain": "input", "handle": 3, "expr": [{"accept": null}]}},
+		{"rule": {"family": "inet", "table": "mini-container", "chain": "forward", "handle": 7, "comment": "mini-container:mc-web forward-out",
+			"expr": [{"match": {"op": "==", "left": {"meta": {"key": "iifname"}}, "right": "mc-web"}}, {"accept": null}]}}
+	]}`)
+	exists, rules, err := parseNFTListing(data)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Len(t, rules, 1)
+	assert.Equal(t, "forward", rules[0].Chain)
+	assert.Equal(t, 7, rules[0].Handle)
+	assert.Equal(t, "delete rule inet mini-container forward handle 7", rules[0].delete())
+
+	exists, rules, err = parseNFTListing([]byte(`{"nftables": [{"metainfo": {"version": "1.0.6"}}]}`))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Empty(t, rules)
+
+	_, _, err = parseNFTListing([]byte("Error: syntax error"))
+	assert.Error(t, err)
+}
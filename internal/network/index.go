@@ -3,8 +3,10 @@ package network
 import (
 	"fmt"
 	"math/rand"
+	"mini-container/common"
 	"mini-container/config"
 	"mini-container/internal/network/bridge"
+	"mini-container/internal/network/firewall"
 	"mini-container/internal/network/ippool"
 	"net"
 )
@@ -26,50 +28,335 @@ func InitBridgeAndIPPool() error {
 	}
 
 	if !bridge.ExistsBridge(config.DefaultBridgeName) {
-		err = bridge.CreateBridgeAndSetSNAT(config.DefaultBridgeName, config.DefaultBridgeIPNet)
-		if err != nil {
-			return err
+		return DefaultNetwork().Ensure()
+	}
+	return nil
+}
+
+// ReconcileHostNetwork 检查并修复所有网络在宿主机上的配置，并按正在使用的地址重建IP池
+// 宿主机重启后网桥、防火墙规则和 ip_forward 会丢失，而IP池中仍记录着已经退出的容器的地址
+// 同时清理已经不存在的网络留下的防火墙规则
+// leases: 运行中的容器的地址
+func ReconcileHostNetwork(leases []*net.IPNet) error {
+	networks, err := ListNetworks()
+	if err != nil {
+		return err
+	}
+	used := make([]string, 0, len(networks)+len(leases))
+	for _, nw := range networks {
+		if err := nw.Ensure(); err != nil {
+			if !nw.IsBridge() {
+				// parent 网卡不存在时只影响该网络
+				common.ErrLog("reconcile network "+nw.Name, err)
+			} else {
+				return common.ErrTag("reconcile network "+nw.Name, err)
+			}
+		}
+		used = append(used, nw.Gateway().String())
+		if nw.Gateway6() != nil {
+			used = append(used, nw.Gateway6().String())
 		}
+	}
+	if _, err := PruneFirewallRules(); err != nil {
+		return common.ErrTag("prune firewall rules", err)
+	}
+	for _, lease := range leases {
+		used = append(used, lease.String())
+	}
+	return common.ErrTag("reconcile ip pool", IPPool.ResetUsed(used))
+}
+
+// EndpointOptions 容器连接到网络时的配置
+type EndpointOptions struct {
+	IP          net.IP         // 静态IP，为 nil 时从IP池中分配
+	StickyOwner string         // 不为空时，IP池为该名字保留上次分配的IP，重启后仍使用同一个IP
+	Ports       []*PortMapping // 发布到宿主机的端口
+	// NoDefaultRoute 不添加默认路由，用于 network connect 连接的额外网络，默认路由只经过容器启动时的网络
+	NoDefaultRoute bool
+	// 进入和发出容器的速率，单位 bit/s，为0时不限速，只对 bridge 网络生效
+	IngressRate uint64
+	EgressRate  uint64
+}
 
+// ValidateStaticIP 检查静态IP是否可以在网络中使用：在子网内，不是网络地址、广播地址和网关，并且没有被占用
+// 与 docker 相同，--ip-range 只限制自动分配的地址，静态IP可以在 ip-range 之外，不会与自动分配的地址冲突
+func ValidateStaticIP(nw *Network, staticIP net.IP) error {
+	ip := staticIP.To4()
+	if ip == nil {
+		if staticIP.To16() != nil {
+			return fmt.Errorf("static ipv6 is not supported, ip %s", staticIP)
+		}
+		return fmt.Errorf("invalid ip %s", staticIP)
+	}
+	if !nw.Subnet().Contains(ip) {
+		return fmt.Errorf("ip %s is not in subnet %s of network %s", ip, nw.Subnet(), nw.Name)
+	}
+	if ip.Equal(nw.Subnet().IP) || ip.Equal(broadcast(nw.Subnet())) || ip.Equal(nw.Gateway().IP) {
+		return fmt.Errorf("ip %s is reserved in network %s", ip, nw.Name)
+	}
+	ipNet := &net.IPNet{IP: ip, Mask: nw.Subnet().Mask}
+	available, err := IPPool.IsAvailable(ipNet.String())
+	if err != nil {
+		return err
+	}
+	if !available {
+		return fmt.Errorf("ip %s is already in use", ip)
 	}
 	return nil
 }
 
-// ConfigNetworkForContainer 配置容器IP
-// return: allocateIPNet, error
-func ConfigNetworkForContainer(pid int) (*net.IPNet, error) {
-	// 分配IP
-	allocateIPNet, err := IPPool.AllocateIP(config.DefaultBridgeIPNet)
-	if err != nil {
-		return nil, fmt.Errorf("alloc allocateIPNet fail %s", err)
+// Endpoint 容器在一个网络中的配置，停止或断开时按该配置释放
+type Endpoint struct {
+	Network  string     `json:"network"`  // 网络名，为空表示容器的 --network（旧版本的状态）
+	IPNet    *net.IPNet `json:"ipNet"`    // x.x.x.x/x
+	IPNet6   *net.IPNet `json:"ipNet6"`   // 网络启用 IPv6 时的地址
+	MAC      string     `json:"mac"`      // 容器端网卡的 MAC 地址
+	VethName string     `json:"vethName"` // 宿主机端的 veth 名称
+	// LinkName macvlan/ipvlan 子接口的名称，子接口没有宿主机端，释放时在容器的 network namespace 中删除
+	LinkName string `json:"linkName"`
+}
+
+// Released 是否已经全部释放，见 ReleaseNetworkForContainer
+func (ep *Endpoint) Released() bool {
+	return ep.IPNet == nil && ep.IPNet6 == nil && ep.VethName == "" && ep.LinkName == ""
+}
+
+// IPs 容器在网络中的地址
+func (ep *Endpoint) IPs() []net.IP {
+	ips := make([]net.IP, 0, 2)
+	for _, ipNet := range []*net.IPNet{ep.IPNet, ep.IPNet6} {
+		if ipNet != nil {
+			ips = append(ips, ipNet.IP)
+		}
 	}
+	return ips
+}
 
-	// 主机上创建 veth 设备,并连接到网桥上
-	randPart := rand.Intn(900) + 100 // 100~999
-	vethName := fmt.Sprintf("%d-%d", pid, randPart)
+// stickyOwner6 IPv6 地址在IP池中保留时使用的名字
+func stickyOwner6(owner string) string {
+	return owner + "@ipv6"
+}
 
-	peerName, err := bridge.CreateVeth(config.DefaultBridgeName, vethName)
+// ReleaseStickyIPs 释放为 owner 保留的 IPv4 和 IPv6 地址
+func ReleaseStickyIPs(owner string) error {
+	return common.Err(common.ErrGroup(
+		IPPool.ReleaseSticky(owner),
+		IPPool.ReleaseSticky(stickyOwner6(owner)),
+	))
+}
+
+// allocateIP 按 EndpointOptions 分配IP
+func allocateIP(nw *Network, opts *EndpointOptions) (*net.IPNet, error) {
+	switch {
+	case opts.IP != nil:
+		if err := ValidateStaticIP(nw, opts.IP); err != nil {
+			return nil, err
+		}
+		return IPPool.AllocateStaticIP((&net.IPNet{IP: opts.IP, Mask: nw.Subnet().Mask}).String())
+	case opts.StickyOwner != "":
+		return IPPool.AllocateStickyIP(opts.StickyOwner, nw.Subnet().String(), nw.IPRange)
+	default:
+		return IPPool.AllocateIPInRange(nw.Subnet().String(), nw.IPRange)
+	}
+}
 
-	//fmt.Println("[Debug]peerName:", peerName)
+// allocateIP6 分配 IPv6 地址，静态IP只支持 IPv4，IPv6 地址总是从IP池中分配
+func allocateIP6(nw *Network, opts *EndpointOptions) (*net.IPNet, error) {
+	if opts.StickyOwner != "" {
+		return IPPool.AllocateStickyIP(stickyOwner6(opts.StickyOwner), nw.Subnet6().String(), nil)
+	}
+	return IPPool.AllocateIP(nw.Subnet6().String())
+}
 
+// ConfigNetworkForContainer 从网络的IP池中分配容器IP，按网络驱动为容器创建网卡（bridge 驱动连接到网络的网桥上），并配置端口映射和限速
+// 网络启用 IPv6 时同时分配 IPv6 地址，并添加 IPv6 默认路由
+// 容器已经连接了其他网络时（network connect）会在容器中增加一个网卡
+// pid 用于生成网卡名称，netnsPath 为容器的 network namespace
+// 注意：出错时已经分配的IP和创建的veth也会记录在返回的 Endpoint 中，调用方需要通过 ReleaseNetworkForContainer 释放
+func ConfigNetworkForContainer(pid int, netnsPath string, nw *Network, opts *EndpointOptions) (*Endpoint, error) {
+	ep := &Endpoint{Network: nw.Name}
+	ports := opts.Ports
+	if nw.Internal && len(ports) > 0 {
+		return ep, fmt.Errorf("can not publish ports on internal network %s", nw.Name)
+	}
+	if !nw.IsBridge() && len(ports) > 0 {
+		return ep, fmt.Errorf("can not publish ports on %s network %s", nw.Driver, nw.Name)
+	}
+	d, err := GetDriver(nw.Driver)
 	if err != nil {
-		return nil, fmt.Errorf("create veth fail err=%s", err)
+		return ep, err
+	}
+	if err := nw.Ensure(); err != nil {
+		return ep, fmt.Errorf("ensure network fail err=%s", err)
+	}
+
+	// 分配IP
+	if ep.IPNet, err = allocateIP(nw, opts); err != nil {
+		return ep, fmt.Errorf("alloc allocateIPNet fail %s", err)
+	}
+	addrs := []*bridge.EndpointAddr{{IP: ep.IPNet.IP, Gateway: nw.Gateway(), DeviceRoute: nw.deviceRoute()}}
+	if nw.Gateway6() != nil {
+		if ep.IPNet6, err = allocateIP6(nw, opts); err != nil {
+			return ep, fmt.Errorf("alloc ipv6 fail %s", err)
+		}
+		addrs = append(addrs, &bridge.EndpointAddr{IP: ep.IPNet6.IP, Gateway: nw.Gateway6(), DeviceRoute: nw.deviceRoute()})
+	}
+
+	// 主机上创建 veth 设备并连接到网桥上，macvlan/ipvlan 驱动创建 parent 的子接口
+	randPart := rand.Intn(900) + 100 // 100~999
+	linkName := fmt.Sprintf("%d-%d", pid, randPart)
+
+	hostVethName, peerName, err := d.CreateLink(nw, linkName)
+	if err != nil {
+		return ep, fmt.Errorf("create link fail err=%s", err)
+	}
+	ep.VethName = hostVethName
+	if hostVethName == "" {
+		ep.LinkName = peerName
+	}
+	// 子接口没有宿主机端，移入容器的网络命名空间之前出错时需要立即删除，移入之后由 ReleaseNetworkForContainer 删除
+	fail := func(err error) (*Endpoint, error) {
+		if hostVethName == "" {
+			common.ErrLog("delete link", bridge.DeleteLink(peerName))
+		}
+		return ep, err
+	}
+	// peer 端移入容器的网络命名空间后 MAC 地址不变
+	mac, err := bridge.HardwareAddr(peerName)
+	if err != nil {
+		return fail(err)
+	}
+	ep.MAC = mac.String()
+	if hostVethName != "" && (opts.IngressRate > 0 || opts.EgressRate > 0) {
+		if err := bridge.SetBandwidth(hostVethName, opts.IngressRate, opts.EgressRate); err != nil {
+			return ep, fmt.Errorf("set bandwidth fail err=%s", err)
+		}
 	}
 	// 主机上设置子进程网络命名空间配置
-	bridgeIPNet, _ := bridge.ParseIPNet(config.DefaultBridgeIPNet)
-	if err := bridge.SetContainerIP(peerName, pid, allocateIPNet.IP, bridgeIPNet); err != nil {
-		return nil, fmt.Errorf("SetContainerIP fail err=%s peer-name=%s pid=%d allocateIPNet=%v", err, peerName, pid, allocateIPNet)
+	if err := bridge.SetContainerIP(peerName, netnsPath, addrs, !nw.Internal && !opts.NoDefaultRoute); err != nil {
+		return fail(fmt.Errorf("SetContainerIP fail err=%s peer-name=%s netns=%s ip=%v", err, peerName, netnsPath, ep.IPNet))
+	}
+
+	if len(ports) > 0 {
+		// 容器通过宿主机地址访问自己映射的端口时，流量需要从同一个网桥端口发回
+		if err := bridge.SetHairpin(hostVethName); err != nil {
+			return ep, fmt.Errorf("set hairpin fail err=%s", err)
+		}
+		if err := SetupPortMappings(nw.Bridge.Name, ep.IPNet.IP, ports); err != nil {
+			return ep, err
+		}
 	}
-	return allocateIPNet, nil
+	return ep, nil
 }
 
-// ReleaseNetworkForContainer 释放容器IP配置
-func ReleaseNetworkForContainer(ipNetStr string) error {
-	return IPPool.ReleaseIPStr(ipNetStr)
+// ReleaseNetworkForContainer 释放容器的网络配置：端口映射规则、宿主机端 veth 和限速使用的 ifb、
+// netnsPath 中的 macvlan/ipvlan 子接口、IP
+// 子接口需要先于 IP 删除，否则容器仍然持有该地址，IP 池又将其分配给其他容器，物理网络上出现重复的地址
+// Endpoint 中为空的字段跳过对应的步骤，释放成功的字段会被清空
+// 注意：出错时停止释放，ip 仍然保留，可以重复调用
+func ReleaseNetworkForContainer(nw *Network, ep *Endpoint, netnsPath string, ports []*PortMapping) error {
+	if ep.IPNet != nil {
+		// 端口映射规则依赖容器ip，需要先于ip释放
+		if err := ReleasePortMappings(nw.Bridge.Name, ep.IPNet.IP, ports); err != nil {
+			return common.ErrTag("release port mappings", err)
+		}
+	}
+	if ep.VethName != "" {
+		// 限速使用的 ifb 不会随 veth 一起删除
+		if err := bridge.DeleteBandwidth(ep.VethName); err != nil {
+			return common.ErrTag("delete ifb", err)
+		}
+		// 删除宿主机端即删除整个 veth pair，容器的 network namespace 在停止时才删除，peer 端仍然存在
+		if err := bridge.DeleteVeth(ep.VethName); err != nil {
+			return common.ErrTag("delete veth", err)
+		}
+		ep.VethName = ""
+	}
+	if ep.LinkName != "" {
+		// 移入容器之前出错时子接口仍然在宿主机上
+		err := common.Err(common.ErrGroup(
+			bridge.DeleteLink(ep.LinkName),
+			bridge.DeleteLinkInNetNS(netnsPath, ep.LinkName),
+		))
+		if err != nil {
+			return common.ErrTag("delete sub-interface", err)
+		}
+		ep.LinkName = ""
+	}
+	if ep.IPNet6 != nil {
+		if err := IPPool.ReleaseIPStr(ep.IPNet6.String()); err != nil {
+			return common.ErrTag("release ipv6", err)
+		}
+		ep.IPNet6 = nil
+	}
+	if ep.IPNet != nil {
+		if err := IPPool.ReleaseIPStr(ep.IPNet.String()); err != nil {
+			return common.ErrTag("release ip", err)
+		}
+		ep.IPNet = nil
+	}
+	return nil
 }
 
-func ReleaseBridge() error {
-	// TODO
+// ReleaseAllBridges 删除所有网络在宿主机上的配置（网桥），以及 mini-container 添加的所有防火墙规则和链
+// 网络的配置保留，下次使用时重新创建网桥
+func ReleaseAllBridges() error {
+	networks, err := ListNetworks()
+	if err != nil {
+		return err
+	}
+	for _, nw := range networks {
+		if err := nw.Release(); err != nil {
+			return err
+		}
+	}
+	fw, err := firewall.Default()
+	if err != nil {
+		return err
+	}
+	return common.ErrTag("release "+fw.Name()+" rules", fw.ReleaseAll())
+}
 
-	return nil
+// FirewallRules 当前使用的防火墙实现，以及 mini-container 添加的所有规则
+func FirewallRules() (string, []*firewall.Rule, error) {
+	fw, err := firewall.Default()
+	if err != nil {
+		return "", nil, err
+	}
+	rules, err := fw.List()
+	return fw.Name(), rules, err
+}
+
+// PruneFirewallRules 删除不属于任何网络的网桥的规则，例如网络的配置被手动删除后留下的规则，返回被清理的网桥
+func PruneFirewallRules() ([]string, error) {
+	fw, err := firewall.Default()
+	if err != nil {
+		return nil, err
+	}
+	rules, err := fw.List()
+	if err != nil {
+		return nil, err
+	}
+	networks, err := ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+	bridges := make(map[string]bool, len(networks))
+	for _, nw := range networks {
+		if nw.IsBridge() {
+			bridges[nw.Bridge.Name] = true
+		}
+	}
+	pruned := make([]string, 0)
+	for _, r := range rules {
+		if r.Owner == "" || bridges[r.Owner] {
+			continue
+		}
+		bridges[r.Owner] = true
+		if err := fw.ReleaseBridge(r.Owner); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, r.Owner)
+	}
+	return pruned, nil
 }
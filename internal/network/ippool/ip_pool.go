@@ -1,55 +1,137 @@
 package ippool
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math/big"
 	"mini-container/common"
 	"net"
+	"os"
+	"sync"
 )
 
-// TODO 通过文件方式进行加锁
+// MaxPoolBits an ipv6 subnet's bitmap covers at most the first 2^MaxPoolBits addresses,
+// so an ipv6 /64 doesn't need a 2^64 bitmap; ipv4 bitmaps always cover the whole subnet
+const MaxPoolBits = 16
 
+// Every exported method loads, modifies and saves the pool file while holding
+// an flock on <path>.lock, so concurrent processes never hand out the same ip.
+// The unexported methods work on the loaded state and must be called inside update/view.
 type IPPool struct {
+	mu sync.Mutex
 	//subnetStr -> bitmap
-	m    map[string]*common.Bitmap
-	path string
+	m map[string]*common.Bitmap
+	// owner(container name) -> x.x.x.x/x
+	// sticky ips stay used after release, and are handed back to the same owner
+	sticky map[string]string
+	path   string
+}
+
+// poolFile the format of the pool file
+// legacy format (before sticky ips): {subnetStr: bitmap}
+type poolFile struct {
+	Subnets map[string]*common.Bitmap `json:"subnets"`
+	Sticky  map[string]string         `json:"sticky"`
 }
 
 func New(path string) (*IPPool, error) {
 	pool := &IPPool{
-		m:    make(map[string]*common.Bitmap),
-		path: path,
+		m:      make(map[string]*common.Bitmap),
+		sticky: make(map[string]string),
+		path:   path,
 	}
+	// creates the pool file if not exists, migrates the legacy format
+	return pool, pool.update(func() error { return nil })
+}
 
-	if !common.IsExistPath(path) {
-		//fmt.Println("[DEBUG New]", pool.m)
-		return pool, pool.save()
-	}
+func (p *IPPool) lockPath() string {
+	return p.path + ".lock"
+}
+
+// update load the pool, call fn and save the pool if fn succeeds, with the pool file locked exclusively
+func (p *IPPool) update(fn func() error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return common.WithFileLock(p.lockPath(), common.DefaultLockTimeout, func() error {
+		if err := p.load(); err != nil {
+			return err
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+		return p.save()
+	})
+}
 
-	return pool, nil
+// view load the pool and call fn, with the pool file locked shared
+func (p *IPPool) view(fn func() error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return common.WithFileRLock(p.lockPath(), common.DefaultLockTimeout, func() error {
+		if err := p.load(); err != nil {
+			return err
+		}
+		return fn()
+	})
 }
 
 // load
 func (p *IPPool) load() error {
+	p.m = make(map[string]*common.Bitmap)
+	p.sticky = make(map[string]string)
 	if !common.IsExistPath(p.path) {
 		return nil
 	}
 
-	err := common.ReadJSON(p.path, &(p.m))
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+
+	if _, ok := keys["subnets"]; !ok {
+		// legacy format, it's migrated on next save
+		return json.Unmarshal(data, &(p.m))
+	}
+	f := &poolFile{Subnets: p.m, Sticky: p.sticky}
+	err = json.Unmarshal(data, f)
 	//fmt.Println("[DEBUG load]", p.m)
+	if f.Subnets != nil {
+		p.m = f.Subnets
+	}
+	if f.Sticky != nil {
+		p.sticky = f.Sticky
+	}
 	return err
 }
 
 func (p *IPPool) save() error {
 	//fmt.Println("[DEBUG save]", p.m)
-	return common.WriteJSONSync(p.path, p.m)
+	return common.WriteJSONSync(p.path, &poolFile{Subnets: p.m, Sticky: p.sticky})
 }
 
 // AllocateIP allocate an ip from the pool
 // ipNetStr: x.x.x.x/x
 func (p *IPPool) AllocateIP(subnetStr string) (*net.IPNet, error) {
-	if err := p.load(); err != nil {
-		return nil, err
-	}
+	return p.AllocateIPInRange(subnetStr, nil)
+}
+
+// AllocateIPInRange allocate an ip from ipRange of the subnet
+// subnetStr: x.x.x.x/x or ipv6 prefix
+// ipRange: sub range of the subnet, nil means the whole subnet
+func (p *IPPool) AllocateIPInRange(subnetStr string, ipRange *net.IPNet) (ipNet *net.IPNet, err error) {
+	err = p.update(func() error {
+		ipNet, err = p.allocateInRange(subnetStr, ipRange)
+		return err
+	})
+	return ipNet, err
+}
+
+func (p *IPPool) allocateInRange(subnetStr string, ipRange *net.IPNet) (*net.IPNet, error) {
 	//fmt.Println("[DEBUG AllocateIP]", p.m)
 	// ip: 192.168.0.1/24
 	_, ipNet, err := net.ParseCIDR(subnetStr) // ipNet: 192.168.0.0/24
@@ -57,65 +139,170 @@ func (p *IPPool) AllocateIP(subnetStr string) (*net.IPNet, error) {
 		return nil, err
 	}
 
-	subnetStr = ipNet.String()
-
-	bm, ok := p.m[subnetStr]
-	if !ok {
-		ones, _ := ipNet.Mask.Size()
-		validIPs := 1 << uint(32-ones)
-
-		bm = common.NewBitmap(validIPs)
-		p.m[subnetStr] = bm
+	bm := p.bitmap(ipNet)
+	start, end := usableRange(ipNet)
+	if ipRange != nil {
+		rangeOnes, _ := ipRange.Mask.Size()
+		subnetOnes, _ := ipNet.Mask.Size()
+		if !ipNet.Contains(ipRange.IP) || rangeOnes < subnetOnes {
+			return nil, fmt.Errorf("ip range %s is not in subnet %s", ipRange, ipNet)
+		}
+		rangeStart := offset(ipNet, ipRange.IP.Mask(ipRange.Mask))
+		rangeEnd := new(big.Int).Add(rangeStart, hostCount(ipRange))
+		rangeEnd.Sub(rangeEnd, big.NewInt(1))
+		if rangeStart.IsInt64() && rangeStart.Int64() > int64(start) {
+			start = int(rangeStart.Int64())
+		}
+		if rangeEnd.Cmp(big.NewInt(int64(end))) < 0 {
+			end = int(rangeEnd.Int64())
+		}
 	}
 
-	if bm.Ones() >= bm.Cap()-2 {
+	unsetPos := bm.GetFirstUnset(start)
+	if unsetPos == -1 || unsetPos > end {
 		return nil, errors.New("no available IP")
 	}
-
-	unsetPos := bm.GetFirstUnset(1)
 	_ = bm.Set(unsetPos) // no error
 
-	ip := ipNet.IP.To4() // 192.168.0.0
-	ip1Uint32 := uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
-	ip2Uint32 := uint32(unsetPos) // 0.0.0.2
+	ipNet.IP = ipAt(ipNet, unsetPos)
+	return ipNet, nil
+}
+
+// AllocateStaticIP allocate the given ip
+// ipNetStr: x.x.x.x/x
+func (p *IPPool) AllocateStaticIP(ipNetStr string) (ipNet *net.IPNet, err error) {
+	err = p.update(func() error {
+		available, err := p.isAvailable(ipNetStr)
+		if err != nil {
+			return err
+		}
+		if !available {
+			return fmt.Errorf("ip %s is not available", ipNetStr)
+		}
+		if err := p.setUsed(ipNetStr); err != nil {
+			return err
+		}
+		var ip net.IP
+		ip, ipNet, _ = net.ParseCIDR(ipNetStr)
+		ipNet.IP = normalize(ip)
+		return nil
+	})
+	return ipNet, err
+}
+
+// AllocateStickyIP allocate an ip for the owner, the last ip of the owner is handed back if it's in the subnet
+// subnetStr: x.x.x.x/x
+// ipRange: sub range of the subnet, nil means the whole subnet
+func (p *IPPool) AllocateStickyIP(owner, subnetStr string, ipRange *net.IPNet) (ipNet *net.IPNet, err error) {
+	err = p.update(func() error {
+		ipNet, err = p.allocateSticky(owner, subnetStr, ipRange)
+		return err
+	})
+	return ipNet, err
+}
+
+func (p *IPPool) allocateSticky(owner, subnetStr string, ipRange *net.IPNet) (*net.IPNet, error) {
+	_, subnet, err := net.ParseCIDR(subnetStr)
+	if err != nil {
+		return nil, err
+	}
+	if last, ok := p.sticky[owner]; ok {
+		ip, ipNet, err := net.ParseCIDR(last)
+		if err == nil && ipNet.String() == subnet.String() {
+			// the sticky ip is kept used after release
+			if err := p.setUsed(last); err != nil {
+				return nil, err
+			}
+			ipNet.IP = normalize(ip)
+			return ipNet, nil
+		}
+	}
+
+	ipNet, err := p.allocateInRange(subnetStr, ipRange)
+	if err != nil {
+		return nil, err
+	}
+	p.sticky[owner] = ipNet.String()
+	return ipNet, nil
+}
+
+// ReleaseSticky release the sticky ip of the owner
+func (p *IPPool) ReleaseSticky(owner string) error {
+	return p.update(func() error {
+		last, ok := p.sticky[owner]
+		if !ok {
+			return nil
+		}
+		delete(p.sticky, owner)
+		return p.releaseIP(last)
+	})
+}
 
-	ipUint32 := ip1Uint32 | ip2Uint32
-	ip[0] = byte(ipUint32 >> 24)
-	ip[1] = byte(ipUint32 >> 16)
-	ip[2] = byte(ipUint32 >> 8)
-	ip[3] = byte(ipUint32)
+// ReleaseSubnet release all ips of the subnet
+// subnetStr: x.x.x.x/x
+func (p *IPPool) ReleaseSubnet(subnetStr string) error {
+	return p.update(func() error {
+		_, ipNet, err := net.ParseCIDR(subnetStr)
+		if err != nil {
+			return err
+		}
+		delete(p.m, ipNet.String())
+		for owner, ipNetStr := range p.sticky {
+			if _, stickyNet, err := net.ParseCIDR(ipNetStr); err == nil && stickyNet.String() == ipNet.String() {
+				delete(p.sticky, owner)
+			}
+		}
+		return nil
+	})
+}
 
-	ipNet.IP = ip
-	return ipNet, p.save()
+// ResetUsed clear all subnets, then set the given ips and sticky ips to used
+// ipNetStrs: x.x.x.x/x
+func (p *IPPool) ResetUsed(ipNetStrs []string) error {
+	return p.update(func() error {
+		p.m = make(map[string]*common.Bitmap)
+		for _, ipNetStr := range p.sticky {
+			ipNetStrs = append(ipNetStrs, ipNetStr)
+		}
+		for _, ipNetStr := range ipNetStrs {
+			if err := p.setUsed(ipNetStr); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // ReleaseIPStr release an ip to the pool
 // ipNetStr: x.x.x.x/x
 func (p *IPPool) ReleaseIPStr(ipNetStr string) error {
-	if err := p.load(); err != nil {
-		return err
-	}
+	return p.update(func() error {
+		for _, sticky := range p.sticky {
+			if sticky == ipNetStr {
+				// released by ReleaseSticky
+				return nil
+			}
+		}
+		return p.releaseIP(ipNetStr)
+	})
+}
+
+func (p *IPPool) releaseIP(ipNetStr string) error {
 	//fmt.Println("[DEBUG ReleaseIPStr]", p.m)
 	ip, ipNet, err := net.ParseCIDR(ipNetStr)
 	if err != nil {
 		return err
 	}
-
-	ipNetStr = ipNet.String()
-	ip = ip.To4()
-
-	bm, ok := p.m[ipNetStr]
+	bm, ok := p.m[ipNet.String()]
 	if !ok {
 		return nil
 	}
-
-	// get ip pos
-	ones, _ := ipNet.Mask.Size()
-	ipUint32 := uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
-	pos := ipUint32 & ((1 << uint(32-ones)) - 1)
-
-	bm.Unset(int(pos))
-	return p.save()
+	pos, err := position(ipNet, ip)
+	if err != nil {
+		return err
+	}
+	bm.Unset(pos)
+	return nil
 }
 
 // ReleaseIP release an ip to the pool
@@ -125,66 +312,127 @@ func (p *IPPool) ReleaseIP(ipNet *net.IPNet) error {
 
 // IsAvailable check if an ip is available
 // ipNetStr: x.x.x.x/x
-func (p *IPPool) IsAvailable(ipNetStr string) (bool, error) {
-	if err := p.load(); err != nil {
-		return false, err
-	}
+func (p *IPPool) IsAvailable(ipNetStr string) (available bool, err error) {
+	err = p.view(func() error {
+		available, err = p.isAvailable(ipNetStr)
+		return err
+	})
+	return available, err
+}
+
+func (p *IPPool) isAvailable(ipNetStr string) (bool, error) {
 	//fmt.Println("[DEBUG IsAvailable]", p.m)
 	ip, ipNet, err := net.ParseCIDR(ipNetStr)
 	if err != nil {
 		return false, err
 	}
 
-	ipNetStr = ipNet.String()
-	ip = ip.To4()
-
-	// get ip pos
-	ones, _ := ipNet.Mask.Size()
-	ipUint32 := uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
-	pos := ipUint32 & ((1 << uint(32-ones)) - 1)
-	validIPs := 1 << uint(32-ones)
-	if pos == 0 || pos == uint32(validIPs-1) {
+	pos, err := position(ipNet, ip)
+	if err != nil {
+		return false, err
+	}
+	start, end := usableRange(ipNet)
+	if pos < start || pos > end {
 		return false, nil
 	}
 
-	bm, ok := p.m[ipNetStr]
+	bm, ok := p.m[ipNet.String()]
 	if !ok {
 		return true, nil
 	}
-	return !bm.Get(int(pos)), nil
+	return !bm.Get(pos), nil
 }
 
 // SetUsed set an ip to used
 // ipNetStr: x.x.x.x/x
 func (p *IPPool) SetUsed(ipNetStr string) error {
-	if err := p.load(); err != nil {
-		return err
-	}
+	return p.update(func() error {
+		return p.setUsed(ipNetStr)
+	})
+}
+
+func (p *IPPool) setUsed(ipNetStr string) error {
 	//fmt.Println("[DEBUG SetUsed]", p.m)
 	ip, ipNet, err := net.ParseCIDR(ipNetStr)
 	if err != nil {
 		return err
 	}
 
-	subnetStr := ipNet.String()
-	ip = ip.To4()
-	ones, _ := ipNet.Mask.Size()
+	pos, err := position(ipNet, ip)
+	if err != nil {
+		return err
+	}
+	return p.bitmap(ipNet).Set(pos)
+}
 
-	bm, ok := p.m[subnetStr]
+// bitmap get the bitmap of the subnet, create it if not exists
+func (p *IPPool) bitmap(subnet *net.IPNet) *common.Bitmap {
+	bm, ok := p.m[subnet.String()]
 	if !ok {
+		bm = common.NewBitmap(poolSize(subnet))
+		p.m[subnet.String()] = bm
+	}
+	return bm
+}
 
-		validIPs := 1 << uint(32-ones)
-		bm = common.NewBitmap(validIPs)
-		p.m[subnetStr] = bm
+// normalize ipv4 in 4 bytes, ipv6 in 16 bytes
+func normalize(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
 	}
+	return ip.To16()
+}
 
-	// get ip pos
-	ipUint32 := uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
-	pos := ipUint32 & ((1 << uint(32-ones)) - 1)
+// hostCount the number of addresses in the subnet
+func hostCount(subnet *net.IPNet) *big.Int {
+	ones, bits := subnet.Mask.Size()
+	return new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+}
 
-	if err = bm.Set(int(pos)); err != nil {
-		return err
+// poolSize the number of addresses covered by the subnet's bitmap
+func poolSize(subnet *net.IPNet) int {
+	ones, bits := subnet.Mask.Size()
+	if bits == 128 && bits-ones > MaxPoolBits {
+		return 1 << MaxPoolBits
 	}
-	//fmt.Println("[DEBUG SetUsed2]", p.m)
-	return p.save()
+	return 1 << uint(bits-ones)
+}
+
+// usableRange the positions which can be allocated:
+// skip the network address, and the broadcast address of ipv4
+func usableRange(subnet *net.IPNet) (int, int) {
+	end := poolSize(subnet) - 1
+	_, bits := subnet.Mask.Size()
+	if bits == 32 && big.NewInt(int64(poolSize(subnet))).Cmp(hostCount(subnet)) == 0 {
+		end--
+	}
+	return 1, end
+}
+
+// offset the offset of the ip in the subnet
+func offset(subnet *net.IPNet, ip net.IP) *big.Int {
+	n := new(big.Int).SetBytes(normalize(ip))
+	return n.Sub(n, new(big.Int).SetBytes(normalize(subnet.IP)))
+}
+
+// position the position of the ip in the subnet's bitmap
+func position(subnet *net.IPNet, ip net.IP) (int, error) {
+	if !subnet.Contains(ip) {
+		return 0, fmt.Errorf("ip %s is not in subnet %s", ip, subnet)
+	}
+	off := offset(subnet, ip)
+	if !off.IsInt64() || off.Int64() >= int64(poolSize(subnet)) {
+		return 0, fmt.Errorf("ip %s is outside the first %d addresses of subnet %s", ip, poolSize(subnet), subnet)
+	}
+	return int(off.Int64()), nil
+}
+
+// ipAt the ip at the position of the subnet
+func ipAt(subnet *net.IPNet, pos int) net.IP {
+	base := normalize(subnet.IP)
+	n := new(big.Int).SetBytes(base)
+	n.Add(n, big.NewInt(int64(pos)))
+	ip := make(net.IP, len(base))
+	n.FillBytes(ip)
+	return ip
 }
@@ -1,9 +1,17 @@
 package ippool
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"mini-container/common"
 	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
 )
 
@@ -140,4 +148,245 @@ func TestIPPoolRead(t *testing.T) {
 	assert.NoError(t, err)
 
 	os.RemoveAll("./ip_pool.json")
+	os.RemoveAll("./ip_pool.json.lock")
+}
+
+func TestAllocateIPInRange(t *testing.T) {
+	pool, err := New(filepath.Join(t.TempDir(), "ip_pool.json"))
+	assert.NoError(t, err)
+
+	_, ipRange, _ := net.ParseCIDR("10.10.0.128/30")
+	for _, want := range []string{"10.10.0.128/24", "10.10.0.129/24", "10.10.0.130/24", "10.10.0.131/24"} {
+		ip, err := pool.AllocateIPInRange("10.10.0.0/24", ipRange)
+		assert.NoError(t, err)
+		assert.Equal(t, want, ip.String())
+	}
+	_, err = pool.AllocateIPInRange("10.10.0.0/24", ipRange)
+	assert.Error(t, err)
+
+	// 范围之外的地址不受影响
+	ip, err := pool.AllocateIP("10.10.0.0/24")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.10.0.1/24", ip.String())
+
+	_, outside, _ := net.ParseCIDR("10.10.1.0/28")
+	_, err = pool.AllocateIPInRange("10.10.0.0/24", outside)
+	assert.Error(t, err)
+
+	assert.NoError(t, pool.ReleaseSubnet("10.10.0.0/24"))
+	ip, err = pool.AllocateIPInRange("10.10.0.0/24", ipRange)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.10.0.128/24", ip.String())
+}
+
+// TestLargeIPv4Subnet ipv4 子网大于 /16 时位图覆盖整个子网
+func TestLargeIPv4Subnet(t *testing.T) {
+	pool, err := New(filepath.Join(t.TempDir(), "ip_pool.json"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, pool.SetUsed("10.255.255.254/8"))
+	assert.Equal(t, 1<<24, pool.m["10.0.0.0/8"].Cap())
+
+	_, ipRange, _ := net.ParseCIDR("10.200.0.0/16")
+	ip, err := pool.AllocateIPInRange("10.0.0.0/8", ipRange)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.200.0.0/8", ip.String())
+
+	ip, err = pool.AllocateStaticIP("10.200.0.5/8")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.200.0.5/8", ip.String())
+	available, err := pool.IsAvailable("10.255.255.254/8")
+	assert.NoError(t, err)
+	assert.False(t, available)
+
+	// 广播地址不分配
+	_, last, _ := net.ParseCIDR("10.255.255.254/31")
+	ip, err = pool.AllocateIPInRange("10.0.0.0/8", last)
+	assert.Error(t, err, fmt.Sprint(ip))
+}
+
+func TestResetUsed(t *testing.T) {
+	pool, err := New(filepath.Join(t.TempDir(), "ip_pool.json"))
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := pool.AllocateIP("10.20.0.0/24")
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, pool.ResetUsed([]string{"10.20.0.1/24", "10.20.0.3/24"}))
+	ip, err := pool.AllocateIP("10.20.0.0/24")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.20.0.2/24", ip.String())
+	ip, err = pool.AllocateIP("10.20.0.0/24")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.20.0.4/24", ip.String())
+}
+
+func TestStaticAndStickyIP(t *testing.T) {
+	pool, err := New(filepath.Join(t.TempDir(), "ip_pool.json"))
+	assert.NoError(t, err)
+
+	ip, err := pool.AllocateStaticIP("10.30.0.50/24")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.30.0.50/24", ip.String())
+	_, err = pool.AllocateStaticIP("10.30.0.50/24")
+	assert.Error(t, err)
+	_, err = pool.AllocateStaticIP("10.30.0.255/24")
+	assert.Error(t, err)
+
+	ip, err = pool.AllocateStickyIP("web", "10.30.0.0/24", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.30.0.1/24", ip.String())
+
+	// 释放后仍然保留给 web
+	assert.NoError(t, pool.ReleaseIP(ip))
+	other, err := pool.AllocateIP("10.30.0.0/24")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.30.0.2/24", other.String())
+	ip, err = pool.AllocateStickyIP("web", "10.30.0.0/24", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.30.0.1/24", ip.String())
+
+	// 重新加载后仍然有效
+	pool, err = New(pool.path)
+	assert.NoError(t, err)
+	assert.NoError(t, pool.ResetUsed(nil))
+	available, err := pool.IsAvailable("10.30.0.1/24")
+	assert.NoError(t, err)
+	assert.False(t, available)
+
+	assert.NoError(t, pool.ReleaseSticky("web"))
+	available, err = pool.IsAvailable("10.30.0.1/24")
+	assert.NoError(t, err)
+	assert.True(t, available)
+}
+
+func TestLoadLegacyPoolFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip_pool.json")
+	legacy, err := New(path)
+	assert.NoError(t, err)
+	_, err = legacy.AllocateIP("10.40.0.0/24")
+	assert.NoError(t, err)
+	// 旧版本直接保存 subnet -> bitmap
+	assert.NoError(t, common.WriteJSONSync(path, legacy.m))
+
+	pool, err := New(path)
+	assert.NoError(t, err)
+	ip, err := pool.AllocateIP("10.40.0.0/24")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.40.0.2/24", ip.String())
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"subnets"`)
+}
+
+func TestIPv6Pool(t *testing.T) {
+	pool, err := New(filepath.Join(t.TempDir(), "ip_pool.json"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, pool.SetUsed("fd00:1::1/64"))
+	ip, err := pool.AllocateIP("fd00:1::/64")
+	assert.NoError(t, err)
+	assert.Equal(t, "fd00:1::2/64", ip.String())
+
+	_, ipRange, _ := net.ParseCIDR("fd00:1::100/120")
+	ip, err = pool.AllocateIPInRange("fd00:1::/64", ipRange)
+	assert.NoError(t, err)
+	assert.Equal(t, "fd00:1::100/64", ip.String())
+
+	// 只使用子网的前 2^MaxPoolBits 个地址
+	assert.Equal(t, 1<<MaxPoolBits, pool.m["fd00:1::/64"].Cap())
+	_, err = pool.AllocateStaticIP("fd00:1::1:0:0/64")
+	assert.Error(t, err)
+
+	assert.NoError(t, pool.ReleaseIPStr("fd00:1::2/64"))
+	available, err := pool.IsAvailable("fd00:1::2/64")
+	assert.NoError(t, err)
+	assert.True(t, available)
+
+	// ipv6 没有广播地址
+	_, small, _ := net.ParseCIDR("fd00:2::/126")
+	for _, want := range []string{"fd00:2::1/126", "fd00:2::2/126", "fd00:2::3/126"} {
+		ip, err := pool.AllocateIP(small.String())
+		assert.NoError(t, err)
+		assert.Equal(t, want, ip.String())
+	}
+}
+
+// the pool path and the number of ips for the helper process, see TestConcurrentAllocateHelper
+const (
+	hammerEnv      = "IPPOOL_HAMMER_PATH"
+	hammerCountEnv = "IPPOOL_HAMMER_COUNT"
+)
+
+// TestConcurrentAllocate allocates ips from many processes at the same time,
+// every ip must be handed out only once
+func TestConcurrentAllocate(t *testing.T) {
+	const procs, perProc = 8, 25
+	path := filepath.Join(t.TempDir(), "ip_pool.json")
+
+	var wg sync.WaitGroup
+	results := make([][]string, procs)
+	errs := make([]error, procs)
+	for i := 0; i < procs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cmd := exec.Command(os.Args[0], "-test.run=^TestConcurrentAllocateHelper$")
+			cmd.Env = append(os.Environ(), hammerEnv+"="+path, hammerCountEnv+"="+strconv.Itoa(perProc))
+			out, err := cmd.Output()
+			if err != nil {
+				errs[i] = fmt.Errorf("helper %d: %v", i, err)
+				return
+			}
+			scanner := bufio.NewScanner(bytes.NewReader(out))
+			for scanner.Scan() {
+				if line := scanner.Text(); len(line) > 3 && line[:3] == "ip=" {
+					results[i] = append(results[i], line[3:])
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for i := 0; i < procs; i++ {
+		assert.NoError(t, errs[i])
+		assert.Len(t, results[i], perProc)
+		for _, ip := range results[i] {
+			assert.False(t, seen[ip], "duplicate ip %s", ip)
+			seen[ip] = true
+		}
+	}
+	assert.Len(t, seen, procs*perProc)
+
+	// the pool file agrees with the handed out ips
+	pool, err := New(path)
+	assert.NoError(t, err)
+	for ip := range seen {
+		available, err := pool.IsAvailable(ip)
+		assert.NoError(t, err)
+		assert.False(t, available, ip)
+	}
+}
+
+// TestConcurrentAllocateHelper runs in the helper processes of TestConcurrentAllocate
+func TestConcurrentAllocateHelper(t *testing.T) {
+	path := os.Getenv(hammerEnv)
+	if path == "" {
+		t.Skip("helper process of TestConcurrentAllocate")
+	}
+	count, _ := strconv.Atoi(os.Getenv(hammerCountEnv))
+	pool, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		ip, err := pool.AllocateIP("10.10.0.0/23")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Printf("ip=%s\n", ip)
+	}
 }
@@ -0,0 +1,180 @@
+package iptables
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const (
+	TableNat    = "nat"
+	TableFilter = "filter"
+
+	// CommentPrefix mini-container 添加的规则都带有该前缀的注释，删除时据此识别，不会误删其他程序的规则
+	CommentPrefix = "mini-container"
+)
+
+// Comment 规则的注释参数
+// owner: 规则所属的对象，例如网桥名，为空表示全局规则
+func Comment(owner string) []string {
+	comment := CommentPrefix
+	if owner != "" {
+		comment += ":" + owner
+	}
+	return []string{"-m", "comment", "--comment", comment}
+}
+
+// IPTables iptables 命令的封装，所有添加/删除规则的操作都是幂等的
+type IPTables struct {
+	bin string
+}
+
+var (
+	IPv4 = &IPTables{bin: "iptables"}
+	IPv6 = &IPTables{bin: "ip6tables"}
+)
+
+func (ipt *IPTables) run(args ...string) ([]byte, error) {
+	// -w 等待 xtables 锁，避免和其他进程同时修改规则时直接失败
+	output, err := exec.Command(ipt.bin, append([]string{"-w"}, args...)...).CombinedOutput()
+	if err != nil {
+		return output, fmt.Errorf("%s %s fail err=%s output=%s",
+			ipt.bin, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return output, nil
+}
+
+// Exists 判断规则是否存在
+func (ipt *IPTables) Exists(table, chain string, rule ...string) bool {
+	_, err := ipt.run(append([]string{"-t", table, "-C", chain}, rule...)...)
+	return err == nil
+}
+
+// Append 在链的末尾添加规则，规则已存在时不重复添加
+func (ipt *IPTables) Append(table, chain string, rule ...string) error {
+	if ipt.Exists(table, chain, rule...) {
+		return nil
+	}
+	_, err := ipt.run(append([]string{"-t", table, "-A", chain}, rule...)...)
+	return err
+}
+
+// Insert 在链的开头插入规则，规则已存在时不重复添加
+func (ipt *IPTables) Insert(table, chain string, rule ...string) error {
+	if ipt.Exists(table, chain, rule...) {
+		return nil
+	}
+	_, err := ipt.run(append([]string{"-t", table, "-I", chain, "1"}, rule...)...)
+	return err
+}
+
+// Delete 删除规则，规则不存在时忽略
+func (ipt *IPTables) Delete(table, chain string, rule ...string) error {
+	if !ipt.Exists(table, chain, rule...) {
+		return nil
+	}
+	_, err := ipt.run(append([]string{"-t", table, "-D", chain}, rule...)...)
+	return err
+}
+
+// Restore 通过 iptables-restore --noflush 原子地提交对一个表的修改，要么全部生效，要么都不生效
+// lines: iptables-restore 格式的行，其中 ":<chain> - [0:0]" 创建并清空自定义链，未提到的链不受影响
+func (ipt *IPTables) Restore(table string, lines []string) error {
+	input := "*" + table + "\n" + strings.Join(lines, "\n") + "\nCOMMIT\n"
+	cmd := exec.Command(ipt.bin+"-restore", "-w", "--noflush")
+	cmd.Stdin = strings.NewReader(input)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s-restore fail err=%s output=%s input=%q",
+			ipt.bin, err, strings.TrimSpace(string(output)), input)
+	}
+	return nil
+}
+
+// ExistsChain 判断自定义链是否存在
+func (ipt *IPTables) ExistsChain(table, chain string) bool {
+	_, err := ipt.run("-t", table, "-n", "-L", chain)
+	return err == nil
+}
+
+// EnsureChain 创建自定义链，已存在时忽略
+func (ipt *IPTables) EnsureChain(table, chain string) error {
+	if ipt.ExistsChain(table, chain) {
+		return nil
+	}
+	_, err := ipt.run("-t", table, "-N", chain)
+	return err
+}
+
+// DeleteChain 清空并删除自定义链，不存在时忽略
+// 注意：删除前需要先删除所有跳转到该链的规则
+func (ipt *IPTables) DeleteChain(table, chain string) error {
+	if !ipt.ExistsChain(table, chain) {
+		return nil
+	}
+	if _, err := ipt.run("-t", table, "-F", chain); err != nil {
+		return err
+	}
+	_, err := ipt.run("-t", table, "-X", chain)
+	return err
+}
+
+// Available 判断命令是否存在，宿主机可能没有安装 ip6tables
+func (ipt *IPTables) Available() bool {
+	_, err := exec.LookPath(ipt.bin)
+	return err == nil
+}
+
+// List 表中的所有规则，iptables -S 格式
+func (ipt *IPTables) List(table string) ([]string, error) {
+	output, err := ipt.run("-t", table, "-S")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSpace(string(output)), "\n"), nil
+}
+
+// DeleteByComment 删除表中注释属于 owner 的所有规则，owner 为空时删除 mini-container 添加的所有规则
+func (ipt *IPTables) DeleteByComment(table, owner string) error {
+	lines, err := ipt.List(table)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "-A" || !matchComment(fields, owner) {
+			continue
+		}
+		for i := range fields {
+			fields[i] = strings.Trim(fields[i], `"`)
+		}
+		fields[0] = "-D"
+		if _, err := ipt.run(append([]string{"-t", table}, fields...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchComment 判断 iptables -S 输出的一条规则是否带有 owner 的注释
+func matchComment(fields []string, owner string) bool {
+	commentOwner, ok := CommentOwner(fields)
+	return ok && (owner == "" || commentOwner == owner)
+}
+
+// CommentOwner iptables -S 输出的一条规则的注释中的 owner，ok 为 false 表示不是 mini-container 添加的规则
+func CommentOwner(fields []string) (owner string, ok bool) {
+	for i := 0; i < len(fields)-1; i++ {
+		if fields[i] != "--comment" {
+			continue
+		}
+		comment := strings.Trim(fields[i+1], `"`)
+		if comment == CommentPrefix {
+			return "", true
+		}
+		if owner, ok := strings.CutPrefix(comment, CommentPrefix+":"); ok {
+			return owner, true
+		}
+		return "", false
+	}
+	return "", false
+}
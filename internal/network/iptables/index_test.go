@@ -0,0 +1,37 @@
+package iptables
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestMatchComment(t *testing.T) {
+	rule := func(s string) []string { return strings.Fields(s) }
+
+	bridgeRule := rule(`-A POSTROUTING -s 192.172.0.0/24 ! -o mini-ctr0 -m comment --comment "mini-container:mini-ctr0" -j MASQUERADE`)
+	globalRule := rule(`-A PREROUTING -m addrtype --dst-type LOCAL -m comment --comment mini-container -j MINI-CONTAINER`)
+	otherRule := rule(`-A POSTROUTING -s 172.17.0.0/16 ! -o docker0 -j MASQUERADE`)
+	similarRule := rule(`-A POSTROUTING -m comment --comment mini-container-foo -j ACCEPT`)
+
+	assert.True(t, matchComment(bridgeRule, "mini-ctr0"))
+	assert.False(t, matchComment(bridgeRule, "mc-test"))
+	assert.True(t, matchComment(bridgeRule, ""))
+	assert.True(t, matchComment(globalRule, ""))
+	assert.False(t, matchComment(globalRule, "mini-ctr0"))
+	assert.False(t, matchComment(otherRule, ""))
+	assert.False(t, matchComment(similarRule, ""))
+}
+
+func TestCommentOwner(t *testing.T) {
+	owner, ok := CommentOwner(strings.Fields(`-A FORWARD -i mc-web -m comment --comment "mini-container:mc-web" -j ACCEPT`))
+	assert.True(t, ok)
+	assert.Equal(t, "mc-web", owner)
+
+	owner, ok = CommentOwner(strings.Fields(`-A OUTPUT -m comment --comment mini-container -j MINI-CONTAINER`))
+	assert.True(t, ok)
+	assert.Equal(t, "", owner)
+
+	_, ok = CommentOwner(strings.Fields(`-A FORWARD -m comment --comment other -j ACCEPT`))
+	assert.False(t, ok)
+}
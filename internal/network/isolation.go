@@ -0,0 +1,180 @@
+package network
+
+import (
+	"fmt"
+	"mini-container/common"
+	"mini-container/config"
+	"mini-container/internal/network/firewall"
+	"os"
+	"strings"
+)
+
+// 不同网络中的容器默认不能互相访问，内部网络（--internal）也不能访问外网，
+// network allow 添加的放行规则除外，规则的实现见 firewall 包
+// 隔离规则由所有网络和放行规则生成，每次变化时整体原子替换
+
+// AllowRule 允许 From 网络中的容器访问 To 网络中的容器
+type AllowRule struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Port     int    `json:"port"`     // 为0时放行所有端口
+	Protocol string `json:"protocol"` // tcp/udp，Port 为0时为空
+}
+
+func (r *AllowRule) String() string {
+	if r.Port == 0 {
+		return r.From + " -> " + r.To
+	}
+	return fmt.Sprintf("%s -> %s %d/%s", r.From, r.To, r.Port, r.Protocol)
+}
+
+func (r *AllowRule) Equal(other *AllowRule) bool {
+	return *r == *other
+}
+
+// NewAllowRule 检查网络存在并解析端口，格式：port[/tcp|udp]，为空时放行所有端口
+func NewAllowRule(from, to, portSpec string) (*AllowRule, error) {
+	r := &AllowRule{From: from, To: to}
+	for _, name := range []*string{&r.From, &r.To} {
+		n, err := GetNetwork(*name)
+		if err != nil {
+			return nil, err
+		}
+		if !n.IsBridge() {
+			return nil, fmt.Errorf("network %s uses the %s driver, only bridge networks are isolated", n.Name, n.Driver)
+		}
+		*name = n.Name
+	}
+	if r.From == r.To {
+		return nil, fmt.Errorf("containers in the same network can always reach each other")
+	}
+	if portSpec == "" {
+		return r, nil
+	}
+	port, protocol, _ := strings.Cut(portSpec, "/")
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	if protocol != "tcp" && protocol != "udp" {
+		return nil, fmt.Errorf("invalid protocol %q, must be tcp or udp", protocol)
+	}
+	var err error
+	if r.Port, err = parsePort(port); err != nil {
+		return nil, err
+	}
+	r.Protocol = protocol
+	return r, nil
+}
+
+// ListAllowRules 列出放行规则
+func ListAllowRules() ([]*AllowRule, error) {
+	rules := make([]*AllowRule, 0)
+	if err := common.ReadJSON(config.NetworkAllowRulesPath, &rules); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// AddAllowRule 添加放行规则并更新隔离规则
+func AddAllowRule(r *AllowRule) error {
+	return updateIsolation(func(rules []*AllowRule) ([]*AllowRule, error) {
+		for _, other := range rules {
+			if other.Equal(r) {
+				return nil, fmt.Errorf("rule %s already exists", r)
+			}
+		}
+		return append(rules, r), nil
+	})
+}
+
+// RemoveAllowRule 删除放行规则并更新隔离规则
+func RemoveAllowRule(r *AllowRule) error {
+	return updateIsolation(func(rules []*AllowRule) ([]*AllowRule, error) {
+		for i, other := range rules {
+			if other.Equal(r) {
+				return append(rules[:i], rules[i+1:]...), nil
+			}
+		}
+		return nil, fmt.Errorf("rule %s not found", r)
+	})
+}
+
+// removeAllowRulesOf 删除网络的所有放行规则，用于删除网络
+func removeAllowRulesOf(name string) error {
+	return updateIsolation(func(rules []*AllowRule) ([]*AllowRule, error) {
+		kept := make([]*AllowRule, 0, len(rules))
+		for _, r := range rules {
+			if r.From != name && r.To != name {
+				kept = append(kept, r)
+			}
+		}
+		return kept, nil
+	})
+}
+
+// SyncIsolation 按所有网络和放行规则重新生成隔离规则
+func SyncIsolation() error {
+	return updateIsolation(nil)
+}
+
+// updateIsolation 修改放行规则（update 为 nil 时不修改），并重新生成隔离规则
+// 加锁避免多个进程同时修改，规则提交失败时不保存放行规则
+func updateIsolation(update func([]*AllowRule) ([]*AllowRule, error)) error {
+	return common.WithFileLock(config.NetworkAllowRulesPath+".lock", common.DefaultLockTimeout, func() error {
+		rules, err := ListAllowRules()
+		if err != nil {
+			return err
+		}
+		if update != nil {
+			if rules, err = update(rules); err != nil {
+				return err
+			}
+		}
+		networks, err := ListNetworks()
+		if err != nil {
+			return err
+		}
+		if err := applyIsolation(networks, rules); err != nil {
+			return err
+		}
+		if update == nil {
+			return nil
+		}
+		return common.WriteJSONSync(config.NetworkAllowRulesPath, rules)
+	})
+}
+
+// applyIsolation 提交隔离规则
+func applyIsolation(networks []*Network, rules []*AllowRule) error {
+	fw, err := firewall.Default()
+	if err != nil {
+		return err
+	}
+	return fw.SetIsolation(isolationOf(networks, rules))
+}
+
+// isolationOf 生成防火墙的隔离规则，放行规则中的网络已经不存在时跳过
+// macvlan/ipvlan 网络的流量不经过宿主机的防火墙，不参与隔离
+func isolationOf(networks []*Network, rules []*AllowRule) *firewall.Isolation {
+	iso := &firewall.Isolation{}
+	bridges := make(map[string]string, len(networks))
+	for _, n := range networks {
+		if !n.IsBridge() {
+			continue
+		}
+		bridges[n.Name] = n.Bridge.Name
+		iso.Bridges = append(iso.Bridges, n.Bridge.Name)
+		if n.Internal {
+			iso.Internal = append(iso.Internal, n.Bridge.Name)
+		}
+		iso.IPv6 = iso.IPv6 || n.Gateway6() != nil
+	}
+	for _, r := range rules {
+		from, to := bridges[r.From], bridges[r.To]
+		if from == "" || to == "" {
+			continue
+		}
+		iso.Allows = append(iso.Allows, &firewall.Allow{From: from, To: to, Port: r.Port, Protocol: r.Protocol})
+	}
+	return iso
+}
@@ -0,0 +1,38 @@
+package network
+
+import (
+	"github.com/stretchr/testify/assert"
+	"mini-container/internal/network/bridge"
+	"mini-container/internal/network/firewall"
+	"testing"
+)
+
+func TestIsolationOf(t *testing.T) {
+	networks := []*Network{
+		{Name: "bridge", Bridge: &bridge.BridgeConfig{Name: "mini-ctr0"}},
+		{Name: "web", Bridge: &bridge.BridgeConfig{Name: "mc-web"}},
+		{Name: "db", Bridge: &bridge.BridgeConfig{Name: "mc-db"}, Internal: true},
+		// macvlan 网络不参与隔离
+		{Name: "lan", Driver: DriverMacvlan, Parent: "eth0", Bridge: &bridge.BridgeConfig{}},
+	}
+	rules := []*AllowRule{
+		{From: "web", To: "db", Port: 5432, Protocol: "tcp"},
+		{From: "gone", To: "db"},
+		{From: "lan", To: "db"},
+	}
+	assert.Equal(t, &firewall.Isolation{
+		Bridges:  []string{"mini-ctr0", "mc-web", "mc-db"},
+		Internal: []string{"mc-db"},
+		Allows:   []*firewall.Allow{{From: "mc-web", To: "mc-db", Port: 5432, Protocol: "tcp"}},
+	}, isolationOf(networks, rules))
+}
+
+func TestNewAllowRule(t *testing.T) {
+	_, err := NewAllowRule("bridge", "bridge", "")
+	assert.Error(t, err)
+	_, err = NewAllowRule("bridge", "not-exists", "")
+	assert.Error(t, err)
+
+	assert.Equal(t, "web -> db 5432/tcp", (&AllowRule{From: "web", To: "db", Port: 5432, Protocol: "tcp"}).String())
+	assert.Equal(t, "web -> db", (&AllowRule{From: "web", To: "db"}).String())
+}
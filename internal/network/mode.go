@@ -0,0 +1,62 @@
+package network
+
+import (
+	"mini-container/internal/network/bridge"
+	"strings"
+)
+
+// 容器的网络模式，即 --network 的取值：
+//  - <network name>：独立的 network namespace，通过 veth 连接到网络的网桥，默认为 bridge
+//  - host：使用宿主机的 network namespace，不做任何网络配置
+//  - none：独立的 network namespace，只有回环网卡
+//  - container:<name>：加入另一个运行中的容器的 network namespace
+//  - cni:<name>：独立的 network namespace，由 CNI 配置目录中名为 name 的网络配置执行插件完成配置
+
+const (
+	ModeHost            = "host"
+	ModeNone            = "none"
+	ModeContainerPrefix = "container:"
+	ModeCNIPrefix       = "cni:"
+)
+
+// IsHostMode 使用宿主机网络
+func IsHostMode(mode string) bool {
+	return mode == ModeHost
+}
+
+// IsNoneMode 没有网络
+func IsNoneMode(mode string) bool {
+	return mode == ModeNone
+}
+
+// SharedContainer container:<name> 模式中共享网络的容器名，其他模式返回空字符串
+func SharedContainer(mode string) string {
+	if !strings.HasPrefix(mode, ModeContainerPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(mode, ModeContainerPrefix)
+}
+
+// CNINetwork cni:<name> 模式中的 CNI 网络名，其他模式返回空字符串
+func CNINetwork(mode string) string {
+	if !strings.HasPrefix(mode, ModeCNIPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(mode, ModeCNIPrefix)
+}
+
+// IsBridgeMode 连接到网络的网桥
+func IsBridgeMode(mode string) bool {
+	return !IsHostMode(mode) && !IsNoneMode(mode) &&
+		!strings.HasPrefix(mode, ModeContainerPrefix) && !strings.HasPrefix(mode, ModeCNIPrefix)
+}
+
+// ConfigNoneNetworkForContainer none 模式只需要启用容器的回环网卡
+func ConfigNoneNetworkForContainer(netnsPath string) error {
+	return bridge.SetLoopbackUp(netnsPath)
+}
+
+// JoinNetworkNameSpace 当前线程加入 netnsPath 的 network namespace，用于容器自己的 namespace 和 container 模式
+func JoinNetworkNameSpace(netnsPath string) error {
+	return bridge.JoinNetworkNameSpace(netnsPath)
+}
@@ -0,0 +1,28 @@
+package network
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNetworkMode(t *testing.T) {
+	assert.True(t, IsBridgeMode("bridge"))
+	assert.True(t, IsBridgeMode("mynet"))
+	assert.False(t, IsBridgeMode("host"))
+	assert.False(t, IsBridgeMode("none"))
+	assert.False(t, IsBridgeMode("container:web"))
+	assert.False(t, IsBridgeMode("cni:mynet"))
+
+	assert.True(t, IsHostMode("host"))
+	assert.True(t, IsNoneMode("none"))
+	assert.Equal(t, "web", SharedContainer("container:web"))
+	assert.Equal(t, "", SharedContainer("mynet"))
+	assert.Equal(t, "mynet", CNINetwork("cni:mynet"))
+	assert.Equal(t, "", CNINetwork("mynet"))
+
+	assert.Equal(t, "/var/run/netns/mc-web", NetNSPath("web"))
+	assert.Equal(t, "/proc/10/ns/net", ProcNetNSPath(10))
+
+	_, err := CreateNetwork("host", &CreateOptions{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,38 @@
+package network
+
+import (
+	"fmt"
+	"mini-container/config"
+	"mini-container/internal/network/bridge"
+	"path/filepath"
+)
+
+// 容器的 network namespace 由 parent 在启动 child 之前创建，bind mount 到 /var/run/netns/mc-<container name>，
+// child 启动后加入该 namespace；容器停止时删除：
+//  - 网络的配置和释放不依赖容器进程，进程退出后仍然可以访问 namespace 中的网卡
+//  - 可以通过 ip netns exec mc-<container name> ... 等标准工具调试容器的网络
+// host 模式和 container 模式没有自己的 namespace
+
+// netnsPrefix 句柄的文件名前缀，避免与其他程序创建的 namespace 重名
+const netnsPrefix = "mc-"
+
+// NetNSPath 容器 network namespace 的句柄
+func NetNSPath(containerName string) string {
+	return filepath.Join(config.NetNSDir, netnsPrefix+containerName)
+}
+
+// ProcNetNSPath 进程 pid 的 network namespace，旧版本启动的容器没有句柄，使用该路径
+func ProcNetNSPath(pid int) string {
+	return fmt.Sprintf("/proc/%d/ns/net", pid)
+}
+
+// CreateNetworkNameSpace 创建容器的 network namespace，返回句柄的路径
+func CreateNetworkNameSpace(containerName string) (string, error) {
+	path := NetNSPath(containerName)
+	return path, bridge.CreateNetworkNameSpace(path)
+}
+
+// DeleteNetworkNameSpace 删除 CreateNetworkNameSpace 创建的句柄，不存在时忽略
+func DeleteNetworkNameSpace(netnsPath string) error {
+	return bridge.DeleteNetworkNameSpace(netnsPath)
+}
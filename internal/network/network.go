@@ -0,0 +1,536 @@
+package network
+
+import (
+	"crypto/rand"
+	"fmt"
+	"mini-container/common"
+	"mini-container/config"
+	"mini-container/internal/network/bridge"
+	"mini-container/internal/network/firewall"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 用户自定义网络保存在：
+// ~/.mini-container/networks/<network name>.json
+// 默认网络 bridge 由 config 中的常量描述，不保存在磁盘上
+
+var networkNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// 未指定 --subnet 时，从 192.172.1.0/24 开始依次查找未被占用的子网
+const autoSubnetFormat = "192.172.%d.0/24"
+
+// 未指定 --subnet6 时，随机生成 fdxx:xxxx:xxxx::/64 的唯一本地地址（ULA，RFC 4193）
+const autoSubnet6Ones = 64
+
+type Network struct {
+	Name   string `json:"name"`
+	Driver string `json:"driver"` // 网络驱动，见 Driver，为空时为 bridge（旧版本的网络）
+	// Bridge 网络的子网和网关，bridge 驱动同时是网桥设备的配置；
+	// macvlan/ipvlan 驱动时 Name 为空，子网和网关为 parent 所在的物理网络
+	Bridge     *bridge.BridgeConfig `json:"bridge"`
+	Parent     string               `json:"parent"`     // macvlan/ipvlan 子接口所在的宿主机网卡
+	IPVlanMode string               `json:"ipvlanMode"` // ipvlan 的模式，l2 或 l3
+	IPRange    *net.IPNet           `json:"ipRange"`    // 容器地址的分配范围，为 nil 时使用整个子网
+	Internal   bool                 `json:"internal"`   // 内部网络，不设置SNAT和默认路由，容器无法访问外网
+	CreatedAt  time.Time            `json:"createdAt"`
+}
+
+// CreateOptions network create 的参数，字符串为空时使用默认值
+type CreateOptions struct {
+	Subnet   string // x.x.x.x/x
+	Gateway  string // x.x.x.x，默认为子网的第一个地址
+	IPRange  string // x.x.x.x/x，必须在子网内
+	Bridge   string // 网桥设备名，默认为 mc-<network name>
+	MTU      int
+	Internal bool
+	IPv6     bool   // 启用 IPv6，指定 Subnet6 时自动启用
+	Subnet6  string // xxxx::/x，默认随机生成 /64 的 ULA 子网
+	Gateway6 string // xxxx::x，默认为子网的第一个地址
+	// macvlan/ipvlan 驱动的参数，子网为 parent 所在的物理网络，必须指定
+	Driver     string // bridge、macvlan 或 ipvlan，默认为 bridge
+	Parent     string // 宿主机网卡
+	IPVlanMode string // l2 或 l3，默认为 l2
+}
+
+// ValidNetworkName 判断是否为合法的网络名
+func ValidNetworkName(name string) bool {
+	return networkNameRegexp.MatchString(name)
+}
+
+func (n *Network) IsDefault() bool {
+	return n.Name == config.DefaultNetworkName
+}
+
+// DriverName 网络驱动名
+func (n *Network) DriverName() string {
+	if n.Driver == "" {
+		return DriverBridge
+	}
+	return n.Driver
+}
+
+// IsBridge 是否使用 bridge 驱动，只有 bridge 网络支持端口映射、内置 DNS、网络之间的隔离和限速
+func (n *Network) IsBridge() bool {
+	return n.DriverName() == DriverBridge
+}
+
+// Device 网络在宿主机上的设备：bridge 驱动为网桥，macvlan/ipvlan 驱动为 parent 网卡
+func (n *Network) Device() string {
+	if n.IsBridge() {
+		return n.Bridge.Name
+	}
+	return n.Parent
+}
+
+// deviceRoute 容器的默认路由是否直接经过网卡，ipvlan l3 模式的子接口不处理 ARP，不能经过网关
+func (n *Network) deviceRoute() bool {
+	return n.DriverName() == DriverIPVlan && n.IPVlanMode == bridge.IPVlanModeL3
+}
+
+func (n *Network) Subnet() *net.IPNet {
+	return n.Bridge.Subnet
+}
+
+// Gateway 网桥的地址，x.x.x.x/x
+func (n *Network) Gateway() *net.IPNet {
+	return n.Bridge.IPNet
+}
+
+// Subnet6 IPv6 子网，未启用 IPv6 时为 nil
+func (n *Network) Subnet6() *net.IPNet {
+	return n.Bridge.Subnet6
+}
+
+// Gateway6 网桥的 IPv6 地址，未启用 IPv6 时为 nil
+func (n *Network) Gateway6() *net.IPNet {
+	return n.Bridge.IPNet6
+}
+
+func (n *Network) path() string {
+	return filepath.Join(config.NetworkDir, n.Name+".json")
+}
+
+func (n *Network) Save() error {
+	return common.WriteJSONSync(n.path(), n)
+}
+
+// Ensure 检查并修复网络在宿主机上的配置，可以重复调用，见各个驱动的 Ensure，并在IP池中保留网关地址
+func (n *Network) Ensure() error {
+	d, err := GetDriver(n.Driver)
+	if err != nil {
+		return err
+	}
+	errs := []error{IPPool.SetUsed(n.Gateway().String())}
+	if n.Gateway6() != nil {
+		errs = append(errs, IPPool.SetUsed(n.Gateway6().String()))
+	}
+	errs = append(errs, d.Ensure(n))
+	return common.Err(common.ErrGroup(errs...))
+}
+
+// Release 删除网络在宿主机上的配置，见各个驱动的 Release
+func (n *Network) Release() error {
+	d, err := GetDriver(n.Driver)
+	if err != nil {
+		return err
+	}
+	return d.Release(n)
+}
+
+// ensureFirewall 添加网桥的 FORWARD 规则，非内部网络添加 SNAT 规则
+func (n *Network) ensureFirewall() error {
+	fw, err := firewall.Default()
+	if err != nil {
+		return err
+	}
+	b := &firewall.Bridge{Name: n.Bridge.Name, Subnets: []*net.IPNet{n.Subnet()}, External: !n.Internal}
+	if n.Subnet6() != nil {
+		b.Subnets = append(b.Subnets, n.Subnet6())
+	}
+	return fw.EnsureBridge(b)
+}
+
+// DefaultNetwork 默认网络
+func DefaultNetwork() *Network {
+	gateway, _ := bridge.ParseIPNet(config.DefaultBridgeIPNet)
+	_, subnet, _ := net.ParseCIDR(config.DefaultBridgeIPNet)
+	return &Network{
+		Name: config.DefaultNetworkName,
+		Bridge: &bridge.BridgeConfig{
+			Name:   config.DefaultBridgeName,
+			IPNet:  gateway,
+			Subnet: subnet,
+		},
+	}
+}
+
+// GetNetwork 读取网络，name 为空时返回默认网络
+func GetNetwork(name string) (*Network, error) {
+	if name == "" || name == config.DefaultNetworkName {
+		return DefaultNetwork(), nil
+	}
+	if !ValidNetworkName(name) {
+		return nil, fmt.Errorf("invalid network name %q", name)
+	}
+	n := &Network{Name: name}
+	if err := common.ReadJSON(n.path(), n); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("network %s not found", name)
+		}
+		return nil, err
+	}
+	return n, nil
+}
+
+// ListNetworks 列出所有网络，默认网络在最前面
+func ListNetworks() ([]*Network, error) {
+	networks := []*Network{DefaultNetwork()}
+	entries, err := os.ReadDir(config.NetworkDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return networks, nil
+		}
+		return networks, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, strings.TrimSuffix(e.Name(), ".json"))
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		n, err := GetNetwork(name)
+		if err != nil {
+			return networks, err
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// CreateNetwork 创建网络：检查子网和网桥名没有被占用，创建网桥（macvlan/ipvlan 检查 parent 网卡），在IP池中保留网关地址
+func CreateNetwork(name string, opts *CreateOptions) (*Network, error) {
+	if !ValidNetworkName(name) {
+		return nil, fmt.Errorf("invalid network name %q", name)
+	}
+	if name == config.DefaultNetworkName || !IsBridgeMode(name) {
+		return nil, fmt.Errorf("network %s is reserved", name)
+	}
+	existing, err := ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range existing {
+		if n.Name == name {
+			return nil, fmt.Errorf("network %s already exists", name)
+		}
+	}
+
+	d, err := GetDriver(opts.Driver)
+	if err != nil {
+		return nil, err
+	}
+	if opts.MTU < 0 || (opts.MTU > 0 && opts.MTU < 68) {
+		return nil, fmt.Errorf("invalid mtu %d", opts.MTU)
+	}
+	n := &Network{
+		Name:      name,
+		Driver:    d.Name(),
+		Internal:  opts.Internal,
+		CreatedAt: time.Now(),
+	}
+	if n.IsBridge() {
+		if opts.Parent != "" || opts.IPVlanMode != "" {
+			return nil, fmt.Errorf("--parent and --ipvlan-mode can only be used with --driver %s or %s", DriverMacvlan, DriverIPVlan)
+		}
+		n.Bridge, err = newBridgeConfig(name, opts, existing)
+	} else {
+		err = n.setSubInterfaceConfig(opts, existing)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if opts.IPRange != "" {
+		_, n.IPRange, err = net.ParseCIDR(opts.IPRange)
+		if err != nil || n.IPRange.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid ip range %q", opts.IPRange)
+		}
+		rangeOnes, _ := n.IPRange.Mask.Size()
+		subnetOnes, _ := n.Subnet().Mask.Size()
+		if !n.Subnet().Contains(n.IPRange.IP) || rangeOnes < subnetOnes {
+			return nil, fmt.Errorf("ip range %s is not in subnet %s", n.IPRange, n.Subnet())
+		}
+	}
+
+	if err = d.Create(n); err != nil {
+		n.Release()
+		return nil, err
+	}
+	errs := []error{IPPool.SetUsed(n.Gateway().String())}
+	if n.Gateway6() != nil {
+		errs = append(errs, IPPool.SetUsed(n.Gateway6().String()))
+	}
+	errs = append(errs, os.MkdirAll(config.NetworkDir, 0755), n.Save())
+	if err = common.Err(common.ErrGroup(errs...)); err == nil {
+		// 网络保存后才会出现在隔离规则中
+		err = SyncIsolation()
+	}
+	if err != nil {
+		n.Release()
+		n.releaseSubnets()
+		os.Remove(n.path())
+		return nil, err
+	}
+	return n, nil
+}
+
+// newBridgeConfig 根据参数生成网桥配置，子网不能和已有网络以及宿主机的地址重叠
+func newBridgeConfig(name string, opts *CreateOptions, existing []*Network) (*bridge.BridgeConfig, error) {
+	bc := &bridge.BridgeConfig{Name: opts.Bridge, MTU: opts.MTU}
+	if bc.Name == "" {
+		bc.Name = "mc-" + name
+	}
+	if len(bc.Name) > 15 {
+		return nil, fmt.Errorf("bridge name %q is longer than 15 characters, use --bridge to specify one", bc.Name)
+	}
+	for _, n := range existing {
+		if n.Bridge.Name == bc.Name {
+			return nil, fmt.Errorf("bridge %s is used by network %s", bc.Name, n.Name)
+		}
+	}
+	if bridge.ExistsBridge(bc.Name) {
+		return nil, fmt.Errorf("device %s already exists", bc.Name)
+	}
+
+	hostNets := hostIPNets()
+	overlapped := func(subnet *net.IPNet) error {
+		if err := overlappedNetwork(subnet, existing); err != nil {
+			return err
+		}
+		for _, hn := range hostNets {
+			if overlaps(subnet, hn) {
+				return fmt.Errorf("subnet %s overlaps with host address %s", subnet, hn)
+			}
+		}
+		return nil
+	}
+	return bc, setAddresses(bc, opts, overlapped)
+}
+
+// setSubInterfaceConfig macvlan/ipvlan 网络的配置，子网为 parent 所在的物理网络，必须指定，
+// 只检查与已有网络不重叠，宿主机在 parent 上通常也有该子网的地址
+func (n *Network) setSubInterfaceConfig(opts *CreateOptions, existing []*Network) error {
+	if opts.Bridge != "" {
+		return fmt.Errorf("--bridge can not be used with --driver %s", n.Driver)
+	}
+	if opts.Parent == "" {
+		return fmt.Errorf("--parent is required by --driver %s", n.Driver)
+	}
+	if opts.Subnet == "" {
+		return fmt.Errorf("--subnet is required by --driver %s", n.Driver)
+	}
+	if opts.IPv6 && opts.Subnet6 == "" {
+		return fmt.Errorf("--subnet6 is required by --driver %s when --ipv6 is set", n.Driver)
+	}
+	n.Parent = opts.Parent
+	switch {
+	case n.Driver == DriverIPVlan && opts.IPVlanMode == "":
+		n.IPVlanMode = bridge.IPVlanModeL2
+	case n.Driver == DriverIPVlan && (opts.IPVlanMode == bridge.IPVlanModeL2 || opts.IPVlanMode == bridge.IPVlanModeL3):
+		n.IPVlanMode = opts.IPVlanMode
+	case n.Driver == DriverIPVlan:
+		return fmt.Errorf("invalid ipvlan mode %q, must be %s or %s", opts.IPVlanMode, bridge.IPVlanModeL2, bridge.IPVlanModeL3)
+	case opts.IPVlanMode != "":
+		return fmt.Errorf("--ipvlan-mode can only be used with --driver %s", DriverIPVlan)
+	}
+
+	n.Bridge = &bridge.BridgeConfig{MTU: opts.MTU}
+	return setAddresses(n.Bridge, opts, func(subnet *net.IPNet) error {
+		return overlappedNetwork(subnet, existing)
+	})
+}
+
+// overlappedNetwork 检查子网与已有网络的子网不重叠
+func overlappedNetwork(subnet *net.IPNet, existing []*Network) error {
+	for _, n := range existing {
+		if overlaps(subnet, n.Subnet()) || (n.Subnet6() != nil && overlaps(subnet, n.Subnet6())) {
+			return fmt.Errorf("subnet %s overlaps with network %s", subnet, n.Name)
+		}
+	}
+	return nil
+}
+
+// setAddresses 根据参数设置网络的子网和网关，overlapped 检查子网是否可以使用
+func setAddresses(bc *bridge.BridgeConfig, opts *CreateOptions, overlapped func(*net.IPNet) error) error {
+	if opts.Subnet == "" {
+		for i := 1; i < 256 && bc.Subnet == nil; i++ {
+			_, subnet, _ := net.ParseCIDR(fmt.Sprintf(autoSubnetFormat, i))
+			if overlapped(subnet) == nil {
+				bc.Subnet = subnet
+			}
+		}
+		if bc.Subnet == nil {
+			return fmt.Errorf("no available subnet, use --subnet to specify one")
+		}
+	} else {
+		_, subnet, err := net.ParseCIDR(opts.Subnet)
+		if err != nil || subnet.IP.To4() == nil {
+			return fmt.Errorf("invalid subnet %q", opts.Subnet)
+		}
+		if ones, _ := subnet.Mask.Size(); ones > 30 {
+			return fmt.Errorf("subnet %s is too small", subnet)
+		}
+		if err := overlapped(subnet); err != nil {
+			return err
+		}
+		bc.Subnet = subnet
+	}
+
+	gateway := nextIP(bc.Subnet.IP)
+	if opts.Gateway != "" {
+		gateway = net.ParseIP(opts.Gateway).To4()
+		if gateway == nil || !bc.Subnet.Contains(gateway) ||
+			gateway.Equal(bc.Subnet.IP) || gateway.Equal(broadcast(bc.Subnet)) {
+			return fmt.Errorf("invalid gateway %q for subnet %s", opts.Gateway, bc.Subnet)
+		}
+	}
+	bc.IPNet = &net.IPNet{IP: gateway, Mask: bc.Subnet.Mask}
+
+	if opts.IPv6 || opts.Subnet6 != "" {
+		if err := setBridgeIPv6(bc, opts, overlapped); err != nil {
+			return err
+		}
+	} else if opts.Gateway6 != "" {
+		return fmt.Errorf("--gateway6 requires --ipv6")
+	}
+	return nil
+}
+
+// setBridgeIPv6 配置网络的 IPv6 子网和网关
+func setBridgeIPv6(bc *bridge.BridgeConfig, opts *CreateOptions, overlapped func(*net.IPNet) error) error {
+	if opts.Subnet6 == "" {
+		for i := 0; i < 16 && bc.Subnet6 == nil; i++ {
+			subnet := randomULASubnet()
+			if overlapped(subnet) == nil {
+				bc.Subnet6 = subnet
+			}
+		}
+		if bc.Subnet6 == nil {
+			return fmt.Errorf("no available ipv6 subnet, use --subnet6 to specify one")
+		}
+	} else {
+		_, subnet, err := net.ParseCIDR(opts.Subnet6)
+		if err != nil || subnet.IP.To4() != nil {
+			return fmt.Errorf("invalid ipv6 subnet %q", opts.Subnet6)
+		}
+		if ones, _ := subnet.Mask.Size(); ones > 126 {
+			return fmt.Errorf("subnet %s is too small", subnet)
+		}
+		if err := overlapped(subnet); err != nil {
+			return err
+		}
+		bc.Subnet6 = subnet
+	}
+
+	gateway := nextIP(bc.Subnet6.IP)
+	if opts.Gateway6 != "" {
+		gateway = net.ParseIP(opts.Gateway6)
+		if gateway == nil || gateway.To4() != nil || !bc.Subnet6.Contains(gateway) || gateway.Equal(bc.Subnet6.IP) {
+			return fmt.Errorf("invalid gateway %q for subnet %s", opts.Gateway6, bc.Subnet6)
+		}
+	}
+	bc.IPNet6 = &net.IPNet{IP: gateway, Mask: bc.Subnet6.Mask}
+	return nil
+}
+
+// randomULASubnet fd00::/8 中随机 40 位 Global ID 的 /64 子网
+func randomULASubnet() *net.IPNet {
+	ip := make(net.IP, net.IPv6len)
+	ip[0] = 0xfd
+	rand.Read(ip[1:6])
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(autoSubnet6Ones, 128)}
+}
+
+// releaseSubnets 删除IP池中网络的子网
+func (n *Network) releaseSubnets() error {
+	errs := []error{IPPool.ReleaseSubnet(n.Subnet().String())}
+	if n.Subnet6() != nil {
+		errs = append(errs, IPPool.ReleaseSubnet(n.Subnet6().String()))
+	}
+	return common.Err(common.ErrGroup(errs...))
+}
+
+// RemoveNetwork 删除网络、网桥、IP池中的记录以及与该网络有关的放行规则
+// 注意：调用前需要确保没有容器使用该网络
+func RemoveNetwork(name string) error {
+	n, err := GetNetwork(name)
+	if err != nil {
+		return err
+	}
+	if n.IsDefault() {
+		return fmt.Errorf("network %s can not be removed", name)
+	}
+	// 依次执行，网桥和规则删除失败时保留配置，可以重新执行 network rm
+	if err := n.Release(); err != nil {
+		return common.ErrTag("remove network "+name, err)
+	}
+	if err := n.releaseSubnets(); err != nil {
+		return common.ErrTag("remove network "+name, err)
+	}
+	if err := os.Remove(n.path()); err != nil {
+		return common.ErrTag("remove network "+name, err)
+	}
+	return common.ErrTag("remove network "+name, removeAllowRulesOf(n.Name))
+}
+
+// hostIPNets 宿主机网卡上已有的子网，不包括回环地址和链路本地地址
+func hostIPNets() []*net.IPNet {
+	ipNets := make([]*net.IPNet, 0)
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ipNets
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ipNets = append(ipNets, &net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask})
+	}
+	return ipNets
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func nextIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func broadcast(subnet *net.IPNet) net.IP {
+	ip := make(net.IP, 4)
+	for i := range ip {
+		ip[i] = subnet.IP.To4()[i] | ^subnet.Mask[i]
+	}
+	return ip
+}
@@ -0,0 +1,142 @@
+package network
+
+import (
+	"github.com/stretchr/testify/assert"
+	"mini-container/internal/network/bridge"
+	"mini-container/internal/network/ippool"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestSubnetHelpers(t *testing.T) {
+	_, a, _ := net.ParseCIDR("10.1.0.0/16")
+	_, b, _ := net.ParseCIDR("10.1.2.0/24")
+	_, c, _ := net.ParseCIDR("10.2.0.0/24")
+	assert.True(t, overlaps(a, b))
+	assert.True(t, overlaps(b, a))
+	assert.False(t, overlaps(a, c))
+
+	assert.Equal(t, "10.1.0.1", nextIP(a.IP).String())
+	assert.Equal(t, "10.2.1.0", nextIP(net.ParseIP("10.2.0.255")).String())
+	assert.Equal(t, "10.1.255.255", broadcast(a).String())
+	assert.Equal(t, "10.1.2.255", broadcast(b).String())
+
+	_, v6, _ := net.ParseCIDR("fd00:1::/64")
+	assert.False(t, overlaps(a, v6))
+	assert.Equal(t, "fd00:1::1", nextIP(v6.IP).String())
+}
+
+func TestSetBridgeIPv6(t *testing.T) {
+	noOverlap := func(*net.IPNet) error { return nil }
+
+	bc := &bridge.BridgeConfig{}
+	assert.NoError(t, setBridgeIPv6(bc, &CreateOptions{IPv6: true}, noOverlap))
+	assert.Equal(t, byte(0xfd), bc.Subnet6.IP[0])
+	ones, bits := bc.Subnet6.Mask.Size()
+	assert.Equal(t, []int{64, 128}, []int{ones, bits})
+	assert.Equal(t, nextIP(bc.Subnet6.IP).String(), bc.IPNet6.IP.String())
+
+	bc = &bridge.BridgeConfig{}
+	assert.NoError(t, setBridgeIPv6(bc, &CreateOptions{Subnet6: "fd00:1::/64", Gateway6: "fd00:1::fe"}, noOverlap))
+	assert.Equal(t, "fd00:1::fe/64", bc.IPNet6.String())
+
+	for _, opts := range []*CreateOptions{
+		{Subnet6: "10.0.0.0/24"},
+		{Subnet6: "fd00:1::/127"},
+		{Subnet6: "fd00:1::/64", Gateway6: "fd00:2::1"},
+		{Subnet6: "fd00:1::/64", Gateway6: "fd00:1::"},
+	} {
+		assert.Error(t, setBridgeIPv6(&bridge.BridgeConfig{}, opts, noOverlap), opts.Subnet6)
+	}
+}
+
+func TestDefaultNetwork(t *testing.T) {
+	n, err := GetNetwork("")
+	assert.NoError(t, err)
+	assert.True(t, n.IsDefault())
+	assert.Equal(t, "192.172.0.0/24", n.Subnet().String())
+	assert.Equal(t, "192.172.0.1/24", n.Gateway().String())
+
+	_, err = GetNetwork("../etc")
+	assert.Error(t, err)
+}
+
+func TestSetSubInterfaceConfig(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.1.0/24")
+	existing := []*Network{{Name: "web", Bridge: &bridge.BridgeConfig{Subnet: subnet}}}
+
+	n := &Network{Name: "lan", Driver: DriverIPVlan}
+	opts := &CreateOptions{Parent: "eth0", Subnet: "10.0.0.0/24", Gateway: "10.0.0.254"}
+	assert.NoError(t, n.setSubInterfaceConfig(opts, existing))
+	assert.Equal(t, "eth0", n.Parent)
+	assert.Equal(t, bridge.IPVlanModeL2, n.IPVlanMode)
+	assert.Equal(t, "", n.Bridge.Name)
+	assert.Equal(t, "10.0.0.254/24", n.Gateway().String())
+	assert.Equal(t, "eth0", n.Device())
+	assert.False(t, n.IsBridge())
+	assert.False(t, n.deviceRoute())
+	assert.Nil(t, n.DNSAddr())
+
+	n = &Network{Name: "lan", Driver: DriverIPVlan}
+	assert.NoError(t, n.setSubInterfaceConfig(&CreateOptions{Parent: "eth0", Subnet: "10.0.0.0/24", IPVlanMode: "l3"}, existing))
+	assert.True(t, n.deviceRoute())
+
+	for _, opts := range []*CreateOptions{
+		{Subnet: "10.0.0.0/24"},
+		{Parent: "eth0"},
+		{Parent: "eth0", Subnet: "192.168.0.0/16"},
+		{Parent: "eth0", Subnet: "10.0.0.0/24", Bridge: "br0"},
+		{Parent: "eth0", Subnet: "10.0.0.0/24", IPv6: true},
+		{Parent: "eth0", Subnet: "10.0.0.0/24", IPVlanMode: "l3"},
+	} {
+		n := &Network{Name: "lan", Driver: DriverMacvlan}
+		assert.Error(t, n.setSubInterfaceConfig(opts, existing), opts)
+	}
+	n = &Network{Name: "lan", Driver: DriverIPVlan}
+	assert.Error(t, n.setSubInterfaceConfig(&CreateOptions{Parent: "eth0", Subnet: "10.0.0.0/24", IPVlanMode: "l4"}, existing))
+}
+
+func TestGetDriver(t *testing.T) {
+	for name, want := range map[string]string{"": DriverBridge, "bridge": DriverBridge, "macvlan": DriverMacvlan, "ipvlan": DriverIPVlan} {
+		d, err := GetDriver(name)
+		assert.NoError(t, err)
+		assert.Equal(t, want, d.Name())
+	}
+	_, err := GetDriver("overlay")
+	assert.Error(t, err)
+
+	n := DefaultNetwork()
+	assert.Equal(t, DriverBridge, n.DriverName())
+	assert.True(t, n.IsBridge())
+	assert.Equal(t, "mini-ctr0", n.Device())
+}
+
+func TestValidateStaticIP(t *testing.T) {
+	pool, err := ippool.New(filepath.Join(t.TempDir(), "ip-pool.json"))
+	assert.NoError(t, err)
+	old := IPPool
+	IPPool = pool
+	defer func() { IPPool = old }()
+
+	_, subnet, _ := net.ParseCIDR("10.10.0.0/24")
+	_, ipRange, _ := net.ParseCIDR("10.10.0.128/25")
+	nw := &Network{
+		Name:    "mynet",
+		Bridge:  &bridge.BridgeConfig{Subnet: subnet, IPNet: &net.IPNet{IP: net.ParseIP("10.10.0.1").To4(), Mask: subnet.Mask}},
+		IPRange: ipRange,
+	}
+
+	// ip-range 只限制自动分配，静态IP可以在 ip-range 之外
+	assert.NoError(t, ValidateStaticIP(nw, net.ParseIP("10.10.0.50")))
+	assert.NoError(t, ValidateStaticIP(nw, net.ParseIP("10.10.0.200")))
+
+	assert.EqualError(t, ValidateStaticIP(nw, net.ParseIP("fd00::5")), "static ipv6 is not supported, ip fd00::5")
+	assert.EqualError(t, ValidateStaticIP(nw, net.ParseIP("10.20.0.5")), "ip 10.20.0.5 is not in subnet 10.10.0.0/24 of network mynet")
+	assert.EqualError(t, ValidateStaticIP(nw, net.ParseIP("10.10.0.1")), "ip 10.10.0.1 is reserved in network mynet")
+	assert.EqualError(t, ValidateStaticIP(nw, net.ParseIP("10.10.0.255")), "ip 10.10.0.255 is reserved in network mynet")
+
+	_, err = pool.AllocateStaticIP("10.10.0.50/24")
+	assert.NoError(t, err)
+	assert.EqualError(t, ValidateStaticIP(nw, net.ParseIP("10.10.0.50")), "ip 10.10.0.50 is already in use")
+}
@@ -0,0 +1,126 @@
+package network
+
+import (
+	"fmt"
+	"mini-container/common"
+	"mini-container/internal/network/firewall"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 端口映射通过防火墙的 DNAT 规则实现，规则见 firewall 包，此外：
+//  - 宿主机通过 127.0.0.1 访问时，需要开启网桥的 route_localnet，否则内核会丢弃目的地址被 DNAT 为容器地址的回环流量
+//  - 容器通过宿主机地址访问自己映射出去的端口（hairpin）时，需要网桥端口开启 hairpin 模式
+
+// PortMapping 宿主机端口到容器端口的映射
+type PortMapping struct {
+	HostIP        string `json:"hostIP"` // 为空表示宿主机的所有地址
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"` // tcp/udp
+}
+
+func (pm *PortMapping) String() string {
+	hostIP := pm.HostIP
+	if hostIP == "" {
+		hostIP = "0.0.0.0"
+	}
+	return fmt.Sprintf("%d/%s -> %s", pm.ContainerPort, pm.Protocol, net.JoinHostPort(hostIP, strconv.Itoa(pm.HostPort)))
+}
+
+// Conflicts 判断两个映射是否占用了宿主机上的同一个端口
+func (pm *PortMapping) Conflicts(other *PortMapping) bool {
+	if pm.Protocol != other.Protocol || pm.HostPort != other.HostPort {
+		return false
+	}
+	return pm.HostIP == "" || other.HostIP == "" || pm.HostIP == other.HostIP
+}
+
+// ParsePortMapping 解析 -p 参数
+// 格式：[hostIP:]hostPort:containerPort[/protocol]，protocol 默认为 tcp
+// 例如：8080:80、127.0.0.1:8053:53/udp
+func ParsePortMapping(spec string) (*PortMapping, error) {
+	pm := &PortMapping{Protocol: "tcp"}
+
+	rest := spec
+	if i := strings.LastIndexByte(spec, '/'); i != -1 {
+		rest, pm.Protocol = spec[:i], strings.ToLower(spec[i+1:])
+	}
+	if pm.Protocol != "tcp" && pm.Protocol != "udp" {
+		return nil, fmt.Errorf("invalid port mapping %q, protocol must be tcp or udp", spec)
+	}
+
+	parts := strings.Split(rest, ":")
+	switch len(parts) {
+	case 2:
+	case 3:
+		pm.HostIP = parts[0]
+		ip := net.ParseIP(pm.HostIP)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid port mapping %q, invalid host ip %q", spec, pm.HostIP)
+		}
+		if ip.IsUnspecified() {
+			pm.HostIP = ""
+		}
+		parts = parts[1:]
+	default:
+		return nil, fmt.Errorf("invalid port mapping %q, format: [hostIP:]hostPort:containerPort[/protocol]", spec)
+	}
+
+	var err error
+	if pm.HostPort, err = parsePort(parts[0]); err != nil {
+		return nil, fmt.Errorf("invalid port mapping %q, %s", spec, err)
+	}
+	if pm.ContainerPort, err = parsePort(parts[1]); err != nil {
+		return nil, fmt.Errorf("invalid port mapping %q, %s", spec, err)
+	}
+	return pm, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// firewallPorts 转换为防火墙的端口映射
+func firewallPorts(ports []*PortMapping) []*firewall.PortMapping {
+	result := make([]*firewall.PortMapping, 0, len(ports))
+	for _, pm := range ports {
+		result = append(result, &firewall.PortMapping{
+			HostIP:        pm.HostIP,
+			HostPort:      pm.HostPort,
+			ContainerPort: pm.ContainerPort,
+			Protocol:      pm.Protocol,
+		})
+	}
+	return result
+}
+
+// SetupPortMappings 为容器添加端口映射规则
+func SetupPortMappings(bridgeName string, containerIP net.IP, ports []*PortMapping) error {
+	fw, err := firewall.Default()
+	if err != nil {
+		return err
+	}
+	return common.Err(common.ErrGroup(
+		os.WriteFile(fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/route_localnet", bridgeName), []byte("1"), 0644),
+		fw.AddPortMappings(bridgeName, containerIP, firewallPorts(ports)),
+	))
+}
+
+// ReleasePortMappings 删除容器的端口映射规则，删除失败时继续删除其余规则
+func ReleasePortMappings(bridgeName string, containerIP net.IP, ports []*PortMapping) error {
+	if len(ports) == 0 {
+		return nil
+	}
+	fw, err := firewall.Default()
+	if err != nil {
+		return err
+	}
+	return fw.RemovePortMappings(bridgeName, containerIP, firewallPorts(ports))
+}
@@ -0,0 +1,38 @@
+package network
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParsePortMapping(t *testing.T) {
+	pm, err := ParsePortMapping("8080:80")
+	assert.NoError(t, err)
+	assert.Equal(t, &PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}, pm)
+	assert.Equal(t, "80/tcp -> 0.0.0.0:8080", pm.String())
+
+	pm, err = ParsePortMapping("127.0.0.1:8053:53/UDP")
+	assert.NoError(t, err)
+	assert.Equal(t, &PortMapping{HostIP: "127.0.0.1", HostPort: 8053, ContainerPort: 53, Protocol: "udp"}, pm)
+
+	pm, err = ParsePortMapping("0.0.0.0:80:80")
+	assert.NoError(t, err)
+	assert.Equal(t, "", pm.HostIP)
+
+	for _, spec := range []string{"80", "80:80/sctp", "0:80", "80:65536", "x:80", "::1:80:80", "1.2.3:80:80", "a:b:c:d"} {
+		_, err := ParsePortMapping(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestPortMappingConflicts(t *testing.T) {
+	all := &PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}
+	local := &PortMapping{HostIP: "127.0.0.1", HostPort: 8080, ContainerPort: 81, Protocol: "tcp"}
+	other := &PortMapping{HostIP: "10.0.0.1", HostPort: 8080, ContainerPort: 82, Protocol: "tcp"}
+	udp := &PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "udp"}
+
+	assert.True(t, all.Conflicts(local))
+	assert.True(t, local.Conflicts(all))
+	assert.False(t, local.Conflicts(other))
+	assert.False(t, all.Conflicts(udp))
+}
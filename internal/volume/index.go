@@ -0,0 +1,286 @@
+package volume
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mini-container/common"
+	"mini-container/config"
+	"mini-container/internal/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// 命名卷由 mini-container 管理，数据保存在：
+// ~/.mini-container/volumes/<volume name>/_data/
+// ~/.mini-container/volumes/<volume name>/volume.json
+// ~/.mini-container/volumes/<volume name>.lock  修改 volume.json 时加锁，见 WithLock
+
+const (
+	MetaName = "volume.json"
+	DataName = "_data"
+)
+
+// baseDir 命名卷的根目录，测试时替换为临时目录
+var baseDir = config.VolumeDir
+
+var nameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+type Volume struct {
+	Name        string    `json:"name"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Containers  []string  `json:"containers"`  // 引用该卷的容器，为空时才允许删除
+	Initialized bool      `json:"initialized"` // 是否已经从镜像拷贝过挂载点的初始内容
+}
+
+// ValidName 判断是否为合法的卷名
+func ValidName(name string) bool {
+	return nameRegexp.MatchString(name)
+}
+
+func (v *Volume) Dir() string {
+	return filepath.Join(baseDir, v.Name)
+}
+
+// DataDir 卷的数据目录，绑定挂载到容器中
+func (v *Volume) DataDir() string {
+	return filepath.Join(v.Dir(), DataName)
+}
+
+// WithLock 持有卷 name 的锁期间执行 fn，读取、修改、保存卷的元数据需要在同一个 fn 中完成
+// 锁文件与卷目录同级，卷不存在时也可以加锁，用于避免并发创建同名的卷
+func WithLock(name string, fn func() error) error {
+	if !ValidName(name) {
+		return fmt.Errorf("invalid volume name %q", name)
+	}
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		return err
+	}
+	return common.WithFileLock(lockPath(name), common.DefaultLockTimeout, fn)
+}
+
+func lockPath(name string) string {
+	return filepath.Join(baseDir, name+".lock")
+}
+
+func (v *Volume) Save() error {
+	return common.WriteJSONSync(filepath.Join(v.Dir(), MetaName), v)
+}
+
+func (v *Volume) InUse() bool {
+	return len(v.Containers) > 0
+}
+
+// AddRef 记录容器引用了该卷
+// 注意：需要在 WithLock 中与 Get 一起调用
+func (v *Volume) AddRef(containerName string) error {
+	for _, c := range v.Containers {
+		if c == containerName {
+			return v.Save()
+		}
+	}
+	v.Containers = append(v.Containers, containerName)
+	sort.Strings(v.Containers)
+	return v.Save()
+}
+
+// RemoveRef 删除容器对该卷的引用
+// 注意：需要在 WithLock 中与 Get 一起调用
+func (v *Volume) RemoveRef(containerName string) error {
+	containers := make([]string, 0, len(v.Containers))
+	for _, c := range v.Containers {
+		if c != containerName {
+			containers = append(containers, c)
+		}
+	}
+	v.Containers = containers
+	return v.Save()
+}
+
+// Create 创建命名卷，name 为空时生成随机名称
+func Create(name string) (*Volume, error) {
+	if name == "" {
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		name = hex.EncodeToString(buf)
+	}
+	var v *Volume
+	err := WithLock(name, func() (err error) {
+		v, err = create(name)
+		return err
+	})
+	return v, err
+}
+
+func create(name string) (*Volume, error) {
+	if Exists(name) {
+		return nil, fmt.Errorf("volume %s already exists", name)
+	}
+
+	v := &Volume{
+		Name:       name,
+		CreatedAt:  time.Now(),
+		Containers: make([]string, 0),
+	}
+	if err := os.MkdirAll(v.DataDir(), 0755); err != nil {
+		return nil, err
+	}
+	if err := v.Save(); err != nil {
+		os.RemoveAll(v.Dir())
+		return nil, err
+	}
+	return v, nil
+}
+
+func Exists(name string) bool {
+	return common.IsExistPath(filepath.Join(baseDir, name, MetaName))
+}
+
+// Get 读取命名卷
+func Get(name string) (*Volume, error) {
+	if !ValidName(name) {
+		return nil, fmt.Errorf("invalid volume name %q", name)
+	}
+	v := &Volume{Name: name}
+	if err := common.ReadJSON(filepath.Join(v.Dir(), MetaName), v); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("volume %s not found", name)
+		}
+		return nil, err
+	}
+	return v, nil
+}
+
+// GetOrCreate 读取命名卷，不存在时自动创建（run -v myvol:/data 的行为）
+// 注意：需要在 WithLock 中调用
+func GetOrCreate(name string) (*Volume, error) {
+	if Exists(name) {
+		return Get(name)
+	}
+	return create(name)
+}
+
+// Attach 记录容器 containerName 引用了卷 name，卷不存在时自动创建
+// initDir: 卷第一次被使用时拷贝该目录的已有内容（镜像中的挂载点），不是目录时忽略
+// 加锁直到记录引用，并发启动的容器只有一个会拷贝初始内容
+func Attach(name, containerName, initDir string) (*Volume, error) {
+	var v *Volume
+	err := WithLock(name, func() (err error) {
+		v, err = GetOrCreate(name)
+		if err != nil {
+			return err
+		}
+		if !v.Initialized {
+			if info, err := os.Stat(initDir); err == nil && info.IsDir() {
+				if err := fs.CopyDir(initDir, v.DataDir()); err != nil {
+					return common.ErrTag("copy up volume "+name, err)
+				}
+			}
+			v.Initialized = true
+		}
+		return v.AddRef(containerName)
+	})
+	return v, err
+}
+
+// Detach 删除容器 containerName 对卷 name 的引用，卷不存在时忽略
+func Detach(name, containerName string) error {
+	return WithLock(name, func() error {
+		if !Exists(name) {
+			return nil
+		}
+		v, err := Get(name)
+		if err != nil {
+			return err
+		}
+		return v.RemoveRef(containerName)
+	})
+}
+
+// List 列出所有命名卷
+func List() ([]*Volume, error) {
+	volumes := make([]*Volume, 0)
+	dirs, err := os.ReadDir(baseDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return volumes, nil
+		}
+		return volumes, err
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() || !Exists(dir.Name()) {
+			continue
+		}
+		v, err := Get(dir.Name())
+		if err != nil {
+			return volumes, err
+		}
+		volumes = append(volumes, v)
+	}
+	return volumes, nil
+}
+
+// Remove 删除命名卷及其数据
+// force: 为 true 时忽略容器引用
+func Remove(name string, force bool) error {
+	return WithLock(name, func() error {
+		v, err := Get(name)
+		if err != nil {
+			return err
+		}
+		if v.InUse() && !force {
+			return fmt.Errorf("volume %s is in use by %v", name, v.Containers)
+		}
+		return v.remove()
+	})
+}
+
+// remove 删除卷的目录和锁文件，等待锁的进程发现锁文件被删除后会重新加锁
+// 注意：需要在 WithLock 中调用
+func (v *Volume) remove() error {
+	if err := os.RemoveAll(v.Dir()); err != nil {
+		return err
+	}
+	if err := os.Remove(lockPath(v.Name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Prune 删除所有未被容器引用的命名卷
+// return: 被删除的卷名
+func Prune() ([]string, error) {
+	removed := make([]string, 0)
+	volumes, err := List()
+	if err != nil {
+		return removed, err
+	}
+	for _, v := range volumes {
+		// List 之后可能有容器开始引用该卷，加锁后重新读取
+		pruned := false
+		err := WithLock(v.Name, func() error {
+			if !Exists(v.Name) {
+				return nil
+			}
+			v, err := Get(v.Name)
+			if err != nil || v.InUse() {
+				return err
+			}
+			pruned = true
+			return v.remove()
+		})
+		if err != nil {
+			return removed, err
+		}
+		if pruned {
+			removed = append(removed, v.Name)
+		}
+	}
+	return removed, nil
+}
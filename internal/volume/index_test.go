@@ -0,0 +1,154 @@
+package volume
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func useTempDir(t *testing.T) {
+	old := baseDir
+	baseDir = filepath.Join(t.TempDir(), "volumes")
+	t.Cleanup(func() { baseDir = old })
+}
+
+func TestCreateGetList(t *testing.T) {
+	useTempDir(t)
+
+	volumes, err := List()
+	assert.NoError(t, err)
+	assert.Empty(t, volumes)
+
+	v, err := Create("data")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(baseDir, "data", DataName), v.DataDir())
+	assert.DirExists(t, v.DataDir())
+	_, err = Create("data")
+	assert.EqualError(t, err, "volume data already exists")
+	_, err = Create("-bad")
+	assert.EqualError(t, err, `invalid volume name "-bad"`)
+
+	anonymous, err := Create("")
+	assert.NoError(t, err)
+	assert.Len(t, anonymous.Name, 32)
+
+	got, err := Get("data")
+	assert.NoError(t, err)
+	assert.Equal(t, "data", got.Name)
+	assert.Empty(t, got.Containers)
+	_, err = Get("missing")
+	assert.EqualError(t, err, "volume missing not found")
+
+	// 锁文件与卷目录同级，不会被当作卷
+	volumes, err = List()
+	assert.NoError(t, err)
+	assert.Len(t, volumes, 2)
+	assert.FileExists(t, lockPath("data"))
+}
+
+func TestAttachDetach(t *testing.T) {
+	useTempDir(t)
+	initDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(initDir, "index.html"), []byte("image"), 0644))
+
+	// 卷不存在时自动创建，第一次使用时拷贝初始内容
+	v, err := Attach("web", "c1", initDir)
+	assert.NoError(t, err)
+	data, err := os.ReadFile(filepath.Join(v.DataDir(), "index.html"))
+	assert.NoError(t, err)
+	assert.Equal(t, "image", string(data))
+
+	// 之后的容器不会覆盖卷中的数据
+	assert.NoError(t, os.WriteFile(filepath.Join(v.DataDir(), "index.html"), []byte("volume"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(initDir, "new.html"), nil, 0644))
+	_, err = Attach("web", "c2", initDir)
+	assert.NoError(t, err)
+	_, err = Attach("web", "c2", initDir)
+	assert.NoError(t, err)
+	data, err = os.ReadFile(filepath.Join(v.DataDir(), "index.html"))
+	assert.NoError(t, err)
+	assert.Equal(t, "volume", string(data))
+	assert.NoFileExists(t, filepath.Join(v.DataDir(), "new.html"))
+
+	v, err = Get("web")
+	assert.NoError(t, err)
+	assert.True(t, v.Initialized)
+	assert.True(t, v.InUse())
+	assert.Equal(t, []string{"c1", "c2"}, v.Containers)
+
+	assert.NoError(t, Detach("web", "c1"))
+	assert.NoError(t, Detach("web", "c1"))
+	v, err = Get("web")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c2"}, v.Containers)
+	assert.NoError(t, Detach("web", "c2"))
+	v, err = Get("web")
+	assert.NoError(t, err)
+	assert.False(t, v.InUse())
+
+	// 卷已经被删除时忽略
+	assert.NoError(t, Detach("missing", "c1"))
+}
+
+func TestRemove(t *testing.T) {
+	useTempDir(t)
+	v, err := Attach("data", "c1", "")
+	assert.NoError(t, err)
+
+	assert.EqualError(t, Remove("data", false), "volume data is in use by [c1]")
+	assert.DirExists(t, v.DataDir())
+	assert.NoError(t, Remove("data", true))
+	assert.NoDirExists(t, v.Dir())
+	assert.NoFileExists(t, lockPath("data"))
+	assert.EqualError(t, Remove("data", false), "volume data not found")
+
+	_, err = Create("idle")
+	assert.NoError(t, err)
+	assert.NoError(t, Remove("idle", false))
+	assert.False(t, Exists("idle"))
+}
+
+func TestPrune(t *testing.T) {
+	useTempDir(t)
+	_, err := Attach("used", "c1", "")
+	assert.NoError(t, err)
+	_, err = Create("idle1")
+	assert.NoError(t, err)
+	_, err = Create("idle2")
+	assert.NoError(t, err)
+
+	removed, err := Prune()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"idle1", "idle2"}, removed)
+	volumes, err := List()
+	assert.NoError(t, err)
+	assert.Len(t, volumes, 1)
+	assert.Equal(t, "used", volumes[0].Name)
+
+	assert.NoError(t, Detach("used", "c1"))
+	removed, err = Prune()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"used"}, removed)
+}
+
+func TestAttachConcurrent(t *testing.T) {
+	useTempDir(t)
+	names := []string{"c0", "c1", "c2", "c3", "c4", "c5", "c6", "c7"}
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			_, err := Attach("shared", name, "")
+			assert.NoError(t, err)
+		}(name)
+	}
+	wg.Wait()
+
+	// 每次读取-修改-保存都在锁中完成，不会丢失引用
+	v, err := Get("shared")
+	assert.NoError(t, err)
+	assert.Equal(t, names, v.Containers)
+}
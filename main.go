@@ -1,12 +1,19 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
 	common "mini-container/common"
 	"mini-container/config"
 	"mini-container/container"
+	"mini-container/internal/fs"
+	"mini-container/internal/image"
+	"mini-container/internal/network"
+	"net"
 	"os"
 	"os/exec"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -21,6 +28,13 @@ const (
 	CMDNameStart  = "start"
 	CMDNameStop   = "stop"
 	CMDNameClear  = "clear"
+	CMDNameDiff   = "diff"
+	CMDNameExport = "export"
+	CMDNameImport = "import"
+	CMDNameImages = "images"
+	CMDNamePort   = "port"
+	CMDNameUpdate = "update"
+	CMDNameExec   = "exec"
 	CMDNameHelp1  = "--help"
 	CMDNameHelp2  = "-h"
 
@@ -28,14 +42,41 @@ const (
 # mini-container --help/-h
 
 Commands:
-~ run [container name] [image path] [entry point] [args...]		create and start a container
+~ run [options] [container name] [image path|image:tag] [entry point] [args...]	create and start a container
     	For example: ./mini-container run test1 / /bin/sh
+    	Options:
+    	-v host-path|volume-name:container-path[:ro][,rslave]		mount a host path or a named volume, can be repeated
+    	--tmpfs container-path[:size=64m,mode=1777]			mount a tmpfs (noexec,nosuid,nodev by default), can be repeated
+    	--read-only							mount the container's root filesystem as read only
+    	--hostname name							container host name, default to the container name
+    	--domainname name						container NIS domain name
+    	--dns ip							set a custom DNS server, can be repeated
+    	--add-host hostname:ip						add a line to /etc/hosts, can be repeated
+    	-p [host-ip:]host-port:container-port[/tcp|udp]		publish a container's port to the host, can be repeated
+    	--network name							connect the container to a network, default to "bridge"
+    	--network host|none|container:name				use the host network, no network, or share the network of a running container
+    	--network cni:name						configure the network with the CNI plugins of the network config list "name"
+    	--network-alias name						another name of the container in the network's embedded DNS
+    	--ip x.x.x.x							static ip in the network's subnet
+    	--sticky-ip							keep the allocated ip across restarts
+    	--network-ingress-rate rate					limit the rate of traffic into the container, e.g. 10mbit, 512kbit, 1mbps
+    	--network-egress-rate rate					limit the rate of traffic out of the container
 ~ start [container name]						start a stopped or created container
 ~ stop [container name]							stop a running container
 ~ ls									list containers and their information
 ~ rm [container name] 							remove a container
 ~ clear									remove all containers
-`
+~ port [container name]							list port mappings of a container
+~ exec [container name] [command] [args...]				run a command in a running container (requires nsenter)
+~ update [options] [container name]					update the network rates of a container, applied immediately if it is running
+    	--network-ingress-rate rate					limit the rate of traffic into the container, 0 means unlimited
+    	--network-egress-rate rate					limit the rate of traffic out of the container, 0 means unlimited
+~ diff [container name] [--json]					list files added(A), changed(C) or deleted(D) in a container
+~ export [container name] [-o file]					export the container's root filesystem as a tar archive (default to stdout)
+~ import [file|-] [image:tag]						import a tar archive as a single-layer image
+~ images								list local images
+~ volume [create|ls|inspect|rm|prune]					manage named volumes, see "~ volume --help"
+~ network [create|ls|inspect|rm]					manage networks, see "~ network --help"`
 )
 
 // run [container name] [image path] [entry point] [args...]
@@ -48,13 +89,7 @@ func main() {
 	switch os.Args[1] {
 	case CMDNameParent:
 		common.MustLog("init host config", container.InitHostConfig())
-
-		var (
-			containerName = os.Args[2]
-			imageDir      = os.Args[3]
-			entryPoint    = os.Args[4:]
-		)
-		run(containerName, imageDir, entryPoint)
+		run(os.Args[2:])
 
 	case CMDNameChild:
 		var (
@@ -91,6 +126,48 @@ func main() {
 		)
 		stop(containerName)
 
+	case CMDNamePort:
+		common.MustLog("init host config", container.InitHostConfig())
+		var (
+			containerName = os.Args[2]
+		)
+		port(containerName)
+
+	case CMDNameUpdate:
+		common.MustLog("init host config", container.InitHostConfig())
+		update(os.Args[2:])
+
+	case CMDNameExec:
+		common.MustLog("init host config", container.InitHostConfig())
+		execInContainer(os.Args[2:])
+
+	case CMDNameDiff:
+		common.MustLog("init host config", container.InitHostConfig())
+		diff(os.Args[2:])
+
+	case CMDNameExport:
+		common.MustLog("init host config", container.InitHostConfig())
+		export(os.Args[2:])
+
+	case CMDNameImport:
+		common.MustLog("init host config", container.InitHostConfig())
+		importImage(os.Args[2:])
+
+	case CMDNameImages:
+		common.MustLog("init host config", container.InitHostConfig())
+		listImages()
+
+	case CMDNameVolume:
+		common.MustLog("init host config", container.InitHostConfig())
+		volumeCmd(os.Args[2:])
+
+	case CMDNameNetwork:
+		common.MustLog("init host config", container.InitHostConfig())
+		networkCmd(os.Args[2:])
+
+	case network.DNSServeCommand:
+		dnsServe(os.Args[2])
+
 	case CMDNameHelp1, CMDNameHelp2:
 		fmt.Println(HelpText)
 
@@ -100,15 +177,133 @@ func main() {
 	}
 }
 
-// ~ run [container name] [image path] [entry point] [args...]
-func run(containerName, imageDir string, entryPoint []string) {
+// ~ run [options] [container name] [image path] [entry point] [args...]
+func run(args []string) {
+	fset := flag.NewFlagSet(CMDNameParent, flag.ExitOnError)
+	var volumes, tmpfs, dns, addHosts, publish, aliases stringSlice
+	fset.Var(&volumes, "v", "mount a host path or named volume: host-path|volume-name:container-path[:ro|rw][,rprivate|rslave|rshared...]")
+	fset.Var(&tmpfs, "tmpfs", "mount a tmpfs: container-path[:size=64m,mode=1777...]")
+	readOnly := fset.Bool("read-only", false, "mount the container's root filesystem as read only")
+	hostname := fset.String("hostname", "", "container host name, default to the container name")
+	domainname := fset.String("domainname", "", "container NIS domain name")
+	fset.Var(&dns, "dns", "set a custom DNS server")
+	fset.Var(&addHosts, "add-host", "add a custom host-to-IP mapping: hostname:ip")
+	networkName := fset.String("network", config.DefaultNetworkName, "connect the container to a network, or host|none|container:<name>")
+	fset.Var(&aliases, "network-alias", "add a name of the container in the network's embedded DNS")
+	ip := fset.String("ip", "", "static ipv4 address of the container")
+	stickyIP := fset.Bool("sticky-ip", false, "keep the allocated ip across restarts")
+	fset.Var(&publish, "p", "publish a container's port to the host: [host-ip:]host-port:container-port[/tcp|udp]")
+	ingressRate := fset.String("network-ingress-rate", "", "limit the rate of traffic into the container, e.g. 10mbit")
+	egressRate := fset.String("network-egress-rate", "", "limit the rate of traffic out of the container, e.g. 10mbit")
+	// 第一个位置参数之后的内容都属于容器，不再解析
+	common.MustLog("run parse args", fset.Parse(args))
+	if fset.NArg() < 3 {
+		fmt.Print(HelpText)
+		return
+	}
+	var (
+		containerName = fset.Arg(0)
+		imageDir      = fset.Arg(1)
+		entryPoint    = fset.Args()[2:]
+	)
 
 	if container.ExistsContainer(containerName) {
 		fmt.Printf("container %s already exists, you can use `~ rm %s` to remove it\n", containerName, containerName)
 		return
 	}
 
-	ctr, err := container.NewCreatedContainer(containerName, imageDir, entryPoint)
+	imageDir, err := image.ResolveDir(imageDir)
+	common.MustLog("resolve image", err)
+
+	cc := &container.ContainerConfig{
+		Name:            containerName,
+		ImageDir:        imageDir,
+		ChildEntryPoint: entryPoint,
+		ReadOnly:        *readOnly,
+		Hostname:        *hostname,
+		Domainname:      *domainname,
+		DNS:             dns,
+		ExtraHosts:      addHosts,
+	}
+	cc.NetworkIngressRate, err = parseRate(*ingressRate)
+	common.MustLog("parse network-ingress-rate", err)
+	cc.NetworkEgressRate, err = parseRate(*egressRate)
+	common.MustLog("parse network-egress-rate", err)
+	cc.IP = *ip
+	cc.StickyIP = *stickyIP
+	if cc.IP != "" && cc.StickyIP {
+		common.MustLog("parse ip", fmt.Errorf("--ip and --sticky-ip can not be used together"))
+	}
+	var nw *network.Network
+	if network.IsBridgeMode(*networkName) {
+		nw, err = network.GetNetwork(*networkName)
+		common.MustLog("parse network", err)
+		cc.Network = nw.Name
+		common.MustLog("parse ip", container.CheckStaticIP(cc))
+	} else {
+		// host、none、container:<name>、cni:<name> 模式不分配IP，也不能发布端口，cni 模式的地址由插件分配
+		cc.Network = *networkName
+		if cc.IP != "" || cc.StickyIP || len(publish) > 0 || len(aliases) > 0 || cc.NetworkIngressRate > 0 || cc.NetworkEgressRate > 0 {
+			common.MustLog("parse network", fmt.Errorf("--ip, --sticky-ip, --network-alias, --network-*-rate and -p can not be used with --network %s", cc.Network))
+		}
+		if network.SharedContainer(cc.Network) != "" {
+			_, err := cc.SharedNetworkContainer()
+			common.MustLog("parse network", err)
+		}
+		if name := network.CNINetwork(cc.Network); name != "" {
+			_, err := network.GetCNIConfList(name)
+			common.MustLog("parse network", err)
+		}
+	}
+	if *hostname != "" && !network.ValidHostname(*hostname) {
+		common.MustLog("parse hostname", fmt.Errorf("invalid hostname %q", *hostname))
+	}
+	if *domainname != "" && !network.ValidHostname(*domainname) {
+		common.MustLog("parse domainname", fmt.Errorf("invalid domainname %q", *domainname))
+	}
+	for _, alias := range aliases {
+		if !network.ValidHostname(alias) {
+			common.MustLog("parse network-alias", fmt.Errorf("invalid network alias %q", alias))
+		}
+	}
+	cc.NetworkAliases = aliases
+	for _, ns := range dns {
+		if net.ParseIP(ns) == nil {
+			common.MustLog("parse dns", fmt.Errorf("invalid dns server %q", ns))
+		}
+	}
+	for _, spec := range addHosts {
+		_, _, err := network.ParseExtraHost(spec)
+		common.MustLog("parse add-host", err)
+	}
+	for _, spec := range volumes {
+		m, err := fs.ParseMount(spec)
+		common.MustLog("parse volume", err)
+		cc.Mounts = append(cc.Mounts, m)
+	}
+	for _, spec := range tmpfs {
+		t, err := fs.ParseTmpfs(spec)
+		common.MustLog("parse tmpfs", err)
+		cc.Tmpfs = append(cc.Tmpfs, t)
+	}
+	for _, spec := range publish {
+		pm, err := network.ParsePortMapping(spec)
+		common.MustLog("parse publish", err)
+		for _, other := range cc.Ports {
+			if pm.Conflicts(other) {
+				common.MustLog("parse publish", fmt.Errorf("port %s is published more than once", pm))
+			}
+		}
+		cc.Ports = append(cc.Ports, pm)
+	}
+	if nw != nil && nw.Internal && len(cc.Ports) > 0 {
+		common.MustLog("parse publish", fmt.Errorf("can not publish ports on internal network %s", nw.Name))
+	}
+	if nw != nil && !nw.IsBridge() && (len(cc.Ports) > 0 || cc.NetworkIngressRate > 0 || cc.NetworkEgressRate > 0) {
+		common.MustLog("parse network", fmt.Errorf("-p and --network-*-rate can not be used with %s network %s", nw.Driver, nw.Name))
+	}
+
+	ctr, err := container.NewCreatedContainer(cc)
 	common.MustLog("parent new container", err)
 
 	parent(ctr)
@@ -117,6 +312,15 @@ func run(containerName, imageDir string, entryPoint []string) {
 func parent(ctr *container.Container) {
 	fmt.Printf("RUNNING parent as PID %d\n", os.Getpid())
 
+	// 持有端口锁直到容器运行，之后其他容器的检查可以看到该容器；退出时内核自动释放
+	portsLock, err := ctr.LockPorts()
+	common.MustLog("parent lock ports", err)
+	common.MustLog("parent check ports", ctr.CheckPortConflicts())
+	if network.SharedContainer(ctr.Config.Network) != "" {
+		_, err := ctr.Config.SharedNetworkContainer()
+		common.MustLog("parent check network", err)
+	}
+
 	// parent start child process
 	// equivalent: ~ child [container name]
 	cmd := exec.Command(ProcSelfExe, CMDNameChild, ctr.Config.Name)
@@ -127,15 +331,28 @@ func parent(ctr *container.Container) {
 	// CLONE_NEWNS: mount
 	// CLONE_NEWUSER: user
 	// CLONE_NEWIPC: ipc 主要是消息队列的隔离
-	// CLONE_NEWNET: network
 	// CLONE_NEWCGROUP: cgroup
 	// CLONE_NEWTIME: time
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Cloneflags: syscall.CLONE_NEWUTS |
 			syscall.CLONE_NEWPID |
 			syscall.CLONE_NEWNS |
-			syscall.CLONE_NEWIPC |
-			syscall.CLONE_NEWNET,
+			syscall.CLONE_NEWIPC,
+	}
+	// network namespace 不通过 CLONE_NEWNET 创建，而是提前创建并持久化，由 child 加入：
+	// host 模式使用宿主机网络，container 模式由 child 加入目标容器的网络
+	common.MustLog("parent create network namespace", ctr.CreateNetworkNameSpace())
+	// 之后失败时结束 child，释放已经配置的网络并删除 network namespace 的句柄，否则残留到 rm
+	mustOrStop := func(errTag string, err ...error) {
+		if !common.ErrLog(errTag, err...) {
+			return
+		}
+		if cmd.Process != nil {
+			common.ErrLog("parent kill child", cmd.Process.Kill())
+			_ = cmd.Wait()
+		}
+		common.ErrLog("parent stop", ctr.SetStopped())
+		os.Exit(1)
 	}
 	cmd.Env = os.Environ()
 	cmd.Stdin = os.Stdin
@@ -145,18 +362,20 @@ func parent(ctr *container.Container) {
 	// 提前创建信号channel，防止子进程启动完毕后，父进程还没准备好channel阻塞接收
 	waitFunc := common.NewWaitSignalChannel()
 	// Start 异步启动， Run 同步启动
-	common.MustLog("parent start child", cmd.Start())
+	mustOrStop("parent start child", cmd.Start())
 	// child进程初始化完毕后，再执行下方
 	waitFunc()
 
 	// 设置cgroups
 	// 设置network
-	common.MustLog("parent config child",
+	mustOrStop("parent config child",
 		ctr.SetRunning(os.Getpid(), cmd.Process.Pid),
 		ctr.ConfigChildCgroupsInParent(),
 		ctr.ConfigChildNetworkInParent(),
+		ctr.ConfigEtcFilesInParent(),
 		common.Signal(cmd.Process.Pid),
 	)
+	common.ErrLog("parent unlock ports", portsLock.Unlock())
 
 	fmt.Printf("RUNNING child as PID %d\n", cmd.Process.Pid)
 
@@ -176,6 +395,10 @@ func child(containerName string) {
 	ctr, err := container.NewContainerFromDisk(containerName)
 	common.MustLog("child load container", err)
 
+	common.MustLog("child config hostname", ctr.ConfigHostnameForChild())
+	// 需要在切换 rootfs 之前，此时 /proc 仍然是宿主机的
+	common.MustLog("child join network", ctr.JoinNetworkForChild())
+
 	// STEP 3: 挂载文件系统 or 隔离文件系统
 	common.MustLog("child config rootfs", ctr.ConfigRootfsForChild())
 
@@ -192,8 +415,19 @@ func list() {
 	// Name	Image Status
 	fmt.Printf("%v\t%v\t\t\t%v\t\t%v\t\t\t%v\n", "Name", "Image", "Status", "IP", "CPID")
 	for _, e := range containers {
+		ips := make([]string, 0, len(e.State.Endpoints))
+		for _, ep := range e.State.Endpoints {
+			if ep.IPNet != nil {
+				ips = append(ips, ep.IPNet.String())
+			}
+		}
+		for _, ipNet := range network.CNIResultIPNets(e.State.CNIResult) {
+			if ipNet.IP.To4() != nil {
+				ips = append(ips, ipNet.String())
+			}
+		}
 		fmt.Printf("%v\t%v\t\t\t%v\t\t%v\t\t\t%v\n",
-			e.Config.Name, e.Config.ImageDir, e.GetLifeCycle(), e.State.IPNet.String(), e.State.ChildPID)
+			e.Config.Name, e.Config.ImageDir, e.GetLifeCycle(), strings.Join(ips, ","), e.State.ChildPID)
 	}
 
 }
@@ -256,14 +490,219 @@ func stop(containerName string) {
 	common.ErrLog("stop", ctr.Kill())
 }
 
+// ~ port [container name]
+func port(containerName string) {
+	if !container.ExistsContainer(containerName) {
+		fmt.Printf("container %s not found\n", containerName)
+		return
+	}
+	ctr, err := container.NewContainerFromDisk(containerName)
+	common.MustLog("port load container", err)
+	for _, pm := range ctr.Config.Ports {
+		fmt.Println(pm)
+	}
+}
+
+// ~ exec [container name] [command] [args...]
+// 通过 nsenter 加入容器的 namespace，network namespace 使用容器的句柄，退出码与命令相同
+func execInContainer(args []string) {
+	if len(args) < 2 {
+		fmt.Print(HelpText)
+		return
+	}
+	containerName := args[0]
+	if !container.ExistsContainer(containerName) {
+		fmt.Printf("container %s not found\n", containerName)
+		return
+	}
+	ctr, err := container.NewContainerFromDisk(containerName)
+	common.MustLog("exec load container", err)
+	nsenterArgs, err := ctr.ExecArgs(args[1:])
+	common.MustLog("exec", err)
+	// nsenter 及容器中执行的命令继承当前进程的 cgroups
+	common.MustLog("exec", ctr.JoinCgroups(os.Getpid()))
+
+	cmd := exec.Command("nsenter", nsenterArgs...)
+	cmd.Env = os.Environ()
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		common.MustLog("exec", err)
+	}
+}
+
+// ~ update [options] [container name]
+func update(args []string) {
+	fset := flag.NewFlagSet(CMDNameUpdate, flag.ExitOnError)
+	ingressRate := fset.String("network-ingress-rate", "", "limit the rate of traffic into the container, 0 means unlimited")
+	egressRate := fset.String("network-egress-rate", "", "limit the rate of traffic out of the container, 0 means unlimited")
+	positional, err := parseInterleaved(fset, args)
+	common.MustLog("update parse args", err)
+	if len(positional) != 1 {
+		fmt.Print(HelpText)
+		return
+	}
+	containerName := positional[0]
+
+	if !container.ExistsContainer(containerName) {
+		fmt.Printf("container %s not found\n", containerName)
+		return
+	}
+	ctr, err := container.NewContainerFromDisk(containerName)
+	common.MustLog("update load container", err)
+
+	// 只修改指定的参数
+	ingress, egress := ctr.Config.NetworkIngressRate, ctr.Config.NetworkEgressRate
+	if *ingressRate != "" {
+		ingress, err = network.ParseRate(*ingressRate)
+		common.MustLog("parse network-ingress-rate", err)
+	}
+	if *egressRate != "" {
+		egress, err = network.ParseRate(*egressRate)
+		common.MustLog("parse network-egress-rate", err)
+	}
+	common.MustLog("update", ctr.UpdateBandwidth(ingress, egress))
+	fmt.Printf("ingress: %s, egress: %s\n", network.FormatRate(ingress), network.FormatRate(egress))
+}
+
+// parseRate 解析 run 的速率参数，为空时不限速
+func parseRate(spec string) (uint64, error) {
+	if spec == "" {
+		return 0, nil
+	}
+	return network.ParseRate(spec)
+}
+
+// ~ diff [container name] [--json]
+func diff(args []string) {
+	fset := flag.NewFlagSet(CMDNameDiff, flag.ExitOnError)
+	jsonOutput := fset.Bool("json", false, "print changes as JSON")
+	positional, err := parseInterleaved(fset, args)
+	common.MustLog("diff parse args", err)
+	if len(positional) != 1 {
+		fmt.Print(HelpText)
+		return
+	}
+	containerName := positional[0]
+
+	if !container.ExistsContainer(containerName) {
+		fmt.Printf("container %s not found\n", containerName)
+		return
+	}
+	ctr, err := container.NewContainerFromDisk(containerName)
+	common.MustLog("diff load container", err)
+
+	changes, err := ctr.Diff()
+	common.MustLog("diff", err)
+	summary := fs.SummarizeChanges(changes)
+
+	if *jsonOutput {
+		data, err := json.MarshalIndent(map[string]any{
+			"changes": changes,
+			"summary": summary,
+		}, "", "  ")
+		common.MustLog("diff marshal", err)
+		fmt.Println(string(data))
+		return
+	}
+
+	for _, c := range changes {
+		fmt.Printf("%s %s\n", c.Kind, c.Path)
+	}
+	fmt.Printf("\nAdded: %d, Changed: %d, Deleted: %d, Size: %s\n",
+		summary.Added, summary.Changed, summary.Deleted, common.HumanSize(summary.Size))
+}
+
+// ~ export [container name] [-o file]
+func export(args []string) {
+	fset := flag.NewFlagSet(CMDNameExport, flag.ExitOnError)
+	output := fset.String("o", "", "write to a file, instead of stdout")
+	positional, err := parseInterleaved(fset, args)
+	common.MustLog("export parse args", err)
+	if len(positional) != 1 {
+		fmt.Print(HelpText)
+		return
+	}
+	containerName := positional[0]
+
+	if !container.ExistsContainer(containerName) {
+		fmt.Printf("container %s not found\n", containerName)
+		return
+	}
+	ctr, err := container.NewContainerFromDisk(containerName)
+	common.MustLog("export load container", err)
+
+	if *output == "" {
+		common.MustLog("export", ctr.Export(os.Stdout))
+		return
+	}
+
+	file, err := os.Create(*output)
+	common.MustLog("export create file", err)
+	if err := common.ErrTag("export", ctr.Export(file), file.Close()); err != nil {
+		os.Remove(*output)
+		common.MustLog("export", err)
+	}
+}
+
+// ~ import [file|-] [image:tag]
+func importImage(args []string) {
+	if len(args) != 2 {
+		fmt.Print(HelpText)
+		return
+	}
+	var (
+		src = args[0]
+		ref = args[1]
+		r   = os.Stdin
+	)
+	if src != "-" {
+		file, err := os.Open(src)
+		common.MustLog("import open file", err)
+		defer file.Close()
+		r = file
+	}
+
+	img, err := image.Import(r, ref)
+	common.MustLog("import", err)
+	fmt.Println(img.Ref())
+}
+
+// ~ images
+func listImages() {
+	images, err := image.List()
+	common.MustLog("list images", err)
+
+	fmt.Printf("%v\t\t\t%v\t\t%v\t\t\t%v\n", "Name", "Tag", "Created", "Size")
+	for _, e := range images {
+		fmt.Printf("%v\t\t\t%v\t\t%v\t%v\n",
+			e.Name, e.Tag, e.Created.Format("2006-01-02 15:04:05"), common.HumanSize(e.Size))
+	}
+}
+
 func clearAll() {
 	containers, err := container.ListContainers()
 	common.ErrLog("list", err)
 	for _, e := range containers {
 		common.ErrLog("kill and remove", e.Kill(), e.Remove())
 	}
-
-	common.ErrLog("clear config root", os.RemoveAll(config.ConfigDir))
-	time.Sleep(time.Millisecond * 100)
-	common.ErrLog("clear config root", os.RemoveAll(config.ConfigDir))
+	// 网桥和防火墙规则在容器停止后删除，网络的配置保留
+	common.ErrLog("release bridges", network.ReleaseAllBridges())
+
+	// 本地镜像、命名卷和网络不属于容器，保留
+	for _, dir := range []string{
+		config.ContainerMountDir,
+		config.ContainerWorkDir,
+		config.ContainerCOWDir,
+		config.ContainerConfigDir,
+		config.IPPoolPath,
+	} {
+		common.ErrLog("clear config root", os.RemoveAll(dir))
+		time.Sleep(time.Millisecond * 100)
+		common.ErrLog("clear config root", os.RemoveAll(dir))
+	}
 }
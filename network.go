@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"mini-container/common"
+	"mini-container/container"
+	"mini-container/internal/network"
+	"mini-container/internal/network/dns"
+	"os"
+)
+
+const (
+	CMDNameNetwork = "network"
+
+	NetworkHelpText = `
+# mini-container network --help/-h
+
+Commands:
+~ network create [options] [network name]				create a network
+    	Options:
+    	--driver bridge|macvlan|ipvlan					network driver, default to bridge
+    	--parent interface						host interface of macvlan/ipvlan sub-interfaces, required by macvlan/ipvlan
+    	--ipvlan-mode l2|l3						ipvlan mode, default to l2
+    	--subnet cidr							subnet of the network, default to a free 192.172.x.0/24,
+    									required by macvlan/ipvlan (the subnet of the parent's LAN)
+    	--gateway ip							gateway (bridge address), default to the first ip of the subnet
+    	--ip-range cidr							allocate container ips from a sub-range of the subnet
+    	--bridge name							bridge device name, default to mc-<network name>
+    	--mtu n								mtu of the bridge and container interfaces
+    	--internal							no SNAT and no default route, containers can not reach outside
+    	--ipv6								enable ipv6 (dual-stack), containers get an ipv6 address as well
+    	--subnet6 cidr							ipv6 subnet, default to a random fdxx:xxxx:xxxx::/64, implies --ipv6
+    	--gateway6 ip							ipv6 gateway, default to the first ip of the ipv6 subnet
+~ network ls								list networks
+~ network inspect [network name...]					show network details as JSON
+~ network rm [network name...]						remove networks not used by any container
+~ network connect [network name] [container name]			connect a running container to another network
+~ network disconnect [network name] [container name]			disconnect a container from a network it was connected to
+~ network check [container name]					run the CNI CHECK of a running container in a cni:<name> network mode
+~ network allow [from network] [to network] [port[/tcp|udp]]		allow containers in a network to reach another network, all ports if omitted
+~ network allow								list allow rules
+~ network disallow [from network] [to network] [port[/tcp|udp]]	remove an allow rule
+~ network rules [--prune]						list firewall rules added by mini-container,
+									--prune removes rules of bridges without a network first
+
+Containers in different networks can not reach each other unless allowed,
+internal networks can not reach outside either.
+Containers in macvlan/ipvlan networks appear directly on the parent's LAN, they do not support
+published ports, the embedded DNS, isolation and rate limits, and the host can not reach them via the parent.
+Firewall rules are managed by iptables, or nftables when iptables is not installed,
+set MINI_CONTAINER_FIREWALL=iptables|nftables to choose one.
+CNI network config lists (run --network cni:<name>) are read from /etc/cni/net.d and plugins from /opt/cni/bin,
+set MINI_CONTAINER_CNI_CONF_DIR and MINI_CONTAINER_CNI_PATH to change them.
+`
+)
+
+// ~ network [create|ls|inspect|rm|connect|disconnect|check|allow|disallow|rules] ...
+func networkCmd(args []string) {
+	if len(args) == 0 {
+		fmt.Print(NetworkHelpText)
+		return
+	}
+
+	switch args[0] {
+	case "create":
+		fset := flag.NewFlagSet("network create", flag.ExitOnError)
+		opts := &network.CreateOptions{}
+		fset.StringVar(&opts.Subnet, "subnet", "", "subnet of the network")
+		fset.StringVar(&opts.Gateway, "gateway", "", "gateway of the network")
+		fset.StringVar(&opts.IPRange, "ip-range", "", "allocate container ips from a sub-range of the subnet")
+		fset.StringVar(&opts.Bridge, "bridge", "", "bridge device name")
+		fset.IntVar(&opts.MTU, "mtu", 0, "mtu of the bridge and container interfaces")
+		fset.BoolVar(&opts.Internal, "internal", false, "restrict external access to the network")
+		fset.BoolVar(&opts.IPv6, "ipv6", false, "enable ipv6")
+		fset.StringVar(&opts.Subnet6, "subnet6", "", "ipv6 subnet of the network")
+		fset.StringVar(&opts.Gateway6, "gateway6", "", "ipv6 gateway of the network")
+		fset.StringVar(&opts.Driver, "driver", network.DriverBridge, "network driver: bridge, macvlan or ipvlan")
+		fset.StringVar(&opts.Parent, "parent", "", "host interface of macvlan/ipvlan sub-interfaces")
+		fset.StringVar(&opts.IPVlanMode, "ipvlan-mode", "", "ipvlan mode: l2 or l3")
+		names, err := parseInterleaved(fset, args[1:])
+		common.MustLog("network create parse args", err)
+		if len(names) != 1 {
+			fmt.Print(NetworkHelpText)
+			return
+		}
+		n, err := network.CreateNetwork(names[0], opts)
+		common.MustLog("network create", err)
+		fmt.Println(n.Name)
+
+	case "ls":
+		networks, err := network.ListNetworks()
+		common.MustLog("network ls", err)
+		fmt.Printf("%v\t\t%v\t\t%v\t\t%v\t\t%v\n", "Name", "Driver", "Device", "Subnet", "Gateway")
+		for _, n := range networks {
+			fmt.Printf("%v\t\t%v\t\t%v\t\t%v\t\t%v\n", n.Name, n.DriverName(), n.Device(), n.Subnet(), n.Gateway().IP)
+		}
+
+	case "inspect":
+		result := make([]map[string]any, 0)
+		for _, name := range args[1:] {
+			n, err := network.GetNetwork(name)
+			common.MustLog("network inspect", err)
+			containers, err := container.ListContainersInNetwork(n.Name)
+			common.MustLog("network inspect", err)
+			ipRange := ""
+			if n.IPRange != nil {
+				ipRange = n.IPRange.String()
+			}
+			subnet6, gateway6 := "", ""
+			if n.Subnet6() != nil {
+				subnet6, gateway6 = n.Subnet6().String(), n.Gateway6().IP.String()
+			}
+			result = append(result, map[string]any{
+				"name":       n.Name,
+				"driver":     n.DriverName(),
+				"bridge":     n.Bridge.Name,
+				"parent":     n.Parent,
+				"ipvlanMode": n.IPVlanMode,
+				"subnet":     n.Subnet().String(),
+				"gateway":    n.Gateway().IP.String(),
+				"ipRange":    ipRange,
+				"subnet6":    subnet6,
+				"gateway6":   gateway6,
+				"mtu":        n.Bridge.MTU,
+				"internal":   n.Internal,
+				"createdAt":  n.CreatedAt,
+				"containers": containers,
+			})
+		}
+		data, err := json.MarshalIndent(result, "", "  ")
+		common.MustLog("network inspect", err)
+		fmt.Println(string(data))
+
+	case "rm":
+		failed := false
+		for _, name := range args[1:] {
+			containers, err := container.ListContainersInNetwork(name)
+			if err == nil && len(containers) > 0 {
+				err = fmt.Errorf("network %s is in use by %v", name, containers)
+			}
+			if err == nil {
+				err = network.RemoveNetwork(name)
+			}
+			if common.ErrLog("network rm", err) {
+				failed = true
+				continue
+			}
+			fmt.Println(name)
+		}
+		if failed {
+			os.Exit(1)
+		}
+
+	case "connect", "disconnect":
+		if len(args) != 3 {
+			fmt.Print(NetworkHelpText)
+			return
+		}
+		ctr, err := container.NewContainerFromDisk(args[2])
+		common.MustLog("network "+args[0], err)
+		if args[0] == "connect" {
+			err = ctr.Connect(args[1])
+		} else {
+			err = ctr.Disconnect(args[1])
+		}
+		common.MustLog("network "+args[0], err)
+		fmt.Println(ctr.Config.Name)
+
+	case "check":
+		if len(args) != 2 {
+			fmt.Print(NetworkHelpText)
+			return
+		}
+		ctr, err := container.NewContainerFromDisk(args[1])
+		common.MustLog("network check", err)
+		common.MustLog("network check", ctr.CheckCNINetwork())
+		fmt.Println(ctr.Config.Name)
+
+	case "allow", "disallow":
+		if args[0] == "allow" && len(args) == 1 {
+			rules, err := network.ListAllowRules()
+			common.MustLog("network allow", err)
+			for _, r := range rules {
+				fmt.Println(r)
+			}
+			return
+		}
+		if len(args) != 3 && len(args) != 4 {
+			fmt.Print(NetworkHelpText)
+			return
+		}
+		portSpec := ""
+		if len(args) == 4 {
+			portSpec = args[3]
+		}
+		r, err := network.NewAllowRule(args[1], args[2], portSpec)
+		common.MustLog("network "+args[0], err)
+		if args[0] == "allow" {
+			err = network.AddAllowRule(r)
+		} else {
+			err = network.RemoveAllowRule(r)
+		}
+		common.MustLog("network "+args[0], err)
+		fmt.Println(r)
+
+	case "rules":
+		fset := flag.NewFlagSet("network rules", flag.ExitOnError)
+		prune := fset.Bool("prune", false, "remove rules of bridges without a network")
+		common.MustLog("network rules parse args", fset.Parse(args[1:]))
+		if *prune {
+			pruned, err := network.PruneFirewallRules()
+			common.MustLog("network rules prune", err)
+			for _, name := range pruned {
+				fmt.Println("pruned rules of bridge", name)
+			}
+		}
+		backend, rules, err := network.FirewallRules()
+		common.MustLog("network rules", err)
+		fmt.Println("Firewall:", backend)
+		fmt.Printf("%v\t%v\t%v\t\t%v\t\t%v\n", "Family", "Table", "Chain", "Owner", "Rule")
+		for _, r := range rules {
+			owner := r.Owner
+			if owner == "" {
+				owner = "-"
+			}
+			fmt.Printf("%v\t%v\t%v\t\t%v\t\t%v\n", r.Family, r.Table, r.Chain, owner, r.Spec)
+		}
+
+	default:
+		fmt.Print(NetworkHelpText)
+	}
+}
+
+// ~ dns-serve [network name]
+// 网络的内置 DNS 进程，由使用该网络的容器启动时自动创建
+func dnsServe(name string) {
+	common.MustLog("dns-serve", network.ServeDNS(name, func() ([]*dns.Record, error) {
+		return container.DNSRecords(name)
+	}))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"mini-container/common"
+	"mini-container/internal/volume"
+	"os"
+)
+
+const (
+	CMDNameVolume = "volume"
+
+	VolumeHelpText = `
+# mini-container volume --help/-h
+
+Commands:
+~ volume create [volume name]						create a named volume, a random name is generated if omitted
+~ volume ls								list volumes
+~ volume inspect [volume name...]					show volume details as JSON
+~ volume rm [-f] [volume name...]					remove volumes, -f removes volumes still used by containers
+~ volume prune								remove all volumes not used by any container
+`
+)
+
+// ~ volume [create|ls|inspect|rm|prune] ...
+func volumeCmd(args []string) {
+	if len(args) == 0 {
+		fmt.Print(VolumeHelpText)
+		return
+	}
+
+	switch args[0] {
+	case "create":
+		name := ""
+		if len(args) > 1 {
+			name = args[1]
+		}
+		v, err := volume.Create(name)
+		common.MustLog("volume create", err)
+		fmt.Println(v.Name)
+
+	case "ls":
+		volumes, err := volume.List()
+		common.MustLog("volume ls", err)
+		fmt.Printf("%v\t\t\t%v\t\t%v\n", "Name", "Refs", "Containers")
+		for _, v := range volumes {
+			fmt.Printf("%v\t\t\t%v\t\t%v\n", v.Name, len(v.Containers), v.Containers)
+		}
+
+	case "inspect":
+		result := make([]map[string]any, 0)
+		for _, name := range args[1:] {
+			v, err := volume.Get(name)
+			common.MustLog("volume inspect", err)
+			result = append(result, map[string]any{
+				"name":        v.Name,
+				"mountpoint":  v.DataDir(),
+				"createdAt":   v.CreatedAt,
+				"containers":  v.Containers,
+				"refCount":    len(v.Containers),
+				"initialized": v.Initialized,
+			})
+		}
+		data, err := json.MarshalIndent(result, "", "  ")
+		common.MustLog("volume inspect", err)
+		fmt.Println(string(data))
+
+	case "rm":
+		fset := flag.NewFlagSet("volume rm", flag.ExitOnError)
+		force := fset.Bool("f", false, "remove volumes still used by containers")
+		names, err := parseInterleaved(fset, args[1:])
+		common.MustLog("volume rm parse args", err)
+		failed := false
+		for _, name := range names {
+			if common.ErrLog("volume rm", volume.Remove(name, *force)) {
+				failed = true
+				continue
+			}
+			fmt.Println(name)
+		}
+		if failed {
+			os.Exit(1)
+		}
+
+	case "prune":
+		removed, err := volume.Prune()
+		for _, name := range removed {
+			fmt.Println(name)
+		}
+		common.MustLog("volume prune", err)
+
+	default:
+		fmt.Print(VolumeHelpText)
+	}
+}